@@ -16,8 +16,13 @@ This is a port of munificent's bantam:
 package bantam
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // PrefixParser is of the two interfaces used by the Pratt parser.
@@ -41,29 +46,157 @@ type InfixParser interface {
 	Precedence() int
 }
 
+// PrefixInfixParser is implemented by parsers that handle a token both at
+// the beginning and in the middle of an expression, like "-" in "-a - b".
+// A type can't have two Parse methods, so they are named ParsePrefix and
+// ParseInfix; use Parser.RegisterBoth to register one.
+type PrefixInfixParser interface {
+	ParsePrefix(*Parser, Token) Node
+	ParseInfix(*Parser, Node, Token) Node
+	Precedence() int
+}
+
+// StmtParser parses a statement that starts with a given token, like a
+// declaration introduced by a keyword. Its Parse method is called with the
+// consumed leading token and must not consume the semicolon that ends the
+// statement.
+type StmtParser interface {
+	Parse(*Parser, Token) Stmt
+}
+
+// AsPrefix returns the prefix side of a PrefixInfixParser, to register it
+// only as a prefix parser.
+func AsPrefix(p PrefixInfixParser) PrefixParser {
+	return prefixOf{p}
+}
+
+// AsInfix returns the infix side of a PrefixInfixParser, to register it
+// only as an infix parser.
+func AsInfix(p PrefixInfixParser) InfixParser {
+	return infixOf{p}
+}
+
+// prefixOf adapts a PrefixInfixParser to the PrefixParser interface.
+type prefixOf struct {
+	PrefixInfixParser
+}
+
+func (p prefixOf) Parse(parser *Parser, token Token) Node {
+	return p.ParsePrefix(parser, token)
+}
+
+// infixOf adapts a PrefixInfixParser to the InfixParser interface.
+type infixOf struct {
+	PrefixInfixParser
+}
+
+func (p infixOf) Parse(parser *Parser, left Node, token Token) Node {
+	return p.ParseInfix(parser, left, token)
+}
+
 // ----------------------------------------------------------------------------
 
+// Precedence levels used by the default parsers, from lowest to highest.
+// Custom operators can be placed relative to them.
+const (
+	PrecSequence    = iota + 1 // a, b
+	PrecAssignment             // a = b
+	PrecConditional            // a ? b : c
+	PrecLogicalOr              // a || b
+	PrecLogicalAnd             // a && b
+	PrecBitOr                  // a | b
+	PrecBitAnd                 // a & b
+	PrecEquality               // a == b
+	PrecComparison             // a < b
+	PrecShift                  // a << b
+	PrecSum                    // a + b
+	PrecProduct                // a * b
+	PrecExponent               // a ^ b
+	PrecPrefix                 // -a
+	PrecPostfix                // a!
+	PrecCall                   // a(b)
+)
+
 // Default prefix parsers for the Bantam language.
 var PrefixParsers = map[TokenType]PrefixParser{
 	TokenName:        NameParser(0),
+	TokenNumber:      NumberParser(0),
+	TokenString:      StringParser(0),
+	TokenInterpStart: InterpolationParser(0),
 	TokenParenL:      GroupParser(0),
-	TokenPlus:        UnaryParser(6),
-	TokenMinus:       UnaryParser(6),
-	TokenTilde:       UnaryParser(6),
-	TokenExclamation: UnaryParser(6),
+	TokenBraceL:      BlockParser(0),
+	TokenPlus:        UnaryParser(PrecPrefix),
+	TokenMinus:       UnaryParser(PrecPrefix),
+	TokenTilde:       UnaryParser(PrecPrefix),
+	TokenExclamation: UnaryParser(PrecPrefix),
+	TokenIncrement:   UnaryParser(PrecPrefix),
+	TokenDecrement:   UnaryParser(PrecPrefix),
+	TokenFn:          LambdaParser(PrecSequence),
+	TokenIf:          IfParser(PrecSequence),
+	TokenWhile:       WhileParser(PrecSequence),
+	TokenNull:        LiteralParser(0),
 }
 
 // Default infix parsers for the Bantam language.
 var InfixParsers = map[TokenType]InfixParser{
-	TokenAssignment:  AssignParser(1),
-	TokenQuestion:    TernaryParser(2),
-	TokenPlus:        BinaryParser(3),
-	TokenMinus:       BinaryParser(3),
-	TokenAsterisk:    BinaryParser(4),
-	TokenSlash:       BinaryParser(4),
-	TokenCaret:       BinaryRightParser(5),
-	TokenExclamation: UnaryPostfixParser(7),
-	TokenParenL:      FunctionParser(8),
+	TokenComma:       SequenceParser(PrecSequence),
+	TokenAssignment:  AssignParser(PrecAssignment),
+	TokenPlusAssign:  CompoundAssignParser(PrecAssignment),
+	TokenMinusAssign: CompoundAssignParser(PrecAssignment),
+	TokenMulAssign:   CompoundAssignParser(PrecAssignment),
+	TokenDivAssign:   CompoundAssignParser(PrecAssignment),
+	TokenQuestion:    TernaryParser(PrecConditional),
+	TokenElvis:       ElvisParser(PrecConditional),
+	TokenOr:          BinaryParser(PrecLogicalOr),
+	TokenAnd:         BinaryParser(PrecLogicalAnd),
+	TokenPipe:        BinaryParser(PrecBitOr),
+	TokenAmpersand:   BinaryParser(PrecBitAnd),
+	TokenEqual:       ComparisonParser(PrecEquality),
+	TokenNotEqual:    ComparisonParser(PrecEquality),
+	TokenLess:        ComparisonParser(PrecComparison),
+	TokenGreater:     ComparisonParser(PrecComparison),
+	TokenLessEq:      ComparisonParser(PrecComparison),
+	TokenGreaterEq:   ComparisonParser(PrecComparison),
+	TokenShiftLeft:   BinaryParser(PrecShift),
+	TokenShiftRight:  BinaryParser(PrecShift),
+	TokenPlus:        BinaryParser(PrecSum),
+	TokenMinus:       BinaryParser(PrecSum),
+	TokenAsterisk:    BinaryParser(PrecProduct),
+	TokenSlash:       BinaryParser(PrecProduct),
+	TokenCaret:       BinaryRightParser(PrecExponent),
+	TokenExclamation: UnaryPostfixParser(PrecPostfix),
+	TokenIncrement:   UnaryPostfixParser(PrecPostfix),
+	TokenDecrement:   UnaryPostfixParser(PrecPostfix),
+	TokenParenL:      FunctionParser(PrecCall),
+}
+
+// ----------------------------------------------------------------------------
+
+// ParseError is the error returned when an expression can't be parsed.
+//
+// Pos is the position of the next token in the stack when parsing stopped,
+// which is usually the token that caused the error. The message doesn't
+// include it; callers can use it to point to the problem in the source.
+// If that token is a TokenError from the lexer, like for an unterminated
+// string, the error is the lexer one, with its message and position.
+//
+// Token is that token, so callers can highlight or inspect it without
+// matching the message, and Expected lists the token types that would have
+// been accepted instead, when they are known.
+type ParseError struct {
+	Msg      string
+	Token    Token
+	Pos      Pos
+	Expected []TokenType
+}
+
+func (e *ParseError) Error() string {
+	return e.Msg
+}
+
+// lexError returns the error for a TokenError token.
+func lexError(t Token) *ParseError {
+	return &ParseError{Msg: t.Text, Token: t, Pos: t.Pos}
 }
 
 // ----------------------------------------------------------------------------
@@ -71,10 +204,98 @@ var InfixParsers = map[TokenType]InfixParser{
 // Parser parses a token stack and builds an abstract syntax tree.
 type Parser struct {
 	*Stack
+	// The parser maps may be shared with other parsers, like the package
+	// defaults; use Clone to get a parser with its own maps before
+	// registering or removing operators.
 	PrefixParsers map[TokenType]PrefixParser
 	InfixParsers  map[TokenType]InfixParser
+	// PrefixWords and InfixWords map the text of name tokens to parsers,
+	// so that words like "not" or "and" can be used as operators without a
+	// token type of their own. For name tokens they are consulted before
+	// PrefixParsers and InfixParsers.
+	PrefixWords map[string]PrefixParser
+	InfixWords  map[string]InfixParser
+	// StmtParsers maps the token types that start statements to their
+	// parsers, for ParseProgram and ParseAll. Other statements are
+	// expressions.
+	StmtParsers map[TokenType]StmtParser
+	// DefaultPrefix, if set, parses tokens that have no prefix parser,
+	// instead of failing. For example, NameParser(0) accepts any stray
+	// token as a name made of its text. EOF and error tokens are never
+	// passed to it.
+	DefaultPrefix PrefixParser
+	// OperatorSections enables operator sections: inside parentheses, a
+	// binary operator with a missing operand, like "(+ 1)" or "(1 +)", is
+	// parsed as a lambda that takes the missing operand as its parameter.
+	// Note that this makes "(-a)" a section instead of a negation.
+	OperatorSections bool
+	// FoldNegativeLiterals makes a minus sign directly followed by a number
+	// parse as a single negative NumberNode instead of a UnaryNode.
+	FoldNegativeLiterals bool
+	// DisallowChainedComparison makes comparisons like "a < b < c" an
+	// error, since they compare the result of "a < b" with "c". The left
+	// operand is checked after parsing, so "(a < b) < c" is rejected too.
+	DisallowChainedComparison bool
+	// AssignmentAsStatement restricts assignments to statement position:
+	// an assignment nested in another expression, like "c + (a = b)" or
+	// "a = b = c", is an error. The expressions parsed by Parse and
+	// ParseAll, the expressions of a block and the bodies of "if" and
+	// "while" in statement position are statements; parentheses around
+	// them are allowed.
+	AssignmentAsStatement bool
+	// PrecedenceFunc, if set, is called with each infix operator token. A
+	// non-zero result overrides the precedence of the parser registered
+	// for the token, so that grammars can declare the fixity of each
+	// symbol, like user-defined word operators. OperatorParser,
+	// BinaryParser and BinaryRightParser also use it to parse their right
+	// operand.
+	PrecedenceFunc func(Token) int
+	// OnNode, if set, is called once for each node built by the prefix and
+	// infix parsers, as soon as the node is complete.
+	OnNode func(Node)
+	// AllowEmpty makes Parse return a nil node instead of an error when
+	// the input has no tokens.
+	AllowEmpty bool
+	// AllowTrailing makes Parse stop after the first expression and leave
+	// any tokens after it in the stack, instead of returning an error. It
+	// is useful to parse a prefix of a larger input.
+	AllowTrailing bool
+	// MaxTokens is the maximum number of tokens a parse may read from the
+	// lexer, including EOF. Zero means no limit.
+	MaxTokens int
+	// MaxDepth is the maximum nesting level of expressions, like the
+	// number of open parentheses, so that deeply nested input fails with
+	// an error instead of using unbounded memory. Zero means no limit.
+	// Operators and parentheses nest without recursion, but other
+	// parselets, like function calls, still use the goroutine stack, so set
+	// it when parsing untrusted input.
+	MaxDepth int
+	// AttachComments makes Parse and ParseAll attach the comments found
+	// in each expression to its nodes, to be returned by Trivia. A comment
+	// is attached to the first node that starts after it or, if there is
+	// none, to the last node of the expression. The lexer must keep
+	// comments, like a StringLexer with KeepComments set.
+	AttachComments bool
+	// SyncTokens are the token types where ParseRecover resumes parsing
+	// after an error: the tokens up to the next one of them are skipped.
+	// If it is empty, DefaultSyncTokens is used.
+	SyncTokens []TokenType
+	sections   int              // Counter used to name section parameters.
+	ctx        context.Context  // Context of the current parse.
+	started    int              // Tokens read before the current parse.
+	depth      int              // Nesting level of parseExpression calls.
+	stmt       int              // Depth of the first operand of a statement.
+	assignable bool             // Set for an infix operator in statement position.
+	trivia     map[Node][]Token // Comments attached to nodes.
+	recovering bool             // Set by ParseRecover.
+	errs       []*ParseError    // Errors recorded by ParseRecover.
+	trace      io.Writer        // Set by Trace.
 }
 
+// DefaultSyncTokens are the token types where ParseRecover resumes parsing
+// if the parser has no SyncTokens.
+var DefaultSyncTokens = []TokenType{TokenComma, TokenSemicolon, TokenParenR}
+
 // NewParser returns a new parser for the given token stack.
 func NewParser(stack *Stack) *Parser {
 	return &Parser{
@@ -84,60 +305,926 @@ func NewParser(stack *Stack) *Parser {
 	}
 }
 
+// NewSimpleParser returns a parser with the default grammar for a source
+// made of single-character tokens, which is handy to experiment with
+// grammars without writing a lexer. Characters in symbols are read as the
+// mapped token types, spaces are skipped and any other character is a
+// name, so "ab" is two names.
+func NewSimpleParser(src string, symbols map[string]TokenType) *Parser {
+	return &Parser{
+		Stack:         NewStack(&simpleLexer{src: src, symbols: symbols}),
+		PrefixParsers: PrefixParsers,
+		InfixParsers:  InfixParsers,
+	}
+}
+
+// ParseString parses src with the built-in lexer and the default grammar,
+// the common case that otherwise needs a lexer, a stack and a parser.
+func ParseString(src string) (Node, error) {
+	p := &Parser{
+		Stack:         NewStack(NewLexer(src)),
+		PrefixParsers: PrefixParsers,
+		InfixParsers:  InfixParsers,
+	}
+	return p.Parse()
+}
+
+// Reset makes the parser read from another stack and clears the state left
+// by previous parses, so that a parser can be reused for many inputs, for
+// example from a sync.Pool, without building its grammar again. The
+// grammar maps, the exported options and the Trace writer are kept. The
+// comments attached for Trivia, the counter used to name section
+// parameters and the state of ParseRecover are cleared. Reuse the stack
+// too with Stack.Reset:
+//
+//	p.Stack.Reset(NewLexer(src))
+//	p.Reset(p.Stack)
+func (p *Parser) Reset(stack *Stack) {
+	p.Stack = stack
+	p.sections = 0
+	p.ctx = nil
+	p.started = 0
+	p.depth = 0
+	p.stmt, p.assignable = 0, false
+	p.trivia = nil
+	p.recovering = false
+	p.errs = nil
+}
+
+// Clone returns a copy of the parser with its own copies of the prefix and
+// infix parser maps, including the word maps, so that operators can be
+// registered in one parser without affecting the other. The clone shares
+// the same token stack; set its Stack field to parse a different input.
+func (p *Parser) Clone() *Parser {
+	c := *p
+	c.PrefixParsers = make(map[TokenType]PrefixParser, len(p.PrefixParsers))
+	for k, v := range p.PrefixParsers {
+		c.PrefixParsers[k] = v
+	}
+	c.InfixParsers = make(map[TokenType]InfixParser, len(p.InfixParsers))
+	for k, v := range p.InfixParsers {
+		c.InfixParsers[k] = v
+	}
+	if p.PrefixWords != nil {
+		c.PrefixWords = make(map[string]PrefixParser, len(p.PrefixWords))
+		for k, v := range p.PrefixWords {
+			c.PrefixWords[k] = v
+		}
+	}
+	if p.InfixWords != nil {
+		c.InfixWords = make(map[string]InfixParser, len(p.InfixWords))
+		for k, v := range p.InfixWords {
+			c.InfixWords[k] = v
+		}
+	}
+	return &c
+}
+
+// RegisterPrefix registers the prefix parser for the given token type,
+// replacing any previous one.
+func (p *Parser) RegisterPrefix(t TokenType, parser PrefixParser) {
+	p.PrefixParsers[t] = parser
+}
+
+// RegisterInfix registers the infix parser for the given token type,
+// replacing any previous one.
+func (p *Parser) RegisterInfix(t TokenType, parser InfixParser) {
+	p.InfixParsers[t] = parser
+}
+
+// Infix registers a binary operator for the given token type, with the
+// given precedence and associativity. See OperatorParser.
+func (p *Parser) Infix(t TokenType, prec int, assoc Assoc) {
+	p.InfixParsers[t] = OperatorParser{prec, assoc}
+}
+
+// RegisterBoth registers a parser as both the prefix and the infix parser
+// for the given token type.
+func (p *Parser) RegisterBoth(t TokenType, parser PrefixInfixParser) {
+	p.PrefixParsers[t] = prefixOf{parser}
+	p.InfixParsers[t] = infixOf{parser}
+}
+
+// UnregisterPrefix removes the prefix parser for the given token type.
+func (p *Parser) UnregisterPrefix(t TokenType) {
+	delete(p.PrefixParsers, t)
+}
+
+// UnregisterInfix removes the infix parser for the given token type.
+func (p *Parser) UnregisterInfix(t TokenType) {
+	delete(p.InfixParsers, t)
+}
+
+// Validate checks the grammar for misconfigurations and returns an error
+// describing the first one found. Currently it reports infix parsers with a
+// precedence lower than 1: the parse loop never consumes them, so their
+// operators are silently rejected as trailing tokens.
+func (p *Parser) Validate() error {
+	types := make([]int, 0, len(p.InfixParsers))
+	for t := range p.InfixParsers {
+		types = append(types, int(t))
+	}
+	sort.Ints(types)
+	for _, t := range types {
+		if prec := p.InfixParsers[TokenType(t)].Precedence(); prec < 1 {
+			return fmt.Errorf("infix parser for %s has precedence %d and will never be used", TokenType(t), prec)
+		}
+	}
+	words := make([]string, 0, len(p.InfixWords))
+	for w := range p.InfixWords {
+		words = append(words, w)
+	}
+	sort.Strings(words)
+	for _, w := range words {
+		if prec := p.InfixWords[w].Precedence(); prec < 1 {
+			return fmt.Errorf("infix parser for %q has precedence %d and will never be used", w, prec)
+		}
+	}
+	return nil
+}
+
 // Parse consumes the token stack and returns a node that represents an
-// expression. If parsing fails it also returns an error.
-func (p *Parser) Parse() (n Node, err error) {
+// expression. If parsing fails it also returns an error. Tokens left after
+// the expression are an error, unless AllowTrailing is set. Empty input,
+// including input with only spaces and comments, is an error too, unless
+// AllowEmpty is set; then Parse returns a nil node and a nil error.
+func (p *Parser) Parse() (Node, error) {
+	return p.ParseContext(context.Background())
+}
+
+// ParseContext is like Parse but stops parsing if the context is done,
+// returning the context error. The context is checked as each expression
+// and operator is parsed.
+func (p *Parser) ParseContext(ctx context.Context) (n Node, err error) {
 	defer p.recover(&err)
-	n = p.parseExpression(0)
+	p.ctx = ctx
+	p.started = p.read
+	p.depth = 0
+	p.trivia = nil
+	if p.Peek(0).Type == TokenEOF {
+		if p.AllowEmpty {
+			return nil, nil
+		}
+		p.errorf("empty input")
+	}
+	if n, ok := p.parseSingle(); ok {
+		p.attachComments(n)
+		return n, nil
+	}
+	n = p.parseStatement(0)
 	// Our expression terminator is simply EOF.
-	if p.Peek(0).Type != TokenEOF {
-		p.errorf("expected EOF, got %s", p.Peek(0))
+	if !p.AllowTrailing {
+		if err := p.ExpectEOF(); err != nil {
+			panic(err)
+		}
+	}
+	p.attachComments(n)
+	return
+}
+
+// ParseExpressionAt parses an expression at the current position of the
+// stack, like Parse with AllowTrailing set: it stops before the first token
+// it can't continue with, which is left in the stack. This allows parsing
+// an expression embedded in a larger document, like a template. It returns
+// the expression, the number of tokens consumed and the position of the
+// first token left, whose Offset is where the rest of the input starts.
+func (p *Parser) ParseExpressionAt() (n Node, consumed int, rest Pos, err error) {
+	start := p.popped()
+	defer func() {
+		consumed = p.popped() - start
+		rest = p.Peek(0).Pos
+	}()
+	defer p.recover(&err)
+	p.ctx = context.Background()
+	p.started = p.read
+	p.depth = 0
+	p.trivia = nil
+	if p.Peek(0).Type == TokenEOF {
+		p.errorf("empty input")
 	}
+	n = p.parseStatement(0)
+	p.attachComments(n)
 	return
 }
 
+// ParseRecover is like Parse but doesn't stop at the first error. When an
+// expression fails to parse, the error is recorded, the tokens up to the
+// next sync token are skipped (see SyncTokens) and the expression is
+// replaced by an ErrorNode, so that the enclosing expression can go on.
+// It returns a best-effort tree and the errors in the order they were
+// found, which is useful for editors that report all the problems at once.
+// The tree is nil if nothing could be parsed.
+func (p *Parser) ParseRecover() (Node, []*ParseError) {
+	p.recovering = true
+	p.errs = nil
+	defer func() {
+		p.recovering = false
+		p.errs = nil
+	}()
+	n, err := p.Parse()
+	if err != nil {
+		p.record(p.toParseError(err))
+	}
+	return n, p.errs
+}
+
+// ExpectEOF returns an error if the token stack has tokens left before EOF.
+// Parse already checks it; it is meant for callers that parse a prefix of
+// the input with ParseExpression.
+func (p *Parser) ExpectEOF() error {
+	return p.expectEOF()
+}
+
+// expectEOF returns an error if the stack has tokens left before EOF.
+func (s *Stack) expectEOF() error {
+	t := s.Peek(0)
+	switch t.Type {
+	case TokenEOF:
+		return nil
+	case TokenError:
+		return lexError(t)
+	}
+	return &ParseError{Msg: fmt.Sprintf("unexpected token %s after expression", t), Token: t, Pos: t.Pos,
+		Expected: []TokenType{TokenEOF}}
+}
+
+// ParseAll parses a program made of expressions separated by semicolons,
+// calling yield for each expression as soon as it is parsed, so a program
+// can be processed without keeping all of it in memory. It stops when yield
+// returns false or at EOF, and returns the error if parsing fails.
+// A semicolon after the last expression is optional. Statements that start
+// with a token in StmtParsers are parsed by them and yielded as they are.
+//
+// If the lexer emits newline tokens, like a StringLexer with
+// SignificantNewlines set, a newline also ends an expression, unless the
+// expression is incomplete, like in "a +" followed by a newline. Blank
+// lines are skipped.
+func (p *Parser) ParseAll(yield func(Node) bool) (err error) {
+	defer p.recover(&err)
+	p.ctx = context.Background()
+	p.started = p.read
+	p.depth = 0
+	p.trivia = nil
+	for {
+		for p.Match(TokenNewline) {
+		}
+		if p.Peek(0).Type == TokenEOF {
+			break
+		}
+		n := p.parseStmt()
+		if !p.Match(TokenSemicolon) && !p.Match(TokenNewline) && p.Peek(0).Type != TokenEOF {
+			p.errorf("expected ; or EOF, got %s", p.Peek(0))
+		}
+		p.attachComments(n)
+		if !yield(n) {
+			break
+		}
+	}
+	return
+}
+
+// ParseProgram parses a program made of statements separated by
+// semicolons, like ParseAll, and returns them in a ProgramNode. Statements
+// that are expressions are wrapped in an ExprStmt.
+func (p *Parser) ParseProgram() (*ProgramNode, error) {
+	prog := NewProgramNode()
+	prog.Pos = p.Peek(0).Pos
+	err := p.ParseAll(func(n Node) bool {
+		s, ok := n.(Stmt)
+		if !ok {
+			e := NewExprStmt(n)
+			e.Pos = n.Position()
+			s = e
+		}
+		prog.Stmts = append(prog.Stmts, s)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// parseStmt parses a statement with its StmtParser, or an expression.
+func (p *Parser) parseStmt() Node {
+	if parser, ok := p.StmtParsers[p.Peek(0).Type]; ok {
+		s := parser.Parse(p, p.Pop())
+		p.done(s)
+		return s
+	}
+	return p.parseStatement(0)
+}
+
+// Trivia returns the comments attached to a node by the last call to Parse
+// or ParseAll, in source order. See AttachComments.
+func (p *Parser) Trivia(n Node) []Token {
+	return p.trivia[n]
+}
+
+// attachComments attaches the comments read since the last call to the
+// nodes of n, if AttachComments is set.
+func (p *Parser) attachComments(n Node) {
+	comments := p.Comments()
+	if !p.AttachComments || n == nil || p.attached == len(comments) {
+		return
+	}
+	var nodes []Node
+	Walk(n, func(n Node) bool {
+		if n.Position().Line > 0 {
+			nodes = append(nodes, n)
+		}
+		return true
+	})
+	if len(nodes) == 0 {
+		nodes = append(nodes, n)
+	}
+	if p.trivia == nil {
+		p.trivia = make(map[Node][]Token)
+	}
+	for _, c := range comments[p.attached:] {
+		var next, last Node
+		for _, v := range nodes {
+			offset := v.Position().Offset
+			if offset >= c.Pos.Offset && (next == nil || offset < next.Position().Offset) {
+				next = v
+			}
+			if last == nil || offset > last.Position().Offset {
+				last = v
+			}
+		}
+		if next == nil {
+			next = last
+		}
+		p.trivia[next] = append(p.trivia[next], c)
+	}
+	p.attached = len(comments)
+}
+
+// ParseExpression parses an expression, consuming operators while their
+// precedence is higher than the given one. It lets prefix and infix parsers
+// implemented in other packages recurse into the parser, like the ones in
+// this package do.
+func (p *Parser) ParseExpression(precedence int) Node {
+	return p.parseExpression(precedence)
+}
+
+// parseSingle is a fast path for expressions made of a single name or
+// literal, like "a" or "42", which are common enough to skip the general
+// algorithm. If the input is anything else it returns false and leaves the
+// tokens in the stack. It is disabled when MaxTokens is set, so that tokens
+// are counted as in the general path.
+func (p *Parser) parseSingle() (Node, bool) {
+	if p.MaxTokens > 0 {
+		return nil, false
+	}
+	p.checkContext()
+	token := p.Pop()
+	prefix, _ := p.prefixParser(token)
+	switch prefix.(type) {
+	case NameParser, NumberParser, StringParser, LiteralParser:
+		if p.Peek(0).Type == TokenEOF {
+			p.traceParser("prefix", prefix, token)
+			n := prefix.Parse(p, token)
+			p.done(n)
+			return n, true
+		}
+	}
+	p.Push(token)
+	return nil, false
+}
+
+// exprFrame is an operator waiting for its operand in parseExpression.
+type exprFrame struct {
+	token      Token
+	prefix     PrefixParser   // UnaryParser or GroupParser, for prefixes.
+	infix      OperatorParser // For binary operators.
+	left       Node           // Left operand of a binary operator.
+	fold       bool           // Fold a minus sign into a number.
+	prec       int            // Precedence of the operand.
+	precedence int            // Precedence of the enclosing expression.
+}
+
 // parseExpression is the core of the "Top Down Operator Precedence" algorithm.
+//
+// Unary and binary operators and parentheses, which are what deeply nested
+// input is usually made of, are not parsed by recursing into their
+// parselets: their operators are kept in a stack until the operand is
+// parsed, so that nesting uses heap memory instead of the goroutine stack.
+// The depth is counted as if they recursed. Other parselets, which may be
+// defined outside of this package, recurse as usual through
+// ParseExpression.
 func (p *Parser) parseExpression(precedence int) Node {
+	if p.recovering {
+		// Each level recovers from its own errors.
+		return p.parseNested(precedence)
+	}
+	var stack []exprFrame
+	var left Node
+operand:
+	for {
+		p.depth++
+		p.checkDepth()
+		p.checkContext()
+		p.checkTokens()
+		token := p.Pop()
+		for token.Type == TokenNewline {
+			// An operand can start on the next line.
+			token = p.Pop()
+		}
+		prefix, ok := p.prefixParser(token)
+		if !ok {
+			p.Push(token)
+			p.errorf("could not parse %s", token)
+		}
+		p.traceParser("prefix", prefix, token)
+		p.startOperand(prefix)
+		switch parser := prefix.(type) {
+		case UnaryParser:
+			fold := parser.begin(p, token)
+			stack = append(stack, exprFrame{token: token, prefix: parser, fold: fold,
+				precedence: precedence})
+			precedence = int(parser)
+			continue operand
+		case GroupParser:
+			if !p.OperatorSections {
+				stack = append(stack, exprFrame{token: token, prefix: parser,
+					precedence: precedence})
+				precedence = int(parser)
+				continue operand
+			}
+		}
+		left = p.parsePrefix(prefix, token)
+		for {
+			for p.binds(precedence) {
+				p.checkContext()
+				p.checkTokens()
+				token := p.Pop()
+				infix, ok := p.infixParser(token)
+				if !ok {
+					p.Push(token)
+					p.errorf("could not parse %s", token)
+				}
+				p.traceParser("infix", infix, token)
+				p.startInfix()
+				if op, ok := p.operatorParser(infix, left); ok {
+					prec := op.operand(p, token)
+					stack = append(stack, exprFrame{token: token, infix: op, left: left,
+						prec: prec, precedence: precedence})
+					precedence = prec
+					continue operand
+				}
+				left = infix.Parse(p, left, token)
+				p.done(left)
+			}
+			// The operand is complete: apply the operator waiting for it.
+			p.depth--
+			if len(stack) == 0 {
+				return left
+			}
+			f := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			switch parser := f.prefix.(type) {
+			case UnaryParser:
+				left = parser.node(f.token, left, f.fold)
+				p.done(left)
+			case GroupParser:
+				// The grouped node was already reported.
+				p.expectClose(f.token, TokenParenR)
+				p.closeGroup()
+			default:
+				left = f.infix.node(p, f.left, f.token, left, f.prec)
+				p.done(left)
+			}
+			precedence = f.precedence
+		}
+	}
+}
+
+// operatorParser returns the OperatorParser equivalent to a binary operator
+// parser, so that parseExpression can parse it without recursion. For
+// comparisons, it first checks DisallowChainedComparison.
+func (p *Parser) operatorParser(infix InfixParser, left Node) (OperatorParser, bool) {
+	switch parser := infix.(type) {
+	case OperatorParser:
+		return parser, true
+	case BinaryParser:
+		return OperatorParser{int(parser), AssocLeft}, true
+	case BinaryRightParser:
+		return OperatorParser{int(parser), AssocRight}, true
+	case ComparisonParser:
+		parser.check(p, left)
+		return OperatorParser{int(parser), AssocLeft}, true
+	}
+	return OperatorParser{}, false
+}
+
+// stmtPending is the value of Parser.stmt when the first operand of a
+// statement is about to be parsed.
+const stmtPending = -1
+
+// parseStatement parses an expression in statement position, where
+// AssignmentAsStatement allows an assignment.
+func (p *Parser) parseStatement(precedence int) Node {
+	p.stmt = stmtPending
+	n := p.parseExpression(precedence)
+	p.stmt = 0
+	return n
+}
+
+// startOperand records the depth of the first operand of a statement, the
+// only one an assignment in statement position can apply to. Parentheses
+// around it are skipped.
+func (p *Parser) startOperand(prefix PrefixParser) {
+	if p.stmt == stmtPending {
+		if _, ok := prefix.(GroupParser); !ok {
+			p.stmt = p.depth
+		}
+	}
+}
+
+// closeGroup makes the parentheses around the first operand of a statement
+// part of it, so that "(a) = b" is in statement position.
+func (p *Parser) closeGroup() {
+	if p.stmt == p.depth+1 {
+		p.stmt = p.depth
+	}
+}
+
+// startInfix is called before each infix operator is parsed: only the
+// first one after the first operand of a statement is in statement
+// position.
+func (p *Parser) startInfix() {
+	p.assignable = p.inStatement()
+	p.stmt = 0
+}
+
+// inStatement returns true if the operand being parsed is the first one of
+// a statement.
+func (p *Parser) inStatement() bool {
+	return p.stmt == p.depth
+}
+
+// parseNested is parseExpression implemented with recursion, used by
+// ParseRecover so that each nested expression can recover from its errors.
+func (p *Parser) parseNested(precedence int) (left Node) {
+	p.depth++
+	defer p.sync(&left, p.depth)
+	p.checkDepth()
+	p.checkContext()
+	p.checkTokens()
 	token := p.Pop()
-	prefix, ok := PrefixParsers[token.Type]
+	for token.Type == TokenNewline {
+		// An operand can start on the next line.
+		token = p.Pop()
+	}
+	prefix, ok := p.prefixParser(token)
 	if !ok {
 		p.Push(token)
 		p.errorf("could not parse %s", token)
 	}
-	left := prefix.Parse(p, token)
-	for precedence < p.precedence() {
+	p.traceParser("prefix", prefix, token)
+	p.startOperand(prefix)
+	left = p.parsePrefix(prefix, token)
+	for p.binds(precedence) {
+		p.checkContext()
+		p.checkTokens()
 		token = p.Pop()
-		infix, ok := p.InfixParsers[token.Type]
+		infix, ok := p.infixParser(token)
 		if !ok {
 			p.Push(token)
 			p.errorf("could not parse %s", token)
 		}
+		p.traceParser("infix", infix, token)
+		p.startInfix()
 		left = infix.Parse(p, left, token)
+		p.done(left)
 	}
+	p.depth--
 	return left
 }
 
+// sync recovers from an error in an expression when parsing with
+// ParseRecover. It records the error, skips the tokens up to the next sync
+// token and replaces the expression with an ErrorNode. Errors that are not
+// parse errors, like a done context, stop parsing as usual.
+func (p *Parser) sync(n *Node, depth int) {
+	e := recover()
+	if e == nil {
+		return
+	}
+	var err *ParseError
+	switch e := e.(type) {
+	case *ParseError:
+		err = e
+	case runtime.Error:
+		panic(e)
+	case error:
+		if p.ctx != nil && e == p.ctx.Err() {
+			panic(e)
+		}
+		err = p.toParseError(e)
+	default:
+		err = p.toParseError(fmt.Errorf("%v", e))
+	}
+	p.depth = depth - 1
+	p.record(err)
+	sync := p.SyncTokens
+	if len(sync) == 0 {
+		sync = DefaultSyncTokens
+	}
+	for t := p.Peek(0); t.Type != TokenEOF; t = p.Peek(0) {
+		if p.isSync(t.Type, sync) {
+			break
+		}
+		p.Pop()
+	}
+	*n = &ErrorNode{Pos: err.Pos, Err: err}
+}
+
+// isSync returns true if t is one of the sync token types.
+func (p *Parser) isSync(t TokenType, sync []TokenType) bool {
+	for _, v := range sync {
+		if t == v {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds an error for ParseRecover. An error at the same position as
+// the last one is dropped: it is the same problem seen from an enclosing
+// expression.
+func (p *Parser) record(err *ParseError) {
+	if n := len(p.errs); n > 0 && p.errs[n-1].Pos == err.Pos {
+		return
+	}
+	p.errs = append(p.errs, err)
+}
+
+// toParseError wraps an error that is not a *ParseError, at the position
+// of the next token.
+func (p *Parser) toParseError(err error) *ParseError {
+	if e, ok := err.(*ParseError); ok {
+		return e
+	}
+	t := p.Peek(0)
+	return &ParseError{Msg: err.Error(), Token: t, Pos: t.Pos}
+}
+
+// groupingParser is implemented by prefix parsers that may return a node
+// parsed by parseExpression unchanged, like GroupParser. built is false
+// for those nodes, which were already reported.
+type groupingParser interface {
+	parse(parser *Parser, token Token) (n Node, built bool)
+}
+
+// parsePrefix calls a prefix parser and reports its node, unless it was
+// already reported.
+func (p *Parser) parsePrefix(prefix PrefixParser, token Token) Node {
+	n, built := p.callPrefix(prefix, token)
+	if built {
+		p.done(n)
+	}
+	return n
+}
+
+// callPrefix calls a prefix parser, returning whether it built the node.
+func (p *Parser) callPrefix(prefix PrefixParser, token Token) (Node, bool) {
+	if g, ok := prefix.(groupingParser); ok {
+		return g.parse(p, token)
+	}
+	return prefix.Parse(p, token), true
+}
+
+// done calls OnNode for a completed node.
+func (p *Parser) done(n Node) {
+	if p.trace != nil {
+		p.tracef("node %s", n)
+	}
+	if p.OnNode != nil {
+		p.OnNode(n)
+	}
+}
+
+// binds returns true if the next token is an infix operator that binds
+// tighter than the given precedence, which means that the expression being
+// parsed continues with it.
+func (p *Parser) binds(precedence int) bool {
+	next := p.precedence()
+	if p.trace != nil {
+		if precedence < next {
+			p.tracef("continue at %s: %d < %d", p.Peek(0), precedence, next)
+		} else {
+			p.tracef("stop at %s: %d >= %d", p.Peek(0), precedence, next)
+		}
+	}
+	return precedence < next
+}
+
+// Trace makes the parser write a line to w for each parselet it calls,
+// with the token that triggered it, for each node built and for each
+// comparison of precedences that decides whether an expression goes on
+// with the next token. Lines are indented by the nesting level. It helps
+// to find out why an operator binds the wrong way. Pass nil to stop
+// tracing.
+func (p *Parser) Trace(w io.Writer) {
+	p.trace = w
+}
+
+// traceParser traces a call to a parselet, if tracing.
+func (p *Parser) traceParser(kind string, parser interface{}, token Token) {
+	if p.trace == nil {
+		return
+	}
+	switch v := parser.(type) {
+	case prefixOf:
+		parser = v.PrefixInfixParser
+	case infixOf:
+		parser = v.PrefixInfixParser
+	}
+	name := strings.TrimPrefix(fmt.Sprintf("%T", parser), "bantam.")
+	p.tracef("%s %s for %s", kind, name, token)
+}
+
+// tracef writes a trace line, indented by the nesting level.
+func (p *Parser) tracef(format string, args ...interface{}) {
+	fmt.Fprintf(p.trace, "%s%s\n", strings.Repeat("  ", p.depth), fmt.Sprintf(format, args...))
+}
+
 // precedence returns the precedence level for the next token to be read.
 func (p *Parser) precedence() int {
-	if parser, ok := p.InfixParsers[p.Peek(0).Type]; ok {
+	if parser, ok := p.infixParser(p.Peek(0)); ok {
+		if p.OperatorSections && p.isSection() {
+			// A binary operator right before ")" ends the expression:
+			// it is a section like "(1 +)", handled by GroupParser.
+			return 0
+		}
+		return p.tokenPrecedence(p.Peek(0), parser.Precedence())
+	}
+	return 0
+}
+
+// tokenPrecedence returns the precedence of an infix operator token: the
+// result of PrecedenceFunc if it is set and not zero, or the given
+// precedence otherwise.
+func (p *Parser) tokenPrecedence(t Token, precedence int) int {
+	if p.PrecedenceFunc != nil {
+		if v := p.PrecedenceFunc(t); v != 0 {
+			return v
+		}
+	}
+	return precedence
+}
+
+// prefixParser returns the prefix parser for the given token.
+func (p *Parser) prefixParser(t Token) (PrefixParser, bool) {
+	if t.Type == TokenName {
+		if parser, ok := p.PrefixWords[t.Text]; ok {
+			return parser, true
+		}
+	}
+	if parser, ok := p.PrefixParsers[t.Type]; ok {
+		return parser, true
+	}
+	if p.DefaultPrefix != nil && t.Type != TokenEOF && t.Type != TokenError {
+		return p.DefaultPrefix, true
+	}
+	return nil, false
+}
+
+// infixParser returns the infix parser for the given token.
+func (p *Parser) infixParser(t Token) (InfixParser, bool) {
+	if t.Type == TokenName {
+		if parser, ok := p.InfixWords[t.Text]; ok {
+			return parser, true
+		}
+	}
+	parser, ok := p.InfixParsers[t.Type]
+	return parser, ok
+}
+
+// infixPrecedence returns the precedence of the infix parser registered for
+// the given token type, or 0 if there's none.
+func (p *Parser) infixPrecedence(t TokenType) int {
+	if parser, ok := p.InfixParsers[t]; ok {
 		return parser.Precedence()
 	}
 	return 0
 }
 
-// errorf stops parsing and makes the parser return an error.
-func (p *Parser) errorf(format string, args ...interface{}) {
-	panic(fmt.Errorf(format, args...))
+// isSectionOperator returns true if the token is a binary operator that can
+// be used in an operator section.
+func (p *Parser) isSectionOperator(t Token) bool {
+	parser, _ := p.infixParser(t)
+	switch parser.(type) {
+	case BinaryParser, BinaryRightParser, OperatorParser:
+		return true
+	}
+	return false
+}
+
+// isSection returns true if the next tokens are a section operator followed
+// by a closing parenthesis.
+func (p *Parser) isSection() bool {
+	return p.isSectionOperator(p.Peek(0)) && p.Peek(1).Type == TokenParenR
+}
+
+// section returns the lambda for an operator section opened by paren.
+// The missing operand, left or right, is nil and is replaced by the lambda
+// parameter. The parameter gets a fresh name that can't clash with user
+// names because "$" is not valid in them.
+func (p *Parser) section(paren, op Token, left, right Node) Node {
+	p.sections++
+	param := NewNameNode(fmt.Sprintf("$%d", p.sections))
+	param.Pos = op.Pos
+	if left == nil {
+		left = param
+	} else {
+		right = param
+	}
+	body := NewBinaryNode(left, op.Type, right)
+	body.Pos = op.Pos
+	n := NewLambdaNode([]string{param.Name}, body)
+	n.Pos = paren.Pos
+	return n
+}
+
+// checkContext stops parsing if the context of the current parse is done.
+func (p *Parser) checkContext() {
+	if p.ctx == nil {
+		return
+	}
+	if err := p.ctx.Err(); err != nil {
+		panic(err)
+	}
+}
+
+// checkDepth stops parsing if expressions are nested deeper than MaxDepth.
+func (p *Parser) checkDepth() {
+	if p.MaxDepth > 0 && p.depth > p.MaxDepth {
+		p.errorf("expression too deeply nested")
+	}
+}
+
+// checkTokens stops parsing if more than MaxTokens were read since the
+// parse started.
+func (p *Parser) checkTokens() {
+	if p.MaxTokens > 0 && p.read-p.started > p.MaxTokens {
+		p.errorf("token limit of %d exceeded", p.MaxTokens)
+	}
+}
+
+// expectClose consumes the close token that matches the open one, like ")"
+// for "(". Otherwise it stops parsing with an error that points to where
+// the open token was.
+func (p *Parser) expectClose(open Token, close TokenType) {
+	if p.Match(close) {
+		return
+	}
+	if t := p.Peek(0); t.Type != TokenEOF {
+		p.errorf("expected %s to close '%s' opened at %s, got %s", close, open.Type, open.Pos, t)
+	}
+	p.errorf("unclosed '%s' opened at %s", open.Type, open.Pos)
+}
+
+// errorf stops parsing and makes the parser return an error, at the
+// position of the next token. If the next token is a lexer error, that
+// error is returned instead.
+func (s *Stack) errorf(format string, args ...interface{}) {
+	t := s.Peek(0)
+	if t.Type == TokenError {
+		panic(lexError(t))
+	}
+	panic(&ParseError{Msg: fmt.Sprintf(format, args...), Token: t, Pos: t.Pos})
 }
 
 // recover turns panics into returns from the top level of Parse.
+// Runtime errors are real bugs, so they are not recovered. Panics with
+// values that are not errors are wrapped in a ParseError.
 func (p *Parser) recover(err *error) {
 	if e := recover(); e != nil {
-		if _, ok := e.(runtime.Error); ok {
-			panic(e)
-		}
-		*err = e.(error)
+		*err = p.panicError(e)
+	}
+}
+
+// panicError returns the error for a value recovered from a parse panic.
+func (s *Stack) panicError(e interface{}) error {
+	switch e := e.(type) {
+	case runtime.Error:
+		panic(e)
+	case error:
+		return e
+	}
+	t := s.Peek(0)
+	return &ParseError{Msg: fmt.Sprint(e), Token: t, Pos: t.Pos}
+}
+
+// word returns the text of word operators, which are name tokens.
+func word(t Token) string {
+	if t.Type == TokenName {
+		return t.Text
 	}
+	return ""
 }
 
 // ----------------------------------------------------------------------------
@@ -146,29 +1233,426 @@ func (p *Parser) recover(err *error) {
 type NameParser int
 
 func (NameParser) Parse(parser *Parser, token Token) Node {
-	return NewNameNode(token.Text)
+	n := NewNameNode(token.Text)
+	n.Pos = token.Pos
+	return n
+}
+
+// ----------------------------------------------------------------------------
+
+// NumberParser is a simple parser for a number literal like "42" or "1.5".
+type NumberParser int
+
+func (NumberParser) Parse(parser *Parser, token Token) Node {
+	text := token.Text
+	if strings.HasPrefix(text, "0x") || strings.HasPrefix(text, "0X") {
+		// ParseFloat requires a binary exponent for hexadecimal numbers.
+		text += "p0"
+	}
+	v, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		parser.errorf("invalid number %q", token.Text)
+	}
+	n := NewNumberNode(v)
+	n.Pos = token.Pos
+	n.Text = token.Text
+	return n
+}
+
+// ----------------------------------------------------------------------------
+
+// InterpolationParser parses an interpolated string like "a ${b} c", lexed
+// by a StringLexer with Interpolation set.
+type InterpolationParser int
+
+func (InterpolationParser) Parse(parser *Parser, token Token) Node {
+	n := NewInterpolationNode(token.Text)
+	n.Pos = token.Pos
+	for {
+		n.Exprs = append(n.Exprs, parser.parseExpression(0))
+		t := parser.Pop()
+		switch t.Type {
+		case TokenInterpMid:
+			n.Parts = append(n.Parts, t.Text)
+		case TokenInterpEnd:
+			n.Parts = append(n.Parts, t.Text)
+			return n
+		default:
+			parser.Push(t)
+			if t.Type != TokenEOF {
+				parser.errorf("expected } to close '${' in string at %s, got %s", token.Pos, t)
+			}
+			parser.errorf("unclosed '${' in string at %s", token.Pos)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// StringParser parses a string literal like "abc".
+type StringParser int
+
+func (StringParser) Parse(parser *Parser, token Token) Node {
+	n := NewStringNode(token.Text)
+	n.Pos = token.Pos
+	return n
+}
+
+// ----------------------------------------------------------------------------
+
+// LiteralParser parses keyword literals. Currently the only one is "null".
+type LiteralParser int
+
+func (LiteralParser) Parse(parser *Parser, token Token) Node {
+	if token.Type != TokenNull {
+		parser.errorf("unknown literal %s", token)
+	}
+	return Null
 }
 
 // ----------------------------------------------------------------------------
 
 // GroupParser parses parentheses used to group expressions,
 // like "a * (b + c)".
+//
+// If the parser has OperatorSections enabled, it also parses operator
+// sections: "(+ 1)" becomes "fn($1) ($1 + 1)" and "(1 +)" becomes
+// "fn($1) (1 + $1)".
 type GroupParser int
 
 func (p GroupParser) Parse(parser *Parser, token Token) Node {
+	n, _ := p.parse(parser, token)
+	return n
+}
+
+// parse returns the grouped node, or the lambda for a section and true.
+func (p GroupParser) parse(parser *Parser, token Token) (Node, bool) {
+	if parser.OperatorSections && parser.isSectionOperator(parser.Peek(0)) {
+		// Left operand is missing, like "(+ 1)".
+		op := parser.Pop()
+		right := parser.parseExpression(int(p))
+		parser.expectClose(token, TokenParenR)
+		return parser.section(token, op, nil, right), true
+	}
 	n := parser.parseExpression(int(p))
-	parser.Expect(TokenParenR)
+	if parser.OperatorSections && parser.isSection() {
+		// Right operand is missing, like "(1 +)".
+		op := parser.Pop()
+		parser.expectClose(token, TokenParenR)
+		return parser.section(token, op, n, nil), true
+	}
+	parser.expectClose(token, TokenParenR)
+	parser.closeGroup()
+	return n, false
+}
+
+// ----------------------------------------------------------------------------
+
+// BlockParser parses a block of expressions separated by semicolons, like
+// "{ a = 1; b = a + 1; a * b }", whose value is the last expression. A
+// semicolon after the last expression and empty blocks are allowed. If the
+// lexer emits newline tokens, a newline also separates expressions, like
+// in ParseAll.
+type BlockParser int
+
+func (p BlockParser) Parse(parser *Parser, token Token) Node {
+	n := NewBlockNode()
+	n.Pos = token.Pos
+	for {
+		for parser.Match(TokenNewline) || parser.Match(TokenSemicolon) {
+		}
+		if parser.Match(TokenBraceR) {
+			return n
+		}
+		if parser.Peek(0).Type == TokenEOF {
+			parser.expectClose(token, TokenBraceR)
+		}
+		n.Exprs = append(n.Exprs, parser.parseStatement(int(p)))
+		if t := parser.Peek(0).Type; t != TokenSemicolon && t != TokenNewline {
+			parser.expectClose(token, TokenBraceR)
+			return n
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// BracketParser parses an expression enclosed by a pair of tokens, like
+// "|a + b|" for the absolute value, and returns a BracketNode. It is
+// registered as the prefix parser for the Open token:
+//
+//	p.PrefixParsers[TokenPipe] = BracketParser{Open: TokenPipe, Close: TokenPipe}
+//
+// The inner expression stops at operators that don't bind tighter than the
+// Close token as an infix operator, so that "|a | b|" can't be read as a
+// bitwise or. Parentheses are handled by GroupParser, which returns the
+// inner expression itself.
+type BracketParser struct {
+	Open  TokenType
+	Close TokenType
+}
+
+func (p BracketParser) Parse(parser *Parser, token Token) Node {
+	inner := parser.parseExpression(parser.infixPrecedence(p.Close))
+	parser.expectClose(token, p.Close)
+	n := NewBracketNode(p.Open, inner, p.Close)
+	n.Pos = token.Pos
+	return n
+}
+
+// ----------------------------------------------------------------------------
+
+// MixfixParser parses an operator made of several tokens with operands
+// between them, like "|a|", "a between b and c" or "a if b else c", and
+// returns a MixfixNode. It is registered for the first token, with AsPrefix
+// if the construct starts with it or AsInfix if it starts with an operand:
+//
+//	p.PrefixParsers[TokenPipe] = AsPrefix(MixfixParser{
+//		Separators: []Token{{Type: TokenPipe}},
+//		Closed:     true,
+//	})
+//	p.InfixWords["between"] = AsInfix(MixfixParser{
+//		Separators: []Token{{Type: TokenName, Text: "and"}},
+//		Prec:       PrecComparison,
+//	})
+//
+// An operand followed by a separator stops at operators that don't bind
+// tighter than the separator as an infix operator, like in BracketParser.
+// Unless the construct is Closed, the last separator is followed by an
+// operand parsed like the right operand of BinaryParser, with Prec, for a
+// prefix construct, and with Prec - 1 for an infix one, so that
+// "a if b else c if d else e" nests to the right like the ternary operator.
+type MixfixParser struct {
+	// Separators are the tokens after the first one, in order. A
+	// separator matches a token of the same type and, if its Text is not
+	// empty, the same text, as needed for words.
+	Separators []Token
+	// Closed makes the last separator end the construct.
+	Closed bool
+	// Prec is the precedence of an infix construct.
+	Prec int
+}
+
+func (p MixfixParser) ParsePrefix(parser *Parser, token Token) Node {
+	return p.parse(parser, NewMixfixNode(token), token, p.Prec)
+}
+
+func (p MixfixParser) ParseInfix(parser *Parser, left Node, token Token) Node {
+	n := NewMixfixNode(token)
+	n.Operands = append(n.Operands, left)
+	return p.parse(parser, n, token, p.Prec-1)
+}
+
+func (p MixfixParser) Precedence() int {
+	return p.Prec
+}
+
+// parse parses the operands and separators after the first token.
+func (p MixfixParser) parse(parser *Parser, n *MixfixNode, token Token, last int) Node {
+	n.Pos = token.Pos
+	n.Prefix = len(n.Operands) == 0
+	for _, sep := range p.Separators {
+		prec := 0
+		if infix, ok := parser.infixParser(sep); ok {
+			prec = parser.tokenPrecedence(sep, infix.Precedence())
+		}
+		n.Operands = append(n.Operands, parser.parseExpression(prec))
+		t := parser.Peek(0)
+		if t.Type != sep.Type || sep.Text != "" && t.Text != sep.Text {
+			text := sep.Text
+			if text == "" {
+				text = sep.Type.String()
+			}
+			parser.errorf("expected '%s' after '%s' at %s, got %s", text, token.Text, token.Pos, t)
+		}
+		n.Operators = append(n.Operators, parser.Pop())
+	}
+	if !p.Closed {
+		n.Operands = append(n.Operands, parser.parseExpression(last))
+	}
+	return n
+}
+
+// ----------------------------------------------------------------------------
+
+// LambdaParser parses an anonymous function like "fn(a, b) a + b": a list
+// of parameter names in parentheses followed by the body expression. The
+// body is parsed with the parser's precedence, so the default one doesn't
+// absorb commas and lambdas can be passed as arguments.
+type LambdaParser int
+
+func (p LambdaParser) Parse(parser *Parser, token Token) Node {
+	parser.Expect(TokenParenL)
+	params := []string{}
+	if !parser.Match(TokenParenR) {
+		for {
+			param := parser.Pop()
+			if param.Type != TokenName {
+				parser.Push(param)
+				parser.errorf("expected parameter name, got %s", param)
+			}
+			params = append(params, param.Text)
+			if !parser.Match(TokenComma) {
+				break
+			}
+		}
+		parser.Expect(TokenParenR)
+	}
+	n := NewLambdaNode(params, parser.parseExpression(int(p)))
+	n.Pos = token.Pos
+	return n
+}
+
+// ----------------------------------------------------------------------------
+
+// TryPrefix returns a prefix parser that tries the given parsers in order
+// for the same token, for grammars where one token of lookahead can't tell
+// the alternatives apart, like "(" starting a group or the parameters of a
+// lambda. When a parser fails with a *ParseError, the stack is rewound to
+// the token after the one being parsed and the next parser is tried. The
+// error of the last parser is returned as is. Nodes of failed attempts may
+// have been passed to OnNode. It panics if no parsers are given.
+func TryPrefix(parsers ...PrefixParser) PrefixParser {
+	if len(parsers) == 0 {
+		panic(fmt.Errorf("TryPrefix requires at least one parser"))
+	}
+	return tryPrefix(parsers)
+}
+
+type tryPrefix []PrefixParser
+
+func (p tryPrefix) Parse(parser *Parser, token Token) Node {
+	n, _ := p.parse(parser, token)
+	return n
+}
+
+func (p tryPrefix) parse(parser *Parser, token Token) (Node, bool) {
+	for _, prefix := range p[:len(p)-1] {
+		if n, built, ok := p.try(parser, prefix, token); ok {
+			return n, built
+		}
+	}
+	return parser.callPrefix(p[len(p)-1], token)
+}
+
+// try runs an alternative, rewinding the stack and the parser state if it
+// fails. Errors are not recovered while trying, so that ParseRecover only
+// reports the errors of the chosen alternative.
+func (p tryPrefix) try(parser *Parser, prefix PrefixParser, token Token) (n Node, built, ok bool) {
+	mark := parser.Mark()
+	depth, sections, stmt, recovering := parser.depth, parser.sections, parser.stmt, parser.recovering
+	parser.recovering = false
+	defer func() {
+		parser.recovering = recovering
+		if ok {
+			parser.Release(mark)
+			return
+		}
+		e := recover()
+		if _, isParseError := e.(*ParseError); !isParseError {
+			panic(e)
+		}
+		parser.Rewind(mark)
+		parser.depth, parser.sections, parser.stmt = depth, sections, stmt
+	}()
+	n, built = parser.callPrefix(prefix, token)
+	return n, built, true
+}
+
+// ----------------------------------------------------------------------------
+
+// IfParser parses a conditional like "if (a) b else c", where the else
+// branch is optional. An else belongs to the closest if, so
+// "if (a) if (b) c else d" has a single else. Like in LambdaParser, the
+// branches are parsed with the parser's precedence, so the default one
+// doesn't absorb commas.
+type IfParser int
+
+func (p IfParser) Parse(parser *Parser, token Token) Node {
+	stmt := parser.inStatement()
+	cond := parser.condition(token)
+	n := NewIfNode(cond, parser.parseBody(int(p), stmt), nil)
+	n.Pos = token.Pos
+	if parser.Match(TokenElse) {
+		n.Else = parser.parseBody(int(p), stmt)
+	}
 	return n
 }
 
 // ----------------------------------------------------------------------------
 
-// UnaryParser parses an unary prefix operator.
+// WhileParser parses a loop like "while (a) b". The body is parsed with the
+// parser's precedence, like in IfParser.
+type WhileParser int
+
+func (p WhileParser) Parse(parser *Parser, token Token) Node {
+	stmt := parser.inStatement()
+	cond := parser.condition(token)
+	n := NewWhileNode(cond, parser.parseBody(int(p), stmt))
+	n.Pos = token.Pos
+	return n
+}
+
+// parseBody parses the body of a keyword like "if", which is in statement
+// position if the keyword is.
+func (p *Parser) parseBody(precedence int, stmt bool) Node {
+	if stmt {
+		return p.parseStatement(precedence)
+	}
+	return p.parseExpression(precedence)
+}
+
+// condition parses the condition in parentheses after a keyword like "if".
+func (p *Parser) condition(keyword Token) Node {
+	open := p.Peek(0)
+	if open.Type != TokenParenL {
+		p.errorf("expected ( after '%s', got %s", keyword.Type, open)
+	}
+	p.Pop()
+	cond := p.parseExpression(0)
+	p.expectClose(open, TokenParenR)
+	return cond
+}
+
+// ----------------------------------------------------------------------------
+
+// UnaryParser parses an unary prefix operator. It fails early if the next
+// token can't start an expression, like in "-)".
+//
+// If the parser has FoldNegativeLiterals enabled, a minus sign directly
+// followed by a number is parsed as a single negative number.
 type UnaryParser int
 
 func (p UnaryParser) Parse(parser *Parser, token Token) Node {
-	right := parser.parseExpression(int(p))
-	return NewUnaryNode(token.Type, right)
+	fold := p.begin(parser, token)
+	return p.node(token, parser.parseExpression(int(p)), fold)
+}
+
+// begin checks that the operand can start an expression, before it is
+// parsed, and returns whether the operator must be folded into a number.
+func (p UnaryParser) begin(parser *Parser, token Token) bool {
+	next := parser.Peek(0)
+	if _, ok := parser.prefixParser(next); !ok {
+		parser.errorf("expected expression after '%s'", token)
+	}
+	return parser.FoldNegativeLiterals && token.Type == TokenMinus &&
+		next.Type == TokenNumber
+}
+
+// node returns the node for the operator applied to its parsed operand.
+func (p UnaryParser) node(token Token, right Node, fold bool) Node {
+	if num, ok := right.(*NumberNode); ok && fold {
+		n := NewNumberNode(-num.Value)
+		n.Pos = token.Pos
+		if num.Text != "" {
+			n.Text = "-" + num.Text
+		}
+		return n
+	}
+	n := NewUnaryNode(token.Type, right)
+	n.Pos = token.Pos
+	n.Word = word(token)
+	return n
 }
 
 // ----------------------------------------------------------------------------
@@ -177,7 +1661,10 @@ func (p UnaryParser) Parse(parser *Parser, token Token) Node {
 type UnaryPostfixParser int
 
 func (p UnaryPostfixParser) Parse(parser *Parser, left Node, token Token) Node {
-	return NewUnaryPostfixNode(left, token.Type)
+	n := NewUnaryPostfixNode(left, token.Type)
+	n.Pos = token.Pos
+	n.Word = word(token)
+	return n
 }
 
 func (p UnaryPostfixParser) Precedence() int {
@@ -192,12 +1679,18 @@ func (p UnaryPostfixParser) Precedence() int {
 type AssignParser int
 
 func (p AssignParser) Parse(parser *Parser, left Node, token Token) Node {
+	if parser.AssignmentAsStatement && !parser.assignable {
+		parser.errorf("assignment is only allowed as a statement")
+	}
+	parser.assignable = false
 	l, ok := left.(*NameNode)
 	if !ok {
 		parser.errorf("the left-hand side of an assignment must be a name")
 	}
 	right := parser.parseExpression(int(p) - 1)
-	return NewAssignNode(l.Name, right)
+	n := NewAssignNode(l.Name, right)
+	n.Pos = token.Pos
+	return n
 }
 
 func (p AssignParser) Precedence() int {
@@ -206,23 +1699,62 @@ func (p AssignParser) Precedence() int {
 
 // ----------------------------------------------------------------------------
 
+// compoundOperators maps compound assignment operators to the binary
+// operator they apply.
+var compoundOperators = map[TokenType]TokenType{
+	TokenPlusAssign:  TokenPlus,
+	TokenMinusAssign: TokenMinus,
+	TokenMulAssign:   TokenAsterisk,
+	TokenDivAssign:   TokenSlash,
+}
+
+// CompoundAssignParser parses compound assignments like "a += b". They
+// follow the same rules as AssignParser and are desugared, so "a += b" is
+// parsed as "a = a + b" and prints as "(a = (a + b))". It can be registered
+// for "+=", "-=", "*=" and "/=".
+type CompoundAssignParser int
+
+func (p CompoundAssignParser) Parse(parser *Parser, left Node, token Token) Node {
+	op, ok := compoundOperators[token.Type]
+	if !ok {
+		parser.errorf("%s is not a compound assignment operator", token)
+	}
+	n := AssignParser(p).Parse(parser, left, token).(*AssignNode)
+	right := NewBinaryNode(left, op, n.Right)
+	right.Pos = token.Pos
+	n.Right = right
+	return n
+}
+
+func (p CompoundAssignParser) Precedence() int {
+	return int(p)
+}
+
+// ----------------------------------------------------------------------------
+
 // FunctionParser parses a function call like "a(b, c, d)".
 type FunctionParser int
 
 func (p FunctionParser) Parse(parser *Parser, left Node, token Token) Node {
 	// Parse the comma-separated arguments until we hit, ")".
-	// There may be no arguments at all.
+	// There may be no arguments at all. Arguments are parsed with the
+	// precedence of the comma, so that they don't absorb it when it is
+	// registered as an operator.
 	args := NewListNode()
+	args.Pos = token.Pos
 	if !parser.Match(TokenParenR) {
+		precedence := parser.infixPrecedence(TokenComma)
 		for {
-			args.Append(parser.parseExpression(0))
+			args.Append(parser.parseExpression(precedence))
 			if !parser.Match(TokenComma) {
 				break
 			}
 		}
-		parser.Expect(TokenParenR)
+		parser.expectClose(token, TokenParenR)
 	}
-	return NewFunctionNode(left, args)
+	n := NewFunctionNode(left, args)
+	n.Pos = token.Pos
+	return n
 }
 
 func (p FunctionParser) Precedence() int {
@@ -231,12 +1763,12 @@ func (p FunctionParser) Precedence() int {
 
 // ----------------------------------------------------------------------------
 
-// BinaryParser parses a left-associative binary operator.
+// BinaryParser parses a left-associative binary operator. It is the same
+// as an OperatorParser with AssocLeft.
 type BinaryParser int
 
 func (p BinaryParser) Parse(parser *Parser, left Node, token Token) Node {
-	right := parser.parseExpression(int(p))
-	return NewBinaryNode(left, token.Type, right)
+	return OperatorParser{int(p), AssocLeft}.Parse(parser, left, token)
 }
 
 func (p BinaryParser) Precedence() int {
@@ -245,20 +1777,133 @@ func (p BinaryParser) Precedence() int {
 
 // ----------------------------------------------------------------------------
 
-// BinaryRightParser parses a right-associative binary operator.
+// ComparisonParser parses a left-associative comparison operator. If the
+// parser has DisallowChainedComparison enabled, a comparison whose left side
+// is also a comparison is an error.
+type ComparisonParser int
+
+func (p ComparisonParser) Parse(parser *Parser, left Node, token Token) Node {
+	p.check(parser, left)
+	return BinaryParser(p).Parse(parser, left, token)
+}
+
+// check stops parsing if the comparison is chained and the parser doesn't
+// allow it.
+func (p ComparisonParser) check(parser *Parser, left Node) {
+	if parser.DisallowChainedComparison && parser.isComparison(left) {
+		parser.errorf("chained comparison is not allowed")
+	}
+}
+
+func (p ComparisonParser) Precedence() int {
+	return int(p)
+}
+
+// isComparison returns true if the node is a binary expression built by a
+// ComparisonParser.
+func (p *Parser) isComparison(n Node) bool {
+	b, ok := n.(*BinaryNode)
+	if !ok {
+		return false
+	}
+	parser, ok := p.InfixWords[b.Word]
+	if b.Word == "" || !ok {
+		parser = p.InfixParsers[b.Operator]
+	}
+	_, ok = parser.(ComparisonParser)
+	return ok
+}
+
+// ----------------------------------------------------------------------------
+
+// BinaryRightParser parses a right-associative binary operator. It is the
+// same as an OperatorParser with AssocRight.
 type BinaryRightParser int
 
 func (p BinaryRightParser) Parse(parser *Parser, left Node, token Token) Node {
+	return OperatorParser{int(p), AssocRight}.Parse(parser, left, token)
+}
+
+func (p BinaryRightParser) Precedence() int {
+	return int(p)
+}
+
+// ----------------------------------------------------------------------------
+
+// Assoc is the associativity of a binary operator: how operators of the
+// same precedence group, like "a - b - c".
+type Assoc int
+
+const (
+	AssocLeft  Assoc = iota // "a - b - c" is "(a - b) - c".
+	AssocRight              // "a ^ b ^ c" is "a ^ (b ^ c)".
+	AssocNone               // "a == b == c" is an error.
+)
+
+var assocNames = [...]string{"left", "right", "none"}
+
+func (a Assoc) String() string {
+	if a >= 0 && int(a) < len(assocNames) {
+		return assocNames[a]
+	}
+	return fmt.Sprintf("Assoc(%d)", int(a))
+}
+
+// OperatorParser parses a binary operator with the given precedence and
+// associativity. BinaryParser and BinaryRightParser are shorthands for the
+// left and right cases.
+type OperatorParser struct {
+	Prec  int
+	Assoc Assoc
+}
+
+func (p OperatorParser) Parse(parser *Parser, left Node, token Token) Node {
+	prec := p.operand(parser, token)
+	return p.node(parser, left, token, parser.parseExpression(prec), prec)
+}
+
+// operand returns the precedence used to parse the right operand.
+func (p OperatorParser) operand(parser *Parser, token Token) int {
+	prec := parser.tokenPrecedence(token, p.Prec)
 	// To handle right-associative operators like "^", we allow a slightly
 	// lower precedence when parsing the right-hand side. This will let a
 	// parser with the same precedence appear on the right, which will then
 	// take *this* parser's result as its left-hand argument.
-	right := parser.parseExpression(int(p) - 1)
-	return NewBinaryNode(left, token.Type, right)
+	if p.Assoc == AssocRight {
+		prec--
+	}
+	return prec
 }
 
-func (p BinaryRightParser) Precedence() int {
-	return int(p)
+// node returns the node for the operator applied to its parsed operands,
+// the right one parsed with the given precedence.
+func (p OperatorParser) node(parser *Parser, left Node, token Token, right Node, prec int) Node {
+	if p.Assoc == AssocNone && parser.precedence() == prec {
+		parser.errorf("operator '%s' is not associative", token)
+	}
+	n := NewBinaryNode(left, token.Type, right)
+	n.Pos = token.Pos
+	n.Word = word(token)
+	return n
+}
+
+func (p OperatorParser) Precedence() int {
+	return p.Prec
+}
+
+// Associativity returns the associativity of a binary operator parser, and
+// false if the parser is not one, like a TernaryParser. ComparisonParser is
+// left-associative; see DisallowChainedComparison.
+func Associativity(p InfixParser) (Assoc, bool) {
+	switch p := p.(type) {
+	case BinaryParser, ComparisonParser:
+		return AssocLeft, true
+	case BinaryRightParser:
+		return AssocRight, true
+	case OperatorParser:
+		return p.Assoc, true
+	}
+	return 0, false
 }
 
 // ----------------------------------------------------------------------------
@@ -267,12 +1912,67 @@ func (p BinaryRightParser) Precedence() int {
 type TernaryParser int
 
 func (p TernaryParser) Parse(parser *Parser, left Node, token Token) Node {
-	node := parser.parseExpression(0)
-	parser.Expect(TokenColon)
-	elseNode := parser.parseExpression(int(p) - 1)
-	return NewTernaryNode(left, listNode(node), listNode(elseNode))
+	return ternaryParser{int(p), TokenColon}.Parse(parser, left, token)
 }
 
 func (p TernaryParser) Precedence() int {
 	return int(p)
 }
+
+// ternaryParser is a TernaryParser with a custom separator between the two
+// branches, used by Grammar.Ternary.
+type ternaryParser struct {
+	precedence int
+	separator  TokenType
+}
+
+func (p ternaryParser) Parse(parser *Parser, left Node, token Token) Node {
+	node := parser.parseExpression(0)
+	parser.Expect(p.separator)
+	elseNode := parser.parseExpression(p.precedence - 1)
+	n := NewTernaryNode(left, listNode(node), listNode(elseNode))
+	n.Pos = token.Pos
+	return n
+}
+
+func (p ternaryParser) Precedence() int {
+	return p.precedence
+}
+
+// ----------------------------------------------------------------------------
+
+// ElvisParser parses the default operator, like "a ?: b", which yields the
+// left side unless it is false, and the right side otherwise. It is
+// right-associative, so "a ?: b ?: c" is parsed as "a ?: (b ?: c)".
+type ElvisParser int
+
+func (p ElvisParser) Parse(parser *Parser, left Node, token Token) Node {
+	right := parser.parseExpression(int(p) - 1)
+	n := NewElvisNode(left, right)
+	n.Pos = token.Pos
+	return n
+}
+
+func (p ElvisParser) Precedence() int {
+	return int(p)
+}
+
+// ----------------------------------------------------------------------------
+
+// SequenceParser parses the comma operator, like "a, b", which evaluates the
+// left side and then yields the right side. It is right-associative and
+// should have the lowest precedence, so that "a = b, c" is parsed as
+// "(a = b), c". Function arguments are parsed above its precedence, so
+// "f(a, b)" is still a call with two arguments.
+type SequenceParser int
+
+func (p SequenceParser) Parse(parser *Parser, left Node, token Token) Node {
+	right := parser.parseExpression(int(p) - 1)
+	n := NewSequenceNode(left, right)
+	n.Pos = token.Pos
+	return n
+}
+
+func (p SequenceParser) Precedence() int {
+	return int(p)
+}
@@ -5,6 +5,13 @@
 package bantam
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
 	"testing"
 )
 
@@ -29,6 +36,16 @@ var stringToToken = map[string]TokenType{
 	",": TokenComma,
 }
 
+// newParser returns a parser for the default grammar reading from a
+// StringLexer.
+func newParser(src string) *Parser {
+	return &Parser{
+		Stack:         NewStack(NewStringLexer(src)),
+		PrefixParsers: PrefixParsers,
+		InfixParsers:  InfixParsers,
+	}
+}
+
 // stupendously weak lexer, just for testing.
 func (l *lexer) Next() Token {
 	for l.pos < len(l.src) {
@@ -83,12 +100,19 @@ func TestParser(t *testing.T) {
 		{"a + (b + c) + d", "((a + (b + c)) + d)"},
 		{"a ^ (b + c)", "(a ^ (b + c))"},
 		{"(!a)!", "((!a)!)"},
+		// Sequence.
+		{"a, b, c", "(a, (b, c))"},
+		{"a = b, c", "((a = b), c)"},
+		{"a, b = c", "(a, (b = c))"},
+		{"f(a, b)", "f(a, b)"},
+		{"f((a, b), c)", "f((a, b), c)"},
+		{"a ? b, c : d", "(a ? (b, c) : d)"},
 	}
 
 	for _, test := range tests {
 		l := &lexer{src: test.source}
 		s := &Stack{lexer: l}
-		p := &Parser{s, PrefixParsers, InfixParsers}
+		p := &Parser{Stack: s, PrefixParsers: PrefixParsers, InfixParsers: InfixParsers}
 		n, e := p.Parse()
 		if e != nil {
 			t.Errorf("%q: error parsing: %v", test.source, e)
@@ -113,3 +137,2321 @@ func TestParser(t *testing.T) {
 		}
 	*/
 }
+
+func TestOperatorSections(t *testing.T) {
+	type sectionTest struct {
+		source string
+		result string
+	}
+
+	tests := []sectionTest{
+		// Left operand is missing.
+		{"(+ a)", "fn($1) ($1 + a)"},
+		{"(^ a + b)", "fn($1) ($1 ^ (a + b))"},
+		// Right operand is missing.
+		{"(a +)", "fn($1) (a + $1)"},
+		{"(a * b +)", "fn($1) ((a * b) + $1)"},
+		// Regular groups are not affected.
+		{"(a + b)", "(a + b)"},
+		{"(!a)!", "((!a)!)"},
+	}
+
+	for _, test := range tests {
+		l := &lexer{src: test.source}
+		p := &Parser{Stack: &Stack{lexer: l}, PrefixParsers: PrefixParsers, InfixParsers: InfixParsers}
+		p.OperatorSections = true
+		n, e := p.Parse()
+		if e != nil {
+			t.Errorf("%q: error parsing: %v", test.source, e)
+			continue
+		}
+		lambda, ok := n.(*LambdaNode)
+		if ok && len(lambda.Params) != 1 {
+			t.Errorf("%q: expected 1 parameter, got %d", test.source, len(lambda.Params))
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+}
+
+func TestStackPeek(t *testing.T) {
+	s := NewStack(&lexer{src: "a b c"})
+	for i, expected := range []string{`"a"`, `"b"`, `"c"`, "EOF"} {
+		if r := s.Peek(i).String(); r != expected {
+			t.Errorf("Peek(%d): expected %q, got %q", i, expected, r)
+		}
+	}
+	// Peek again, now served from the buffer.
+	for i, expected := range []string{`"a"`, `"b"`, `"c"`} {
+		if r := s.Peek(i).String(); r != expected {
+			t.Errorf("Peek(%d): expected %q, got %q", i, expected, r)
+		}
+	}
+}
+
+func TestParseContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	l := &lexer{src: strings.Repeat("a + ", 1000) + "a"}
+	p := &Parser{Stack: &Stack{lexer: l}, PrefixParsers: PrefixParsers, InfixParsers: InfixParsers}
+	n, err := p.ParseContext(ctx)
+	if err != context.Canceled {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if n != nil {
+		t.Errorf("expected nil node, got %v", n)
+	}
+
+	// The same input parses with a live context.
+	l = &lexer{src: strings.Repeat("a + ", 1000) + "a"}
+	p = &Parser{Stack: &Stack{lexer: l}, PrefixParsers: PrefixParsers, InfixParsers: InfixParsers}
+	if _, err := p.ParseContext(context.Background()); err != nil {
+		t.Errorf("error parsing: %v", err)
+	}
+}
+
+func TestMaxTokens(t *testing.T) {
+	l := &lexer{src: strings.Repeat("a + ", 1000) + "a"}
+	p := &Parser{Stack: &Stack{lexer: l}, PrefixParsers: PrefixParsers, InfixParsers: InfixParsers}
+	p.MaxTokens = 10
+	_, err := p.Parse()
+	if _, ok := err.(*ParseError); !ok {
+		t.Fatalf("expected *ParseError, got %v", err)
+	}
+	if r := err.Error(); r != "token limit of 10 exceeded" {
+		t.Errorf("unexpected error: %q", r)
+	}
+	if p.read > p.MaxTokens+2 {
+		t.Errorf("expected parsing to stop early, read %d tokens", p.read)
+	}
+
+	// "a + b" has 4 tokens including EOF.
+	l = &lexer{src: "a + b"}
+	p = &Parser{Stack: &Stack{lexer: l}, PrefixParsers: PrefixParsers, InfixParsers: InfixParsers}
+	p.MaxTokens = 4
+	if _, err := p.Parse(); err != nil {
+		t.Errorf("error parsing: %v", err)
+	}
+
+	// The limit applies to each parse of a stack.
+	p = newParser("a + b; c + d; e + f")
+	p.MaxTokens = 5
+	for i := 0; i < 3; i++ {
+		if _, _, _, err := p.ParseExpressionAt(); err != nil {
+			t.Fatalf("expression %d: error parsing: %v", i, err)
+		}
+		p.Match(TokenSemicolon)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	deep := strings.Repeat("(", 5000) + "a" + strings.Repeat(")", 5000)
+	tests := []struct {
+		source   string
+		maxDepth int
+		err      string
+	}{
+		{deep, 0, ""},
+		{deep, 1000, "expression too deeply nested"},
+		{strings.Repeat("- ", 10) + "a", 10, "expression too deeply nested"},
+		{strings.Repeat("- ", 9) + "a", 10, ""},
+		{strings.Repeat("a + ", 100) + "a", 2, ""},
+	}
+	for _, test := range tests {
+		p := newParser(test.source)
+		p.MaxDepth = test.maxDepth
+		_, err := p.Parse()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%.10q: error parsing: %v", test.source, err)
+			}
+			continue
+		}
+		if _, ok := err.(*ParseError); !ok || err.Error() != test.err {
+			t.Errorf("%.10q: expected %q, got %v", test.source, test.err, err)
+		}
+	}
+}
+
+func TestDeepNesting(t *testing.T) {
+	// Parsing recursively would need far more than this stack.
+	defer debug.SetMaxStack(debug.SetMaxStack(1 << 20))
+	const n = 100000
+	tests := []struct {
+		source string
+		depth  int
+	}{
+		{strings.Repeat("(", n) + "a" + strings.Repeat(")", n), 0},
+		{strings.Repeat("- ", n) + "a", n},
+		{strings.Repeat("a ^ ", n) + "a", n},
+		{strings.Repeat("-(a + ", n) + "a" + strings.Repeat(")", n), 2 * n},
+	}
+	for _, test := range tests {
+		node, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%.10q: error parsing: %v", test.source, err)
+			continue
+		}
+		depth := 0
+		for ; node != nil; depth++ {
+			switch v := node.(type) {
+			case *UnaryNode:
+				node = v.Right
+			case *BinaryNode:
+				node = v.Right
+			default:
+				node = nil
+			}
+		}
+		if depth-1 != test.depth {
+			t.Errorf("%.10q: expected depth %d, got %d", test.source, test.depth, depth-1)
+		}
+	}
+}
+
+func TestParseString(t *testing.T) {
+	n, err := ParseString("a + b * c")
+	if err != nil || n.String() != "(a + (b * c))" {
+		t.Errorf("expected (a + (b * c)), got %v (%v)", n, err)
+	}
+	if _, err := ParseString("a +"); err == nil {
+		t.Errorf("expected error")
+	}
+	if _, err := ParseString(`"abc`); err == nil || err.Error() != "unterminated string" {
+		t.Errorf("expected lexer error, got %v", err)
+	}
+}
+
+func TestParseExpressionAt(t *testing.T) {
+	tests := []struct {
+		source   string
+		result   string
+		consumed int
+		rest     string
+	}{
+		{"a + b", "(a + b)", 3, "1:6"},
+		{"a + b ) text", "(a + b)", 3, "1:7"},
+		{"f(a) b", "f(a)", 4, "1:6"},
+		{"x\n  + y ) z", "(x + y)", 3, "2:7"},
+	}
+	for _, test := range tests {
+		src := test.source
+		p := newParser(src)
+		n, consumed, rest, err := p.ParseExpressionAt()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if n.String() != test.result || consumed != test.consumed || rest.String() != test.rest {
+			t.Errorf("%q: expected %s %d %s, got %s %d %s", src, test.result, test.consumed, test.rest,
+				n, consumed, rest)
+		}
+	}
+
+	// Consecutive expressions can be parsed from the same stack.
+	p := newParser("a b + c")
+	var nodes []string
+	for p.Peek(0).Type != TokenEOF {
+		n, _, _, err := p.ParseExpressionAt()
+		if err != nil {
+			t.Fatalf("error parsing: %v", err)
+		}
+		nodes = append(nodes, n.String())
+	}
+	if r := strings.Join(nodes, " "); r != "a (b + c)" {
+		t.Errorf("expected a (b + c), got %s", r)
+	}
+
+	if _, consumed, rest, err := newParser("a + )").ParseExpressionAt(); err == nil ||
+		consumed != 2 || rest.String() != "1:5" {
+		t.Errorf("expected error after 2 tokens at 1:5, got %d %s (%v)", consumed, rest, err)
+	}
+}
+
+func TestFoldNegativeLiterals(t *testing.T) {
+	type foldTest struct {
+		source string
+		fold   bool
+		result string
+	}
+
+	tests := []foldTest{
+		{"-3 + 4", false, "((-3) + 4)"},
+		{"-3 + 4", true, "(-3 + 4)"},
+		{"-a + 4", true, "((-a) + 4)"},
+		{"-3!", true, "(-(3!))"},
+		{"- -3", true, "(--3)"},
+	}
+
+	for _, test := range tests {
+		p := newParser(test.source)
+		p.FoldNegativeLiterals = test.fold
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	p := newParser("-3 + 4")
+	p.FoldNegativeLiterals = true
+	n, _ := p.Parse()
+	left := n.(*BinaryNode).Left
+	if num, ok := left.(*NumberNode); !ok || num.Value != -3 {
+		t.Errorf("expected NumberNode -3, got %#v", left)
+	}
+}
+
+func TestOnNode(t *testing.T) {
+	type onNodeTest struct {
+		source string
+		nodes  []string
+	}
+
+	tests := []onNodeTest{
+		{"a + b * c", []string{"a", "b", "c", "(b * c)", "(a + (b * c))"}},
+		{"(a)", []string{"a"}},
+		{"((a)) * (b)", []string{"a", "b", "(a * b)"}},
+		{"-f(a)", []string{"f", "a", "f(a)", "(-f(a))"}},
+		{"null ?: null", []string{"null", "null", "(null ?: null)"}},
+		{"f(null, null)", []string{"f", "null", "null", "f(null, null)"}},
+	}
+
+	for _, test := range tests {
+		var nodes []string
+		p := newParser(test.source)
+		p.OnNode = func(n Node) {
+			nodes = append(nodes, n.String())
+		}
+		if _, err := p.Parse(); err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if len(nodes) != len(test.nodes) {
+			t.Errorf("%q: expected %d nodes, got %d: %q", test.source, len(test.nodes), len(nodes), nodes)
+			continue
+		}
+		for k, v := range nodes {
+			if v != test.nodes[k] {
+				t.Errorf("%q: node %d: expected %q, got %q", test.source, k, test.nodes[k], v)
+			}
+		}
+	}
+}
+
+// wordsNode is a node type that can't be compared with ==.
+type wordsNode []string
+
+func (n wordsNode) String() string { return strings.Join(n, " ") }
+func (n wordsNode) Position() Pos  { return Pos{} }
+
+type wordsParser struct{}
+
+func (wordsParser) Parse(parser *Parser, token Token) Node {
+	return wordsNode{token.Text}
+}
+
+func TestOnNodeReuse(t *testing.T) {
+	// Nodes are reported again when a parser is reused.
+	var nodes []string
+	p := newParser("null")
+	p.OnNode = func(n Node) { nodes = append(nodes, n.String()) }
+	for _, src := range []string{"null", "null"} {
+		p.Stack = NewStack(NewStringLexer(src))
+		if _, err := p.Parse(); err != nil {
+			t.Fatalf("%q: error parsing: %v", src, err)
+		}
+	}
+	if r := strings.Join(nodes, " "); r != "null null" {
+		t.Errorf("expected nodes %q, got %q", "null null", r)
+	}
+
+	// Node types don't need to be comparable.
+	nodes = nil
+	p = newParser("a + b")
+	p.PrefixParsers = map[TokenType]PrefixParser{TokenName: wordsParser{}}
+	p.InfixParsers = map[TokenType]InfixParser{TokenPlus: BinaryParser(PrecSum)}
+	p.OnNode = func(n Node) { nodes = append(nodes, n.String()) }
+	if _, err := p.Parse(); err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if r := strings.Join(nodes, ", "); r != "a, b, (a + b)" {
+		t.Errorf("expected nodes %q, got %q", "a, b, (a + b)", r)
+	}
+}
+
+func TestComments(t *testing.T) {
+	n, err := newParser("a + # comment\n b").Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if r := n.String(); r != "(a + b)" {
+		t.Errorf("expected %q, got %q", "(a + b)", r)
+	}
+}
+
+func TestAttachComments(t *testing.T) {
+	tests := []struct {
+		source string
+		trivia map[string][]string // Node string to the comments attached.
+	}{
+		{"a", nil},
+		{"// first\na", map[string][]string{"a": {"// first"}}},
+		{"a + /* b */ b // end", map[string][]string{"b": {"/* b */", "// end"}}},
+		{"/* f */ f(/* x */ x) * 2", map[string][]string{
+			"f":          {"/* f */"},
+			"x":          {"/* x */"},
+			"(f(x) * 2)": nil,
+		}},
+		{"a; # one\nb # two", map[string][]string{"a": nil, "b": {"# one", "# two"}}},
+	}
+	for _, test := range tests {
+		l := NewStringLexer(test.source)
+		l.KeepComments = true
+		p := &Parser{
+			Stack:          NewStack(l),
+			PrefixParsers:  PrefixParsers,
+			InfixParsers:   InfixParsers,
+			AttachComments: true,
+		}
+		var nodes []Node
+		if err := p.ParseAll(func(n Node) bool {
+			nodes = append(nodes, n)
+			return true
+		}); err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		found := map[string][]string{}
+		for _, n := range nodes {
+			Walk(n, func(n Node) bool {
+				for _, c := range p.Trivia(n) {
+					found[n.String()] = append(found[n.String()], c.Text)
+				}
+				return true
+			})
+		}
+		for k, v := range test.trivia {
+			if strings.Join(found[k], "|") != strings.Join(v, "|") {
+				t.Errorf("%q: node %q: expected %q, got %q", test.source, k, v, found[k])
+			}
+		}
+		if len(found) > len(test.trivia) {
+			t.Errorf("%q: expected %v, got %v", test.source, test.trivia, found)
+		}
+	}
+
+	// A parser can be reused swapping its stack, as the Clone doc says.
+	p := &Parser{
+		PrefixParsers:  PrefixParsers,
+		InfixParsers:   InfixParsers,
+		AttachComments: true,
+	}
+	for _, src := range []string{"/* a */ a + /* b */ b // end", "// c\nc"} {
+		l := NewStringLexer(src)
+		l.KeepComments = true
+		p.Stack = NewStack(l)
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		found := 0
+		Walk(n, func(n Node) bool {
+			found += len(p.Trivia(n))
+			return true
+		})
+		if expected := len(p.Comments()); found != expected {
+			t.Errorf("%q: expected %d comments attached, got %d", src, expected, found)
+		}
+	}
+}
+
+func TestInterpolation(t *testing.T) {
+	tests := []struct {
+		source string
+		result string
+		sexpr  string
+	}{
+		{`"a ${b + 1} c"`, `"a ${(b + 1)} c"`, `(interp "a " (+ b 1) " c")`},
+		{`"${a}${b}"`, `"${a}${b}"`, `(interp "" a "" b "")`},
+		{`"x" + "${f("\${y}", z)}!"`, `("x" + "${f("${y}", z)}!")`, `(+ "x" (interp "" (call f "${y}" z) "!"))`},
+		{`"\${a} ${"${b}"}"`, `"\${a} ${"${b}"}"`, `(interp "${a} " (interp "" b "") "")`},
+	}
+	for _, test := range tests {
+		l := NewStringLexer(test.source)
+		l.Interpolation = true
+		p := newParser("")
+		p.Stack = NewStack(l)
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		if r := ToSExpr(n); r != test.sexpr {
+			t.Errorf("%q: expected %q, got %q", test.source, test.sexpr, r)
+		}
+	}
+
+	errors := map[string]string{
+		`"a ${b c}"`:   `expected } to close '${' in string at 1:1, got "c"`,
+		`"a ${b} ${c`:  "unclosed '${' in string at 1:1",
+		`"a ${}"`:      `could not parse }"`,
+		`"a ${b, c} d`: "unterminated string",
+	}
+	for src, expected := range errors {
+		l := NewStringLexer(src)
+		l.Interpolation = true
+		p := newParser("")
+		p.Stack = NewStack(l)
+		if _, err := p.Parse(); err == nil || err.Error() != expected {
+			t.Errorf("%q: expected error %q, got %v", src, expected, err)
+		}
+	}
+
+	// Expressions are visited by Walk and Formatter.
+	l := NewStringLexer(`"${a} and ${b ^ 2}"`)
+	l.Interpolation = true
+	p := newParser("")
+	p.Stack = NewStack(l)
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if r := strings.Join(FreeNames(n), " "); r != "a b" {
+		t.Errorf("expected free names a b, got %q", r)
+	}
+	f := &Formatter{Symbols: map[TokenType]string{TokenCaret: "**"}}
+	if r := f.Format(n); r != `"${a} and ${(b ** 2)}"` {
+		t.Errorf("expected formatted interpolation, got %q", r)
+	}
+}
+
+// arrowLambdaParser parses "(x, y): body" as a lambda, backtracking to a
+// group if the tokens after "(" are not a parameter list followed by ":".
+type arrowLambdaParser int
+
+func (arrowLambdaParser) Parse(parser *Parser, token Token) Node {
+	mark := parser.Mark()
+	var params []string
+	for !parser.Match(TokenParenR) {
+		if len(params) > 0 {
+			if _, err := parser.TryExpect(TokenComma); err != nil {
+				parser.Rewind(mark)
+				return GroupParser(0).Parse(parser, token)
+			}
+		}
+		t, err := parser.TryExpect(TokenName)
+		if err != nil {
+			parser.Rewind(mark)
+			return GroupParser(0).Parse(parser, token)
+		}
+		params = append(params, t.Text)
+	}
+	if !parser.Match(TokenColon) {
+		parser.Rewind(mark)
+		return GroupParser(0).Parse(parser, token)
+	}
+	parser.Release(mark)
+	return NewLambdaNode(params, parser.ParseExpression(PrecSequence))
+}
+
+func TestStackMark(t *testing.T) {
+	tests := map[string]string{
+		"(x, y): x + y":   "fn(x, y) (x + y)",
+		"(x): (y): x * y": "fn(x) fn(y) (x * y)",
+		"(): 1":           "fn() 1",
+		"(x, y)":          "(x, y)",
+		"(x) + 1":         "(x + 1)",
+		"(x + y) * 2":     "((x + y) * 2)",
+		"((x): x)(1)":     "fn(x) x(1)",
+		"(x, y + 1)":      "(x, (y + 1))",
+	}
+	base := newParser("").Clone()
+	base.PrefixParsers[TokenParenL] = arrowLambdaParser(0)
+	for src, expected := range tests {
+		p := base.Clone()
+		p.Stack = NewStack(NewStringLexer(src))
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if r := n.String(); r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+		if p.marks != 0 || len(p.log) != 0 {
+			t.Errorf("%q: expected no marks, got %d and %v", src, p.marks, p.log)
+		}
+	}
+
+	// Rewind undoes pushes too, and marks can be nested.
+	s := NewStack(NewStringLexer("a b c"))
+	outer := s.Mark()
+	s.Pop()
+	inner := s.Mark()
+	s.Push(Token{Type: TokenName, Text: "x"})
+	s.Pop()
+	s.Pop()
+	s.Rewind(inner)
+	if r := s.Peek(0); r.Text != "b" {
+		t.Errorf("expected b, got %v", r)
+	}
+	s.Pop()
+	s.Pop()
+	s.Pop()
+	s.Rewind(outer)
+	var texts []string
+	for tok := s.Pop(); tok.Type != TokenEOF; tok = s.Pop() {
+		texts = append(texts, tok.Text)
+	}
+	if r := strings.Join(texts, " "); r != "a b c" {
+		t.Errorf("expected a b c, got %q", r)
+	}
+}
+
+// parenLambdaParser parses "(x, y): body" as a lambda, failing with a parse
+// error on anything else, to be combined with GroupParser by TryPrefix.
+type parenLambdaParser struct{}
+
+func (parenLambdaParser) Parse(parser *Parser, token Token) Node {
+	var params []string
+	for !parser.Match(TokenParenR) {
+		if len(params) > 0 {
+			parser.Expect(TokenComma)
+		}
+		params = append(params, parser.Expect(TokenName).Text)
+	}
+	parser.Expect(TokenColon)
+	return NewLambdaNode(params, parser.ParseExpression(PrecSequence))
+}
+
+func TestTryPrefix(t *testing.T) {
+	tests := []struct {
+		src, expected, err string
+	}{
+		{src: "(x, y): x + y", expected: "fn(x, y) (x + y)"},
+		{src: "(x): (y): x * y", expected: "fn(x) fn(y) (x * y)"},
+		{src: "(x, y)", expected: "(x, y)"},
+		{src: "(x) + 1", expected: "(x + 1)"},
+		{src: "((x): x)(1)", expected: "fn(x) x(1)"},
+		{src: "(x + y) * 2", expected: "((x + y) * 2)"},
+		// The error of the last alternative is reported.
+		{src: "(x: 1", err: "to close '('"},
+		{src: "(x, y", err: "unclosed '('"},
+	}
+	base := newParser("").Clone()
+	base.PrefixParsers[TokenParenL] = TryPrefix(parenLambdaParser{}, GroupParser(0))
+	for _, test := range tests {
+		p := base.Clone()
+		p.Stack = NewStack(NewStringLexer(test.src))
+		n, err := p.Parse()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: expected error %q, got %v", test.src, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.src, err)
+			continue
+		}
+		if r := n.String(); r != test.expected {
+			t.Errorf("%q: expected %q, got %q", test.src, test.expected, r)
+		}
+		if p.marks != 0 || len(p.log) != 0 || p.depth != 0 {
+			t.Errorf("%q: expected no marks, got %d, %v and depth %d", test.src, p.marks, p.log, p.depth)
+		}
+	}
+
+	// With ParseRecover only the errors of the last alternative are
+	// reported.
+	src := "(x, ): 1"
+	p := base.Clone()
+	p.Stack = NewStack(NewStringLexer(src))
+	_, errs := p.ParseRecover()
+	group := newParser(src)
+	_, expected := group.ParseRecover()
+	if fmt.Sprint(errs) != fmt.Sprint(expected) {
+		t.Errorf("%q: expected errors %v, got %v", src, expected, errs)
+	}
+
+	// At least one parser is required.
+	func() {
+		defer func() {
+			if e := recover(); e == nil || !strings.Contains(fmt.Sprint(e), "at least one parser") {
+				t.Errorf("expected TryPrefix to panic without parsers, got %v", e)
+			}
+		}()
+		TryPrefix()
+	}()
+}
+
+func TestClone(t *testing.T) {
+	base := newParser("")
+	dialect := base.Clone()
+	dialect.InfixParsers[TokenTilde] = BinaryParser(PrecSum)
+	dialect.PrefixParsers[TokenAsterisk] = UnaryParser(PrecPrefix)
+
+	for _, src := range []string{"a ~ b", "*a"} {
+		base.Stack = NewStack(NewStringLexer(src))
+		if _, err := base.Parse(); err == nil {
+			t.Errorf("%q: expected error parsing with the base grammar", src)
+		}
+	}
+
+	tests := map[string]string{
+		"a ~ b * c": "(a ~ (b * c))",
+		"*a + b":    "((*a) + b)",
+	}
+	for src, expected := range tests {
+		dialect.Stack = NewStack(NewStringLexer(src))
+		n, err := dialect.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if r := n.String(); r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+	}
+
+	if _, ok := InfixParsers[TokenTilde]; ok {
+		t.Errorf("default infix parsers were modified")
+	}
+}
+
+func TestLambda(t *testing.T) {
+	type lambdaTest struct {
+		source string
+		result string
+	}
+
+	tests := []lambdaTest{
+		{"fn() a", "fn() a"},
+		{"fn(a) a", "fn(a) a"},
+		{"fn(a, b) a + b", "fn(a, b) (a + b)"},
+		{"fn(a) fn(b) a * b", "fn(a) fn(b) (a * b)"},
+		{"f(fn(x) x)", "f(fn(x) x)"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	for _, src := range []string{"fn(a, 1) a", "fn(a + b) a", "fn(a,) a", "fn a", "fn(a"} {
+		if _, err := newParser(src).Parse(); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestSequenceArguments(t *testing.T) {
+	n, err := newParser("f(a, b)").Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	f, ok := n.(*FunctionNode)
+	if !ok {
+		t.Fatalf("expected *FunctionNode, got %T", n)
+	}
+	if len(f.Args.Nodes) != 2 {
+		t.Errorf("expected 2 arguments, got %d", len(f.Args.Nodes))
+	}
+}
+
+func TestBitwiseOperators(t *testing.T) {
+	type bitwiseTest struct {
+		source string
+		result string
+	}
+
+	tests := []bitwiseTest{
+		{"a | b & c", "(a | (b & c))"},
+		{"a & b | c", "((a & b) | c)"},
+		{"a << b + c", "(a << (b + c))"},
+		{"a >> b << c", "((a >> b) << c)"},
+		{"a & b << c", "(a & (b << c))"},
+		{"a || b && c | d", "(a || (b && (c | d)))"},
+		{"a&&b&c", "(a && (b & c))"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	type parseAllTest struct {
+		source string
+		nodes  []string
+	}
+
+	tests := []parseAllTest{
+		{"", nil},
+		{"a", []string{"a"}},
+		{"a; b; c", []string{"a", "b", "c"}},
+		{"a = b + c; f(a);", []string{"(a = (b + c))", "f(a)"}},
+	}
+
+	for _, test := range tests {
+		var nodes []string
+		err := newParser(test.source).ParseAll(func(n Node) bool {
+			nodes = append(nodes, n.String())
+			return true
+		})
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if strings.Join(nodes, "; ") != strings.Join(test.nodes, "; ") {
+			t.Errorf("%q: expected %q, got %q", test.source, test.nodes, nodes)
+		}
+	}
+
+	// Stop after the first statement.
+	var nodes []string
+	p := newParser("a; b; c")
+	err := p.ParseAll(func(n Node) bool {
+		nodes = append(nodes, n.String())
+		return false
+	})
+	if err != nil {
+		t.Errorf("error parsing: %v", err)
+	}
+	if len(nodes) != 1 || nodes[0] != "a" {
+		t.Errorf("expected [a], got %q", nodes)
+	}
+	if r := p.Peek(0).Text; r != "b" {
+		t.Errorf("expected next token to be b, got %q", r)
+	}
+
+	// Errors.
+	for _, src := range []string{"a b", "a;; b", "a; +"} {
+		if err := newParser(src).ParseAll(func(Node) bool { return true }); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestSignificantNewlines(t *testing.T) {
+	type newlineTest struct {
+		source      string
+		significant bool
+		nodes       []string
+	}
+
+	tests := []newlineTest{
+		{"a\nb", false, nil},
+		{"a\n+ b", false, []string{"(a + b)"}},
+		{"a\nb", true, []string{"a", "b"}},
+		{"\n\na = 1\n\nb = a + 2\n", true, []string{"(a = 1)", "(b = (a + 2))"}},
+		{"a; b\nc;\nd", true, []string{"a", "b", "c", "d"}},
+		{"a +\n  b\nc # comment\nd", true, []string{"(a + b)", "c", "d"}},
+		{"f(a,\nb)", true, []string{"f(a, b)"}},
+	}
+
+	for _, test := range tests {
+		l := NewStringLexer(test.source)
+		l.SignificantNewlines = test.significant
+		p := newParser("")
+		p.Stack = NewStack(l)
+		var nodes []string
+		err := p.ParseAll(func(n Node) bool {
+			nodes = append(nodes, n.String())
+			return true
+		})
+		if test.nodes == nil {
+			if err == nil {
+				t.Errorf("%q: expected error", test.source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if strings.Join(nodes, "; ") != strings.Join(test.nodes, "; ") {
+			t.Errorf("%q: expected %q, got %q", test.source, test.nodes, nodes)
+		}
+	}
+
+	// Newlines don't end an expression inside parentheses before an
+	// operator, only before an operand.
+	l := NewStringLexer("(a\n+ b)")
+	l.SignificantNewlines = true
+	p := newParser("")
+	p.Stack = NewStack(l)
+	if err := p.ParseAll(func(Node) bool { return true }); err == nil {
+		t.Errorf("expected error for newline before operator")
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	p := newParser("").Clone()
+	p.UnregisterInfix(TokenAssignment)
+	p.UnregisterPrefix(TokenMinus)
+
+	for _, src := range []string{"a = b", "-a"} {
+		p.Stack = NewStack(NewStringLexer(src))
+		_, err := p.Parse()
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("%q: expected *ParseError, got %v", src, err)
+		}
+	}
+
+	p.Stack = NewStack(NewStringLexer("a + b - c"))
+	if _, err := p.Parse(); err != nil {
+		t.Errorf("error parsing: %v", err)
+	}
+
+	if _, ok := InfixParsers[TokenAssignment]; !ok {
+		t.Errorf("default infix parsers were modified")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	// A parser built from scratch only knows its own parsers.
+	p := NewParser(NewStack(NewStringLexer("-a ~ b")))
+	p.RegisterPrefix(TokenName, NameParser(0))
+	p.RegisterPrefix(TokenMinus, UnaryParser(PrecPrefix))
+	p.RegisterInfix(TokenTilde, BinaryParser(PrecSum))
+	n, err := p.Parse()
+	if err != nil || n.String() != "((-a) ~ b)" {
+		t.Errorf("expected ((-a) ~ b), got %v (%v)", n, err)
+	}
+
+	p.Stack = NewStack(NewStringLexer("a + b"))
+	if _, err := p.Parse(); err == nil {
+		t.Errorf("expected error parsing an unregistered operator")
+	}
+
+	// Replacing a parser affects only the parser that owns the maps.
+	q := newParser("").Clone()
+	q.RegisterInfix(TokenMinus, BinaryRightParser(PrecSum))
+	q.Stack = NewStack(NewStringLexer("a - b - c"))
+	if n, err := q.Parse(); err != nil || n.String() != "(a - (b - c))" {
+		t.Errorf("expected (a - (b - c)), got %v (%v)", n, err)
+	}
+	if _, ok := InfixParsers[TokenMinus].(BinaryParser); !ok {
+		t.Errorf("default infix parsers were modified")
+	}
+}
+
+func TestInfixAssoc(t *testing.T) {
+	p := newParser("").Clone()
+	p.Infix(TokenMinus, PrecSum, AssocRight)
+	p.Infix(TokenTilde, PrecSum, AssocNone)
+	p.Infix(TokenPipe, PrecSum, AssocLeft)
+	tests := []struct {
+		source string
+		result string
+		err    string
+	}{
+		{"a - b - c", "(a - (b - c))", ""},
+		{"a | b | c", "((a | b) | c)", ""},
+		{"a ~ b * c", "(a ~ (b * c))", ""},
+		{"a ~ b ~ c", "", "operator '~' is not associative"},
+		{"a ~ b + c", "", "operator '~' is not associative"},
+	}
+	for _, test := range tests {
+		p.Stack = NewStack(NewStringLexer(test.source))
+		n, err := p.Parse()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: expected error %q, got %v", test.source, test.err, err)
+			}
+			continue
+		}
+		if err != nil || n.String() != test.result {
+			t.Errorf("%q: expected %s, got %v (%v)", test.source, test.result, n, err)
+		}
+	}
+
+	assocs := []struct {
+		parser InfixParser
+		assoc  Assoc
+		ok     bool
+	}{
+		{BinaryParser(PrecSum), AssocLeft, true},
+		{BinaryRightParser(PrecExponent), AssocRight, true},
+		{ComparisonParser(PrecComparison), AssocLeft, true},
+		{OperatorParser{PrecSum, AssocNone}, AssocNone, true},
+		{TernaryParser(PrecConditional), 0, false},
+	}
+	for _, test := range assocs {
+		if a, ok := Associativity(test.parser); a != test.assoc || ok != test.ok {
+			t.Errorf("%T: expected %s %v, got %s %v", test.parser, test.assoc, test.ok, a, ok)
+		}
+	}
+}
+
+// letParser parses "let a = b" statements.
+type letParser int
+
+func (letParser) Parse(parser *Parser, token Token) Stmt {
+	name := parser.Expect(TokenName)
+	parser.Expect(TokenAssignment)
+	return &letStmt{Pos: token.Pos, Name: name.Text, Value: parser.ParseExpression(0)}
+}
+
+type letStmt struct {
+	Pos
+	Name  string
+	Value Node
+}
+
+func (n *letStmt) String() string {
+	return fmt.Sprintf("let %s = %s", n.Name, n.Value)
+}
+
+func (n *letStmt) StmtNode() {}
+
+func TestParseProgram(t *testing.T) {
+	const tokenLet TokenType = 1001
+	tests := []struct {
+		source string
+		result string
+		sexpr  string
+	}{
+		{"", "", "(program)"},
+		{"a", "a", "(program a)"},
+		{"a = 1; f(a);", "(a = 1); f(a)", "(program (= a 1) (call f a))"},
+		{"let a = 1 + 2; a * 2", "let a = (1 + 2); (a * 2)", "(program let a = (1 + 2) (* a 2))"},
+	}
+	for _, test := range tests {
+		l := NewStringLexer(test.source)
+		l.RegisterKeyword("let", tokenLet)
+		p := NewParser(NewStack(l))
+		p.PrefixParsers = PrefixParsers
+		p.InfixParsers = InfixParsers
+		p.StmtParsers = map[TokenType]StmtParser{tokenLet: letParser(0)}
+		prog, err := p.ParseProgram()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := prog.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		if r := ToSExpr(prog); r != test.sexpr {
+			t.Errorf("%q: expected %q, got %q", test.source, test.sexpr, r)
+		}
+	}
+
+	prog, err := newParser("a; b c").ParseProgram()
+	if prog != nil || err == nil || err.Error() != `expected ; or EOF, got "c"` {
+		t.Errorf("expected error, got %v (%v)", prog, err)
+	}
+
+	prog, _ = newParser("a;\n  b + c").ParseProgram()
+	if s, ok := prog.Stmts[1].(*ExprStmt); !ok || s.Pos.String() != "2:5" || s.X.String() != "(b + c)" {
+		t.Errorf("expected ExprStmt at 2:5, got %#v", prog.Stmts[1])
+	}
+}
+
+func TestBlock(t *testing.T) {
+	tests := []struct {
+		source string
+		result string
+		sexpr  string
+	}{
+		{"{}", "{}", "(block)"},
+		{"{a}", "{a}", "(block a)"},
+		{"{a = 1; b = a + 1; a * b}", "{(a = 1); (b = (a + 1)); (a * b)}",
+			"(block (= a 1) (= b (+ a 1)) (* a b))"},
+		{"{;a;;b;}", "{a; b}", "(block a b)"},
+		{"f({a; b}, {c})", "f({a; b}, {c})", "(call f (block a b) (block c))"},
+		{"{a, b; c} + 1", "({(a, b); c} + 1)", "(+ (block (seq a b) c) 1)"},
+		{"{{a}; {}}", "{{a}; {}}", "(block (block a) (block))"},
+	}
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		if r := ToSExpr(n); r != test.sexpr {
+			t.Errorf("%q: expected %q, got %q", test.source, test.sexpr, r)
+		}
+	}
+
+	errs := map[string]string{
+		"{a; b":  "unclosed '{' opened at 1:1",
+		"{a b}":  `expected } to close '{' opened at 1:1, got "b"`,
+		"{a; )}": "could not parse )",
+	}
+	for src, msg := range errs {
+		if _, err := newParser(src).Parse(); err == nil || err.Error() != msg {
+			t.Errorf("%q: expected %q, got %v", src, msg, err)
+		}
+	}
+
+	// With significant newlines, a newline separates expressions.
+	l := NewStringLexer("{\n  a = 1\n  a +\n    2\n}")
+	l.SignificantNewlines = true
+	p := newParser("")
+	p.Stack = NewStack(l)
+	if n, err := p.Parse(); err != nil || n.String() != "{(a = 1); (a + 2)}" {
+		t.Errorf("expected {(a = 1); (a + 2)}, got %v (%v)", n, err)
+	}
+}
+
+func TestIfWhile(t *testing.T) {
+	tests := []struct {
+		source string
+		result string
+		sexpr  string
+	}{
+		{"if (a) b", "(if (a) b)", "(if a b)"},
+		{"if (a < b) c = 1 else c = 2", "(if ((a < b)) (c = 1) else (c = 2))",
+			"(if (< a b) (= c 1) (= c 2))"},
+		{"if (a) if (b) c else d", "(if (a) (if (b) c else d))", "(if a (if b c d))"},
+		{"x = if (a) b else c + 1", "(x = (if (a) b else (c + 1)))", "(= x (if a b (+ c 1)))"},
+		{"f(if (a) b, c)", "f((if (a) b), c)", "(call f (if a b) c)"},
+		{"while (a) { a = a - 1 }", "(while (a) {(a = (a - 1))})", "(while a (block (= a (- a 1))))"},
+		{"while (a, b) c", "(while ((a, b)) c)", "(while (seq a b) c)"},
+	}
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		if r := ToSExpr(n); r != test.sexpr {
+			t.Errorf("%q: expected %q, got %q", test.source, test.sexpr, r)
+		}
+	}
+
+	errs := map[string]string{
+		"if a b":        `expected ( after 'if', got "a"`,
+		"while (a b":    `expected ) to close '(' opened at 1:7, got "b"`,
+		"if (a) b else": "could not parse EOF",
+		"else b":        "could not parse else",
+	}
+	for src, msg := range errs {
+		if _, err := newParser(src).Parse(); err == nil || err.Error() != msg {
+			t.Errorf("%q: expected %q, got %v", src, msg, err)
+		}
+	}
+
+	// In a program, they are statements.
+	prog, err := newParser("if (a) b; while (c) d").ParseProgram()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if _, ok := prog.Stmts[0].(*IfNode); !ok {
+		t.Errorf("expected *IfNode, got %T", prog.Stmts[0])
+	}
+	if _, ok := prog.Stmts[1].(*WhileNode); !ok {
+		t.Errorf("expected *WhileNode, got %T", prog.Stmts[1])
+	}
+}
+
+func TestMixfix(t *testing.T) {
+	p := newParser("").Clone()
+	p.PrefixParsers[TokenPipe] = AsPrefix(MixfixParser{
+		Separators: []Token{{Type: TokenPipe}},
+		Closed:     true,
+	})
+	p.InfixWords = map[string]InfixParser{
+		"between": AsInfix(MixfixParser{
+			Separators: []Token{{Type: TokenName, Text: "and"}},
+			Prec:       PrecComparison,
+		}),
+	}
+	p.InfixParsers[TokenIf] = AsInfix(MixfixParser{
+		Separators: []Token{{Type: TokenElse}},
+		Prec:       PrecConditional,
+	})
+	p.PrefixWords = map[string]PrefixParser{
+		"sum": AsPrefix(MixfixParser{
+			Separators: []Token{{Type: TokenName, Text: "to"}, {Type: TokenName, Text: "of"}},
+			Prec:       PrecSum,
+		}),
+	}
+	tests := []struct {
+		source string
+		result string
+		sexpr  string
+	}{
+		{"|a - b| * 2", "((| (a - b) |) * 2)", "(* (mixfix (| |) (- a b)) 2)"},
+		{"|a| | |b|", "((| a |) | (| b |))", "(| (mixfix (| |) a) (mixfix (| |) b))"},
+		{"|(a | b)|", "(| (a | b) |)", "(mixfix (| |) (| a b))"},
+		{"x + 1 between a and b * 2 && c", "(((x + 1) between a and (b * 2)) && c)",
+			"(&& (mixfix (between and) (+ x 1) a (* b 2)) c)"},
+		{"a if b else c if d else e", "(a if b else (c if d else e))",
+			"(mixfix (if else) a b (mixfix (if else) c d e))"},
+		{"x = a if b else c", "(x = (a if b else c))", "(= x (mixfix (if else) a b c))"},
+		{"sum i to n of i * 2 + 1", "((sum i to n of (i * 2)) + 1)",
+			"(+ (mixfix (sum to of) i n (* i 2)) 1)"},
+	}
+	for _, test := range tests {
+		p.Stack = NewStack(NewStringLexer(test.source))
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		if r := ToSExpr(n); r != test.sexpr {
+			t.Errorf("%q: expected %q, got %q", test.source, test.sexpr, r)
+		}
+		if r := new(Formatter).Format(n); r != n.String() {
+			t.Errorf("%q: expected %q, got %q", test.source, n.String(), r)
+		}
+	}
+
+	errs := map[string]string{
+		"|a":               "expected '|' after '|' at 1:1, got EOF",
+		"x between a or b": `expected 'and' after 'between' at 1:3, got "or"`,
+		"a if b":           "expected 'else' after 'if' at 1:3, got EOF",
+	}
+	for src, msg := range errs {
+		p.Stack = NewStack(NewStringLexer(src))
+		_, err := p.Parse()
+		if err == nil || err.Error() != msg {
+			t.Errorf("%q: expected %q, got %v", src, msg, err)
+		}
+	}
+}
+
+func TestTrace(t *testing.T) {
+	expected := `  prefix UnaryParser for -
+    prefix NameParser for "a"
+    node a
+    stop at +: 14 >= 11
+  node (-a)
+  continue at +: 0 < 11
+  infix BinaryParser for +
+    prefix NameParser for "b"
+    node b
+    continue at *: 11 < 12
+    infix BinaryParser for *
+      prefix NameParser for "c"
+      node c
+      stop at EOF: 12 >= 0
+    node (b * c)
+    stop at EOF: 11 >= 0
+  node ((-a) + (b * c))
+  stop at EOF: 0 >= 0
+`
+	b := new(bytes.Buffer)
+	p := newParser("-a + b * c")
+	p.Trace(b)
+	if _, err := p.Parse(); err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if b.String() != expected {
+		t.Errorf("expected trace:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// The recursive path used by ParseRecover traces the same.
+	b.Reset()
+	p = newParser("-a + b * c")
+	p.Trace(b)
+	if _, errs := p.ParseRecover(); errs != nil {
+		t.Fatalf("error parsing: %v", errs)
+	}
+	if b.String() != expected {
+		t.Errorf("expected trace:\n%s\ngot:\n%s", expected, b)
+	}
+
+	// Adapted parsers are shown as they are, and nil stops tracing.
+	b.Reset()
+	p = newParser("a")
+	p.PrefixParsers = map[TokenType]PrefixParser{TokenName: AsPrefix(MixfixParser{Closed: true})}
+	p.Trace(b)
+	p.Parse()
+	if r := b.String(); !strings.HasPrefix(r, `  prefix MixfixParser for "a"`) {
+		t.Errorf("expected MixfixParser, got %q", r)
+	}
+	b.Reset()
+	p = newParser("a + b")
+	p.Trace(b)
+	p.Trace(nil)
+	p.Parse()
+	if b.Len() != 0 {
+		t.Errorf("expected no trace, got %q", b)
+	}
+}
+
+func TestReset(t *testing.T) {
+	p := newParser("").Clone()
+	p.OperatorSections = true
+	p.AttachComments = true
+	p.RegisterInfix(TokenTilde, BinaryParser(PrecSum))
+	for _, src := range []string{"(+ 1) ~ a # one", "/* two */ (1 -)"} {
+		l := NewStringLexer(src)
+		l.KeepComments = true
+		p.Stack.Reset(l)
+		p.Reset(p.Stack)
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		// Section parameters are numbered from the start again.
+		if r := n.String(); !strings.Contains(r, "$1") || strings.Contains(r, "$2") {
+			t.Errorf("%q: expected a section with $1, got %q", src, r)
+		}
+		var comments []string
+		Walk(n, func(n Node) bool {
+			for _, c := range p.Trivia(n) {
+				comments = append(comments, c.Text)
+			}
+			return true
+		})
+		if len(comments) != 1 {
+			t.Errorf("%q: expected a comment, got %q", src, comments)
+		}
+	}
+	if _, ok := p.InfixParsers[TokenTilde]; !ok || !p.OperatorSections {
+		t.Errorf("expected grammar and options to survive Reset")
+	}
+}
+
+func TestPrecedenceOrder(t *testing.T) {
+	levels := []int{
+		PrecSequence,
+		PrecAssignment,
+		PrecConditional,
+		PrecLogicalOr,
+		PrecLogicalAnd,
+		PrecBitOr,
+		PrecBitAnd,
+		PrecEquality,
+		PrecComparison,
+		PrecShift,
+		PrecSum,
+		PrecProduct,
+		PrecExponent,
+		PrecPrefix,
+		PrecPostfix,
+		PrecCall,
+	}
+	if levels[0] <= 0 {
+		t.Errorf("lowest precedence must be greater than 0, got %d", levels[0])
+	}
+	for k := 1; k < len(levels); k++ {
+		if levels[k] <= levels[k-1] {
+			t.Errorf("precedence %d (%d) must be greater than precedence %d (%d)", k, levels[k], k-1, levels[k-1])
+		}
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	n, err := newParser("a +\n b").Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	b := n.(*BinaryNode)
+	tests := []struct {
+		node Node
+		pos  string
+	}{
+		{b, "1:3"},
+		{b.Left, "1:1"},
+		{b.Right, "2:2"},
+	}
+	for _, test := range tests {
+		if r := test.node.Position().String(); r != test.pos {
+			t.Errorf("%s: expected position %s, got %s", test.node, test.pos, r)
+		}
+	}
+
+	n, err = newParser("f(x, -1)").Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	f := n.(*FunctionNode)
+	positions := []Pos{f.Pos, f.Function.Position(), f.Args.Pos, f.Args.Nodes[0].Position(), f.Args.Nodes[1].Position()}
+	offsets := []int{1, 0, 1, 2, 5}
+	for k, v := range positions {
+		if v.Offset != offsets[k] {
+			t.Errorf("node %d: expected offset %d, got %d", k, offsets[k], v.Offset)
+		}
+	}
+}
+
+// panicParser is a prefix parser that panics with the given value.
+type panicParser struct {
+	value interface{}
+}
+
+func (p panicParser) Parse(parser *Parser, token Token) Node {
+	panic(p.value)
+}
+
+func TestRecover(t *testing.T) {
+	errPanic := errors.New("error value")
+
+	p := newParser("a").Clone()
+	p.PrefixParsers[TokenName] = panicParser{"string value"}
+	_, err := p.Parse()
+	if e, ok := err.(*ParseError); !ok || e.Msg != "string value" {
+		t.Errorf("expected *ParseError with the panic value, got %#v", err)
+	}
+
+	p = newParser("a").Clone()
+	p.PrefixParsers[TokenName] = panicParser{errPanic}
+	if _, err := p.Parse(); err != errPanic {
+		t.Errorf("expected %v, got %v", errPanic, err)
+	}
+
+	defer func() {
+		if _, ok := recover().(runtime.Error); !ok {
+			t.Errorf("expected runtime error to be re-panicked")
+		}
+	}()
+	p = newParser("a").Clone()
+	p.PrefixParsers[TokenName] = nilMapParser(0)
+	p.Parse()
+}
+
+// nilMapParser is a prefix parser with a bug that causes a runtime error.
+type nilMapParser int
+
+func (nilMapParser) Parse(parser *Parser, token Token) Node {
+	var m map[string]int
+	m["a"] = 1
+	return nil
+}
+
+func TestWordOperators(t *testing.T) {
+	type wordTest struct {
+		source string
+		result string
+		sexpr  string
+	}
+
+	tests := []wordTest{
+		{"a and b or c", "((a and b) or c)", "(or (and a b) c)"},
+		{"a or b and c", "(a or (b and c))", "(or a (and b c))"},
+		{"not a and b", "((not a) and b)", "(and (not a) b)"},
+		{"a + b and andy", "((a + b) and andy)", "(and (+ a b) andy)"},
+		{"not(a)", "(not a)", "(not a)"},
+	}
+
+	base := newParser("")
+	for _, test := range tests {
+		p := base.Clone()
+		p.Stack = NewStack(NewStringLexer(test.source))
+		p.PrefixWords = map[string]PrefixParser{
+			"not": UnaryParser(PrecPrefix),
+		}
+		p.InfixWords = map[string]InfixParser{
+			"and": BinaryParser(PrecLogicalAnd),
+			"or":  BinaryParser(PrecLogicalOr),
+		}
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		if r := ToSExpr(n); r != test.sexpr {
+			t.Errorf("%q: expected %q, got %q", test.source, test.sexpr, r)
+		}
+	}
+
+	// Clone copies the word maps.
+	p := base.Clone()
+	p.InfixWords = map[string]InfixParser{"and": BinaryParser(PrecLogicalAnd)}
+	c := p.Clone()
+	c.InfixWords["or"] = BinaryParser(PrecLogicalOr)
+	if _, ok := p.InfixWords["or"]; ok {
+		t.Errorf("clone modified the original word map")
+	}
+}
+
+func TestUnaryOperand(t *testing.T) {
+	type operandTest struct {
+		source string
+		result string
+	}
+
+	tests := []operandTest{
+		{"-", "expected expression after '-'"},
+		{"(-)", "expected expression after '-'"},
+		{"a * !", "expected expression after '!'"},
+		{"-a", ""},
+		{"a - b", ""},
+		{"- -a", ""},
+	}
+
+	for _, test := range tests {
+		_, err := newParser(test.source).Parse()
+		if test.result == "" {
+			if err != nil {
+				t.Errorf("%q: error parsing: %v", test.source, err)
+			}
+			continue
+		}
+		if err == nil || err.Error() != test.result {
+			t.Errorf("%q: expected error %q, got %v", test.source, test.result, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p := newParser("")
+	if err := p.Validate(); err != nil {
+		t.Errorf("default grammar: unexpected error: %v", err)
+	}
+
+	p = p.Clone()
+	p.InfixParsers[TokenTilde] = BinaryParser(0)
+	err := p.Validate()
+	if err == nil || err.Error() != "infix parser for ~ has precedence 0 and will never be used" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	p = newParser("").Clone()
+	p.InfixWords = map[string]InfixParser{"and": BinaryParser(0)}
+	err = p.Validate()
+	if err == nil || err.Error() != `infix parser for "and" has precedence 0 and will never be used` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestComparison(t *testing.T) {
+	type comparisonTest struct {
+		source   string
+		disallow bool
+		result   string
+	}
+
+	tests := []comparisonTest{
+		{"a < b + c", false, "(a < (b + c))"},
+		{"a == b < c", false, "(a == (b < c))"},
+		{"a <= b != c >= d", false, "((a <= b) != (c >= d))"},
+		{"a & b == c << d", false, "(a & (b == (c << d)))"},
+		{"a != !b", false, "(a != (!b))"},
+		{"a < b < c", false, "((a < b) < c)"},
+		{"a < b < c", true, "chained comparison is not allowed"},
+		{"a == b == c", true, "chained comparison is not allowed"},
+		{"a < b == c", true, "chained comparison is not allowed"},
+		{"(a < b) < c", true, "chained comparison is not allowed"},
+		{"a < b && b < c", true, "((a < b) && (b < c))"},
+		{"a + b < c", true, "((a + b) < c)"},
+	}
+
+	for _, test := range tests {
+		p := newParser(test.source)
+		p.DisallowChainedComparison = test.disallow
+		n, err := p.Parse()
+		var r string
+		if err != nil {
+			r = err.Error()
+		} else {
+			r = n.String()
+		}
+		if r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+}
+
+func TestAssignmentAsStatement(t *testing.T) {
+	type assignmentTest struct {
+		source    string
+		statement bool
+		result    string
+	}
+
+	errStatement := "assignment is only allowed as a statement"
+	tests := []assignmentTest{
+		{"a = b", false, "(a = b)"},
+		{"a = b", true, "(a = b)"},
+		{"a = b + c", true, "(a = (b + c))"},
+		{"c + (a = b)", false, "(c + (a = b))"},
+		{"c + (a = b)", true, errStatement},
+		{"a = b = c", true, errStatement},
+		{"f(a = b)", true, errStatement},
+		{"(a = 1)", true, "(a = 1)"},
+		{"((a) = 1)", true, "(a = 1)"},
+		{"(a) + (b = 1)", true, errStatement},
+		{"{ a = 1; a }", true, "{(a = 1); a}"},
+		{"x = { a = 1; a }", true, "(x = {(a = 1); a})"},
+		{"f({ a }, (b = 1))", true, errStatement},
+		{"if (c) a = 1 else b = 2", true, "(if (c) (a = 1) else (b = 2))"},
+		{"while (c) a = 1", true, "(while (c) (a = 1))"},
+		{"if (a = 1) b", true, errStatement},
+		{"x + if (c) a = 1 else b", true, errStatement},
+	}
+
+	for _, test := range tests {
+		p := newParser(test.source)
+		p.AssignmentAsStatement = test.statement
+		n, err := p.Parse()
+		var r string
+		if err != nil {
+			r = err.Error()
+		} else {
+			r = n.String()
+		}
+		if r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	// Each statement of a program is at statement position.
+	p := newParser("a = 1; b = a")
+	p.AssignmentAsStatement = true
+	if err := p.ParseAll(func(Node) bool { return true }); err != nil {
+		t.Errorf("error parsing: %v", err)
+	}
+}
+
+func TestNull(t *testing.T) {
+	tests := map[string]string{
+		"null":      "null",
+		"a == null": "(a == null)",
+		"nullish":   "nullish",
+		"f(null)":   "f(null)",
+	}
+	for src, expected := range tests {
+		n, err := newParser(src).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if r := n.String(); r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+	}
+
+	n, _ := newParser("null").Parse()
+	if n != Null {
+		t.Errorf("expected the Null node, got %#v", n)
+	}
+}
+
+func TestIncrementDecrement(t *testing.T) {
+	type incrementTest struct {
+		source string
+		result string
+	}
+
+	tests := []incrementTest{
+		{"++a", "(++a)"},
+		{"a--", "(a--)"},
+		{"a+++b", "((a++) + b)"},
+		{"a + +b", "(a + (+b))"},
+		{"a - -b", "(a - (-b))"},
+		{"-a--", "(-(a--))"},
+		{"++a * b", "((++a) * b)"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+}
+
+func TestElvis(t *testing.T) {
+	type elvisTest struct {
+		source string
+		result string
+	}
+
+	tests := []elvisTest{
+		{"a ?: b", "(a ?: b)"},
+		{"a?:b", "(a ?: b)"},
+		{"a ?: b ?: c", "(a ?: (b ?: c))"},
+		{"a ? b : c", "(a ? b : c)"},
+		{"a ? b ?: c : d", "(a ? (b ?: c) : d)"},
+		{"a ?: b ? c : d", "(a ?: (b ? c : d))"},
+		{"a || b ?: c + d", "((a || b) ?: (c + d))"},
+		{"x = a ?: b", "(x = (a ?: b))"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	n, err := newParser("a ?: b + c").Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if r := ToSExpr(n); r != "(?: a (+ b c))" {
+		t.Errorf("expected %q, got %q", "(?: a (+ b c))", r)
+	}
+}
+
+func TestPrecedenceFunc(t *testing.T) {
+	type precedenceTest struct {
+		source string
+		result string
+	}
+
+	// "dot" is registered as a sum-level operator, but declared to bind
+	// tighter than "*"; "cat" keeps its registered precedence.
+	fixity := map[string]int{"dot": PrecExponent}
+	tests := []precedenceTest{
+		{"a * b dot c", "(a * (b dot c))"},
+		{"a dot b * c", "((a dot b) * c)"},
+		{"a dot b dot c", "((a dot b) dot c)"},
+		{"a * b cat c", "((a * b) cat c)"},
+		{"a cat b * c", "(a cat (b * c))"},
+		{"a + b * c", "(a + (b * c))"},
+	}
+
+	for _, test := range tests {
+		p := newParser(test.source)
+		p.InfixWords = map[string]InfixParser{
+			"dot": BinaryParser(PrecSum),
+			"cat": BinaryParser(PrecSum),
+		}
+		p.PrecedenceFunc = func(t Token) int {
+			if t.Type == TokenName {
+				return fixity[t.Text]
+			}
+			return 0
+		}
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+}
+
+func TestParseSingle(t *testing.T) {
+	tests := []string{"a", "42", "1.5", "null", " a # comment", "a + b", "-1", "(a)", "f()", "a b"}
+	for _, src := range tests {
+		n1, err1 := newParser(src).Parse()
+		// ParseExpression always takes the general path.
+		n2 := newParser(src).ParseExpression(0)
+		if err1 != nil {
+			// Only trailing tokens are an error here.
+			if src != "a b" {
+				t.Errorf("%q: error parsing: %v", src, err1)
+			}
+			continue
+		}
+		if n1.String() != n2.String() || n1.Position() != n2.Position() {
+			t.Errorf("%q: expected %q at %s, got %q at %s", src, n2, n2.Position(), n1, n1.Position())
+		}
+	}
+
+	// Words and the token limit still apply.
+	p := newParser("not")
+	p.PrefixWords = map[string]PrefixParser{"not": UnaryParser(PrecPrefix)}
+	if _, err := p.Parse(); err == nil {
+		t.Errorf("expected error for prefix word without operand")
+	}
+	p = newParser("a")
+	p.MaxTokens = 1
+	if _, err := p.Parse(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// OnNode is called for the single node.
+	var nodes []Node
+	p = newParser("a")
+	p.OnNode = func(n Node) { nodes = append(nodes, n) }
+	if n, _ := p.Parse(); len(nodes) != 1 || nodes[0] != n {
+		t.Errorf("expected OnNode to be called once with %v, got %v", n, nodes)
+	}
+}
+
+func BenchmarkParseSingle(b *testing.B) {
+	for _, src := range []string{"a", "42"} {
+		b.Run(src+"/fast", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := newParser(src).Parse(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(src+"/general", func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				newParser(src).ParseExpression(0)
+			}
+		})
+	}
+}
+
+func TestExpectEOF(t *testing.T) {
+	p := newParser("a b + c")
+	n := p.ParseExpression(0)
+	if r := n.String(); r != "a" {
+		t.Errorf("expected a, got %q", r)
+	}
+	if r := p.Remaining(); len(r) != 1 || r[0].Text != "b" {
+		t.Errorf("expected remaining b, got %v", r)
+	}
+	err := p.ExpectEOF()
+	if err == nil || err.Error() != `unexpected token "b" after expression` {
+		t.Errorf("expected error for trailing b, got %v", err)
+	}
+
+	// Remaining doesn't consume tokens and returns them in order.
+	p.Peek(2)
+	r := p.Remaining()
+	if len(r) != 3 || r[0].Text != "b" || r[1].Text != "+" || r[2].Text != "c" {
+		t.Errorf("expected remaining b + c, got %v", r)
+	}
+	r[0].Text = "x"
+	if !p.PeekTextIs("b") {
+		t.Errorf("Remaining must return a copy")
+	}
+
+	p = newParser("a + b")
+	p.ParseExpression(0)
+	if err := p.ExpectEOF(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAllowTrailing(t *testing.T) {
+	type trailingTest struct {
+		source   string
+		allow    bool
+		result   string
+		err      string
+		trailing string
+	}
+
+	tests := []trailingTest{
+		{"a b", false, "", `unexpected token "b" after expression`, ""},
+		{"a + b c", false, "", `unexpected token "c" after expression`, ""},
+		{"a + b )", false, "", "unexpected token ) after expression", ""},
+		{"a + b", false, "(a + b)", "", ""},
+		{"a b", true, "a", "", "b"},
+		{"a + b c", true, "(a + b)", "", "c"},
+		{"a + b", true, "(a + b)", "", ""},
+	}
+
+	for _, test := range tests {
+		p := newParser(test.source)
+		p.AllowTrailing = test.allow
+		n, err := p.Parse()
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%q: expected error %q, got %v", test.source, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		// The trailing token is left in the stack; EOF has no text.
+		if r := p.Pop(); r.Text != test.trailing {
+			t.Errorf("%q: expected trailing %q, got %v", test.source, test.trailing, r)
+		}
+	}
+}
+
+func TestNumberLiterals(t *testing.T) {
+	type numberTest struct {
+		source string
+		value  float64
+		result string
+	}
+
+	tests := []numberTest{
+		{"0xFF", 255, "0xFF"},
+		{"0x1f", 31, "0x1f"},
+		{"1e9", 1e9, "1e9"},
+		{"1.5e-3", 1.5e-3, "1.5e-3"},
+		{"2E+2", 200, "2E+2"},
+		{"1.50", 1.5, "1.50"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		num, ok := n.(*NumberNode)
+		if !ok || num.Value != test.value {
+			t.Errorf("%q: expected %v, got %#v", test.source, test.value, n)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	// The source form is kept in expressions and folded literals.
+	p := newParser("-0x10 * 1e3")
+	p.FoldNegativeLiterals = true
+	if n, err := p.Parse(); err != nil || n.String() != "(-0x10 * 1e3)" {
+		t.Errorf("expected (-0x10 * 1e3), got %v (%v)", n, err)
+	}
+
+	for _, src := range []string{"0x", "1e", "1 + 2e-"} {
+		_, err := newParser(src).Parse()
+		if err == nil || !strings.HasPrefix(err.Error(), "malformed number") {
+			t.Errorf("%q: expected malformed number error, got %v", src, err)
+		}
+	}
+}
+
+func TestUnclosedParen(t *testing.T) {
+	tests := map[string]string{
+		"a + (b * c":          "unclosed '(' opened at 1:5",
+		"(a":                  "unclosed '(' opened at 1:1",
+		"f(a, b":              "unclosed '(' opened at 1:2",
+		"a +\n  g(b, (c + d)": "unclosed '(' opened at 2:4",
+		"(a b)":               `expected ) to close '(' opened at 1:1, got "b"`,
+		"f(a b)":              `expected ) to close '(' opened at 1:2, got "b"`,
+	}
+	for src, expected := range tests {
+		_, err := newParser(src).Parse()
+		if err == nil || err.Error() != expected {
+			t.Errorf("%q: expected error %q, got %v", src, expected, err)
+		}
+	}
+
+	p := newParser("(+ a")
+	p.OperatorSections = true
+	if _, err := p.Parse(); err == nil || err.Error() != "unclosed '(' opened at 1:1" {
+		t.Errorf("expected unclosed section error, got %v", err)
+	}
+}
+
+func TestDefaultPrefix(t *testing.T) {
+	type defaultTest struct {
+		source string
+		result string
+	}
+
+	tests := []defaultTest{
+		{"f(*) + /", "(f(*) + /)"},
+		{"-:", "(-:)"},
+		{"a ? ; : b", "(a ? ; : b)"},
+		{"a + b", "(a + b)"},
+	}
+
+	for _, test := range tests {
+		p := newParser(test.source)
+		p.DefaultPrefix = NameParser(0)
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	// EOF and lexer errors are still errors.
+	for _, src := range []string{"a +", "a + @"} {
+		p := newParser(src)
+		p.DefaultPrefix = NameParser(0)
+		if _, err := p.Parse(); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+	// Without DefaultPrefix, unknown tokens are an error.
+	if _, err := newParser("f(*)").Parse(); err == nil || err.Error() != "could not parse *" {
+		t.Errorf("expected error, got %v", err)
+	}
+}
+
+func TestBracketParser(t *testing.T) {
+	type bracketTest struct {
+		source string
+		result string
+	}
+
+	tests := []bracketTest{
+		{"|a + b|", "|(a + b)|"},
+		{"|a| * 2", "(|a| * 2)"},
+		{"|a - b| | |c|", "(|(a - b)| | |c|)"},
+		{"f(|a|, |-b|)", "f(|a|, |(-b)|)"},
+		{"|a & b|", "|(a & b)|"},
+		{"|(a | b)|", "|(a | b)|"},
+	}
+
+	for _, test := range tests {
+		p := newParser(test.source).Clone()
+		p.PrefixParsers[TokenPipe] = BracketParser{Open: TokenPipe, Close: TokenPipe}
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	p := newParser("a + |b").Clone()
+	p.PrefixParsers[TokenPipe] = BracketParser{Open: TokenPipe, Close: TokenPipe}
+	if _, err := p.Parse(); err == nil || err.Error() != "unclosed '|' opened at 1:5" {
+		t.Errorf("expected unclosed bracket error, got %v", err)
+	}
+}
+
+// plusMinusParser parses "-" both as negation and as subtraction.
+type plusMinusParser int
+
+func (p plusMinusParser) ParsePrefix(parser *Parser, token Token) Node {
+	return NewUnaryNode(token.Type, parser.ParseExpression(PrecPrefix))
+}
+
+func (p plusMinusParser) ParseInfix(parser *Parser, left Node, token Token) Node {
+	return NewBinaryNode(left, token.Type, parser.ParseExpression(int(p)))
+}
+
+func (p plusMinusParser) Precedence() int {
+	return int(p)
+}
+
+func TestPowerOperator(t *testing.T) {
+	tests := map[string]string{
+		"a ** b ** c": "(a ** (b ** c))",
+		"-a ** 2":     "((-a) ** 2)",
+		"a * b ** c":  "(a * (b ** c))",
+		"a**b*c":      "((a ** b) * c)",
+	}
+	base := newParser("").Clone()
+	base.InfixParsers[TokenPower] = BinaryRightParser(PrecExponent)
+	for src, expected := range tests {
+		p := base.Clone()
+		p.Stack = NewStack(NewStringLexer(src))
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if r := n.String(); r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+	}
+}
+
+func TestRegisterBoth(t *testing.T) {
+	type bothTest struct {
+		source string
+		result string
+	}
+
+	tests := []bothTest{
+		{"-a - b", "((-a) - b)"},
+		{"a - -b", "(a - (-b))"},
+		{"a - b * -c", "(a - (b * (-c)))"},
+		{"a * b - c", "((a * b) - c)"},
+	}
+
+	base := NewParser(nil)
+	base.PrefixParsers[TokenName] = NameParser(0)
+	base.InfixParsers[TokenAsterisk] = BinaryParser(PrecProduct)
+	base.RegisterBoth(TokenMinus, plusMinusParser(PrecSum))
+	for _, test := range tests {
+		p := base.Clone()
+		p.Stack = NewStack(NewStringLexer(test.source))
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+}
+
+func TestNewSimpleParser(t *testing.T) {
+	type simpleTest struct {
+		source string
+		result string
+	}
+
+	tests := []simpleTest{
+		{"a(b, c)", "a(b, c)"},
+		{"a ? b : c ? d : e", "(a ? b : (c ? d : e))"},
+		{"a = b + c * d ^ e - f / g", "(a = ((b + (c * (d ^ e))) - (f / g)))"},
+		{"~!-+a", "(~(!(-(+a))))"},
+		{"é + π", "(é + π)"},
+		{"ab", ""},
+	}
+
+	for _, test := range tests {
+		n, err := NewSimpleParser(test.source, stringToToken).Parse()
+		if test.result == "" {
+			if err == nil {
+				t.Errorf("%q: expected error", test.source)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	// Custom symbols.
+	p := NewSimpleParser("a $ b", map[string]TokenType{"$": TokenPlus})
+	if n, err := p.Parse(); err != nil || n.String() != "(a + b)" {
+		t.Errorf("expected (a + b), got %v (%v)", n, err)
+	}
+	// Without it "$" is a name.
+	if _, err := NewSimpleParser("a $ b", stringToToken).Parse(); err == nil {
+		t.Errorf("expected error for name after name")
+	}
+}
+
+func TestCompoundAssignment(t *testing.T) {
+	type compoundTest struct {
+		source string
+		result string
+	}
+
+	tests := []compoundTest{
+		{"a += b * c", "(a = (a + (b * c)))"},
+		{"a += b -= c", "(a = (a + (b = (b - c))))"},
+		{"a*=2", "(a = (a * 2))"},
+		{"a /= b = c", "(a = (a / (b = c)))"},
+		{"a -= -b", "(a = (a - (-b)))"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	for _, src := range []string{"f(a) += b", "1 -= b", "a + b *= c"} {
+		_, err := newParser(src).Parse()
+		if err == nil || err.Error() != "the left-hand side of an assignment must be a name" {
+			t.Errorf("%q: expected error, got %v", src, err)
+		}
+	}
+
+	env := NewEnv()
+	env.Vars["a"] = 2
+	n, _ := newParser("a *= 5").Parse()
+	if r, err := Eval(n, env); err != nil || r != 10 || env.Vars["a"] != 10 {
+		t.Errorf("expected 10, got %v (%v)", r, err)
+	}
+}
+
+func TestEmptyInput(t *testing.T) {
+	for _, src := range []string{"", "   ", "\n\t ", "# only a comment"} {
+		n, err := newParser(src).Parse()
+		if n != nil || err == nil || err.Error() != "empty input" {
+			t.Errorf("%q: expected empty input error, got %v (%v)", src, n, err)
+		}
+		if _, ok := err.(*ParseError); !ok {
+			t.Errorf("%q: expected *ParseError, got %T", src, err)
+		}
+
+		p := newParser(src)
+		p.AllowEmpty = true
+		n, err = p.Parse()
+		if n != nil || err != nil {
+			t.Errorf("%q: expected nil node and error, got %v (%v)", src, n, err)
+		}
+	}
+
+	// Missing operands are still errors.
+	p := newParser("a +")
+	p.AllowEmpty = true
+	if _, err := p.Parse(); err == nil || err.Error() != "could not parse EOF" {
+		t.Errorf("expected error, got %v", err)
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	tests := []struct {
+		source string
+		msg    string
+		pos    string
+	}{
+		{"a +\n  *b", "could not parse *", "2:3"},
+		{"a b", `unexpected token "b" after expression`, "1:3"},
+		{"f(a,\n b", "unclosed '(' opened at 1:2", "2:3"},
+		{"   ", "empty input", "1:4"},
+		{"x = (a = 1) + -)", "expected expression after '-'", "1:16"},
+		// Lexer errors are reported as they are.
+		{`a + "bc`, "unterminated string", "1:5"},
+		{"a @ b", "unexpected character '@'", "1:3"},
+		{"f(a @", "unexpected character '@'", "1:5"},
+		{"a ? b @", "unexpected character '@'", "1:7"},
+		{"-\n 0x", `malformed number "0x"`, "2:2"},
+		{"/* a", "unterminated comment", "1:1"},
+	}
+	for _, test := range tests {
+		_, err := newParser(test.source).Parse()
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: expected *ParseError, got %v", test.source, err)
+			continue
+		}
+		if e.Msg != test.msg || e.Pos.String() != test.pos {
+			t.Errorf("%q: expected %q at %s, got %q at %s", test.source, test.msg, test.pos, e.Msg, e.Pos)
+		}
+		if e.Token.Pos != e.Pos {
+			t.Errorf("%q: expected token at %s, got %v at %s", test.source, e.Pos, e.Token, e.Token.Pos)
+		}
+	}
+}
+
+func TestParseErrorToken(t *testing.T) {
+	tests := []struct {
+		source   string
+		typ      TokenType
+		text     string
+		expected string
+	}{
+		{"a +\n  *b", TokenAsterisk, "*", "[]"},
+		{"a b", TokenName, "b", "[EOF]"},
+		{"a ? b c", TokenName, "c", "[:]"},
+		{"a @", TokenError, "unexpected character '@'", "[]"},
+	}
+	for _, test := range tests {
+		_, err := newParser(test.source).Parse()
+		e, ok := err.(*ParseError)
+		if !ok {
+			t.Errorf("%q: expected *ParseError, got %v", test.source, err)
+			continue
+		}
+		expected := fmt.Sprint(e.Expected)
+		if e.Token.Type != test.typ || e.Token.Text != test.text || expected != test.expected {
+			t.Errorf("%q: expected %s %q %s, got %s %q %s", test.source, test.typ, test.text, test.expected,
+				e.Token.Type, e.Token.Text, expected)
+		}
+	}
+}
+
+func TestParseRecover(t *testing.T) {
+	tests := []struct {
+		source string
+		result string
+		errs   []string
+	}{
+		{"a + b", "(a + b)", nil},
+		{"f(a, *, b)", "f(a, <error>, b)", []string{"1:6 could not parse *"}},
+		{"f(, c * ) + 1", "(f(<error>, (c * <error>)) + 1)",
+			[]string{"1:3 could not parse ,", "1:9 could not parse )"}},
+		{"a + (b * ) + c", "((a + (b * <error>)) + c)", []string{"1:10 could not parse )"}},
+		{"a b c", "a", []string{`1:3 unexpected token "b" after expression`}},
+		{"a +", "(a + <error>)", []string{"1:4 could not parse EOF"}},
+		// The close parenthesis is left for the enclosing expression.
+		{"f(a b) + 1", "<error>", []string{"1:5 expected ) to close '(' opened at 1:2, got \"b\"",
+			"1:6 unexpected token ) after expression"}},
+		{"", "<nil>", []string{"1:1 empty input"}},
+	}
+	for _, test := range tests {
+		n, errs := newParser(test.source).ParseRecover()
+		var got []string
+		for _, e := range errs {
+			got = append(got, fmt.Sprintf("%s %s", e.Pos, e.Msg))
+		}
+		if fmt.Sprint(n) != test.result || fmt.Sprint(got) != fmt.Sprint(test.errs) {
+			t.Errorf("%q: expected %s %q, got %s %q", test.source, test.result, test.errs, n, got)
+		}
+	}
+
+	// Parsing stops at sync tokens.
+	p := newParser("f(a ; b, c)")
+	p.SyncTokens = []TokenType{TokenParenR}
+	n, errs := p.ParseRecover()
+	if n.String() != "<error>" || len(errs) != 2 || errs[1].Pos.String() != "1:11" {
+		t.Errorf("expected errors at ';' and ')', got %s %v", n, errs)
+	}
+	if e, ok := n.(*ErrorNode); !ok || e.Err != errs[0] {
+		t.Errorf("expected an ErrorNode for %v, got %#v", errs[0], n)
+	}
+}
+
+func TestStringLiterals(t *testing.T) {
+	tests := []struct {
+		source string
+		value  string
+		result string
+	}{
+		{`"abc"`, "abc", `"abc"`},
+		{`""`, "", `""`},
+		{`"say \"hi\"\n"`, "say \"hi\"\n", `"say \"hi\"\n"`},
+		{`"a\\b\tc"`, "a\\b\tc", `"a\\b\tc"`},
+	}
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		s, ok := n.(*StringNode)
+		if !ok || s.Value != test.value {
+			t.Errorf("%q: expected %q, got %#v", test.source, test.value, n)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	n, err := newParser(`f("a", b) + "c"`).Parse()
+	if err != nil || n.String() != `(f("a", b) + "c")` {
+		t.Errorf(`expected (f("a", b) + "c"), got %v (%v)`, n, err)
+	}
+}
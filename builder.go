@@ -0,0 +1,59 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+// Builder functions construct expression trees in code, like
+// Add(Var("a"), Mul(Num(2), Var("b"))) for "a + 2 * b". The nodes they
+// return are the same the parser builds for the equivalent source, except
+// that they have no position.
+
+// Var returns a name node, like "a".
+func Var(name string) *NameNode {
+	return NewNameNode(name)
+}
+
+// Num returns a number node, like "2".
+func Num(v float64) *NumberNode {
+	return NewNumberNode(v)
+}
+
+// Add returns a sum node, like "a + b".
+func Add(l, r Node) *BinaryNode {
+	return NewBinaryNode(l, TokenPlus, r)
+}
+
+// Sub returns a subtraction node, like "a - b".
+func Sub(l, r Node) *BinaryNode {
+	return NewBinaryNode(l, TokenMinus, r)
+}
+
+// Mul returns a product node, like "a * b".
+func Mul(l, r Node) *BinaryNode {
+	return NewBinaryNode(l, TokenAsterisk, r)
+}
+
+// Div returns a division node, like "a / b".
+func Div(l, r Node) *BinaryNode {
+	return NewBinaryNode(l, TokenSlash, r)
+}
+
+// Pow returns an exponentiation node, like "a ^ b".
+func Pow(l, r Node) *BinaryNode {
+	return NewBinaryNode(l, TokenCaret, r)
+}
+
+// Neg returns a negation node, like "-a".
+func Neg(n Node) *UnaryNode {
+	return NewUnaryNode(TokenMinus, n)
+}
+
+// Call returns a function call node, like "f(a, b)".
+func Call(fn Node, args ...Node) *FunctionNode {
+	list := NewListNode()
+	for _, v := range args {
+		list.Append(v)
+	}
+	return NewFunctionNode(fn, list)
+}
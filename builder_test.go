@@ -0,0 +1,42 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"testing"
+)
+
+func TestBuilder(t *testing.T) {
+	tests := []struct {
+		node   Node
+		source string
+	}{
+		{Var("a"), "a"},
+		{Num(2.5), "2.5"},
+		{Add(Var("a"), Mul(Num(2), Var("b"))), "a + 2 * b"},
+		{Sub(Sub(Var("a"), Var("b")), Var("c")), "a - b - c"},
+		{Div(Var("a"), Sub(Var("b"), Var("c"))), "a / (b - c)"},
+		{Pow(Var("a"), Pow(Var("b"), Var("c"))), "a ^ b ^ c"},
+		{Neg(Pow(Var("a"), Num(2))), "-(a ^ 2)"},
+		{Mul(Neg(Var("a")), Var("b")), "-a * b"},
+		{Call(Var("f")), "f()"},
+		{Call(Var("f"), Var("a"), Add(Var("b"), Num(1))), "f(a, b + 1)"},
+		{Call(Call(Var("f"), Var("a")), Var("b")), "f(a)(b)"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r, expected := test.node.String(), n.String(); r != expected {
+			t.Errorf("%q: expected %q, got %q", test.source, expected, r)
+		}
+		if r, expected := ToSExpr(test.node), ToSExpr(n); r != expected {
+			t.Errorf("%q: expected %q, got %q", test.source, expected, r)
+		}
+	}
+}
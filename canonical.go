@@ -0,0 +1,54 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+// Canonicalize parses src with the default grammar and returns the string
+// representation of the expression, which makes grouping explicit, like
+// "(a + (b * c))" for "a + b * c".
+//
+// The result parses to the same tree, so canonicalizing it again returns
+// it unchanged. Lambdas followed by more of the expression, like the left
+// operand in "(fn(x) x) + 1", are kept in parentheses, since otherwise
+// their body would extend over the rest.
+func Canonicalize(src string) (string, error) {
+	p := &Parser{
+		Stack:         NewStack(NewStringLexer(src)),
+		PrefixParsers: PrefixParsers,
+		InfixParsers:  InfixParsers,
+	}
+	n, err := p.Parse()
+	if err != nil {
+		return "", err
+	}
+	Walk(n, func(n Node) bool {
+		switch n := n.(type) {
+		case *BinaryNode:
+			n.Left = groupLambda(n.Left)
+		case *ElvisNode:
+			n.Left = groupLambda(n.Left)
+		case *FunctionNode:
+			n.Function = groupLambda(n.Function)
+		case *MixfixNode:
+			if !n.Prefix {
+				n.Operands[0] = groupLambda(n.Operands[0])
+			}
+		case *TernaryNode:
+			n.Condition = groupLambda(n.Condition)
+		case *UnaryPostfixNode:
+			n.Left = groupLambda(n.Left)
+		}
+		return true
+	})
+	return n.String(), nil
+}
+
+// groupLambda returns a lambda enclosed in parentheses, or n if it is not
+// a lambda.
+func groupLambda(n Node) Node {
+	if l, ok := n.(*LambdaNode); ok {
+		return NewBracketNode(TokenParenL, l, TokenParenR)
+	}
+	return n
+}
@@ -0,0 +1,78 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"testing"
+)
+
+// canonicalSeeds are inputs from the parser tests, used as the seed corpus
+// for FuzzCanonicalize.
+var canonicalSeeds = []string{
+	"a(b, c)", "a(b)(c)", "a(b ? c : d, e + f)",
+	"~!-+a", "a!!!", "-a * b", "!a + b", "~a ^ b", "-a!", "!a!",
+	"a = b + c * d ^ e - f / g", "(((a)))", "a ^ b ^ c",
+	"a ? b : c ? d : e", "a + b ? c * d : e / f", "a = b = c",
+	"a, b", "f(a, (b, c))", "a | b & c", "a << b + c", "a && b || c",
+	"a < b == c >= d", "fn(a, b) a + b", "(fn(x) x) + 1", "(fn(x) x)(1)",
+	"(fn(x) x) ? a : b", "f(fn(x) x, y)", "a ?: b ?: c", "a++ + ++b",
+	"a - -b", "- -1", "null", "f(null)", "0xFF + 1.5e-3", "1.50",
+	"a # comment\n+ b", `f("a\"b\\c\n", "")`,
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := map[string]string{
+		"a + b * c":         "(a + (b * c))",
+		"(fn(x) x) + 1":     "((fn(x) x) + 1)",
+		"(fn(x) x)(1)":      "(fn(x) x)(1)",
+		"f(a)(b) ? c : d!":  "(f(a)(b) ? c : (d!))",
+		"- -1":              "(-(-1))",
+		"0xff  +  1e3":      "(0xff + 1e3)",
+		"a,b":               "(a, b)",
+		"(fn(x) x) ? a : b": "((fn(x) x) ? a : b)",
+		"(fn(x) x)!":        "((fn(x) x)!)",
+		"(fn(x) x) ?: a":    "((fn(x) x) ?: a)",
+		"fn(x) fn(y) x":     "fn(x) fn(y) x",
+	}
+	for src, expected := range tests {
+		r, err := Canonicalize(src)
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+	}
+	if _, err := Canonicalize("a b"); err == nil {
+		t.Errorf("expected error")
+	}
+	for _, src := range canonicalSeeds {
+		checkCanonical(t, src)
+	}
+}
+
+func FuzzCanonicalize(f *testing.F) {
+	for _, src := range canonicalSeeds {
+		f.Add(src)
+	}
+	f.Fuzz(checkCanonical)
+}
+
+// checkCanonical checks that canonicalizing the canonical form of src
+// doesn't change it.
+func checkCanonical(t *testing.T, src string) {
+	c1, err := Canonicalize(src)
+	if err != nil {
+		return
+	}
+	c2, err := Canonicalize(c1)
+	if err != nil {
+		t.Fatalf("%q: error parsing canonical form %q: %v", src, c1, err)
+	}
+	if c1 != c2 {
+		t.Fatalf("%q: canonical form %q changed to %q", src, c1, c2)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"fmt"
+)
+
+// Differentiate returns the derivative of an arithmetic expression with
+// respect to the variable wrt. Names other than wrt are treated as
+// constants.
+//
+// The result is not simplified; pass it to Simplify to get a more readable
+// tree. Only numbers, names, unary "+" and "-" and the binary operators
+// "+", "-", "*", "/" and "^" are supported. A variable exponent produces a
+// call to "ln", the natural logarithm.
+func Differentiate(n Node, wrt string) (Node, error) {
+	switch n := n.(type) {
+	case *NumberNode:
+		return NewNumberNode(0), nil
+	case *NameNode:
+		if n.Name == wrt {
+			return NewNumberNode(1), nil
+		}
+		return NewNumberNode(0), nil
+	case *UnaryNode:
+		if n.Operator != TokenPlus && n.Operator != TokenMinus {
+			break
+		}
+		d, err := Differentiate(n.Right, wrt)
+		if err != nil {
+			return nil, err
+		}
+		return NewUnaryNode(n.Operator, d), nil
+	case *BinaryNode:
+		return differentiateBinary(n, wrt)
+	}
+	return nil, fmt.Errorf("cannot differentiate %s", n)
+}
+
+// differentiateBinary returns the derivative of a binary expression.
+func differentiateBinary(n *BinaryNode, wrt string) (Node, error) {
+	u, v := n.Left, n.Right
+	du, err := Differentiate(u, wrt)
+	if err != nil {
+		return nil, err
+	}
+	dv, err := Differentiate(v, wrt)
+	if err != nil {
+		return nil, err
+	}
+	switch n.Operator {
+	case TokenPlus, TokenMinus:
+		// (u ± v)' = u' ± v'
+		return NewBinaryNode(du, n.Operator, dv), nil
+	case TokenAsterisk:
+		// (u * v)' = u' * v + u * v'
+		return NewBinaryNode(
+			NewBinaryNode(du, TokenAsterisk, v),
+			TokenPlus,
+			NewBinaryNode(u, TokenAsterisk, dv)), nil
+	case TokenSlash:
+		// (u / v)' = (u' * v - u * v') / v ^ 2
+		return NewBinaryNode(
+			NewBinaryNode(
+				NewBinaryNode(du, TokenAsterisk, v),
+				TokenMinus,
+				NewBinaryNode(u, TokenAsterisk, dv)),
+			TokenSlash,
+			NewBinaryNode(v, TokenCaret, NewNumberNode(2))), nil
+	case TokenCaret:
+		if !hasName(v, wrt) {
+			// (u ^ c)' = c * u ^ (c - 1) * u'
+			return NewBinaryNode(
+				NewBinaryNode(v, TokenAsterisk,
+					NewBinaryNode(u, TokenCaret,
+						NewBinaryNode(v, TokenMinus, NewNumberNode(1)))),
+				TokenAsterisk,
+				du), nil
+		}
+		// (u ^ v)' = u ^ v * (v' * ln(u) + v * u' / u)
+		ln := NewListNode()
+		ln.Append(u)
+		return NewBinaryNode(
+			n,
+			TokenAsterisk,
+			NewBinaryNode(
+				NewBinaryNode(dv, TokenAsterisk,
+					NewFunctionNode(NewNameNode("ln"), ln)),
+				TokenPlus,
+				NewBinaryNode(NewBinaryNode(v, TokenAsterisk, du), TokenSlash, u))), nil
+	}
+	return nil, fmt.Errorf("cannot differentiate %s", n)
+}
+
+// hasName returns true if the expression references the given name.
+func hasName(n Node, name string) bool {
+	found := false
+	Walk(n, func(n Node) bool {
+		if v, ok := n.(*NameNode); ok && v.Name == name {
+			found = true
+		}
+		return !found
+	})
+	return found
+}
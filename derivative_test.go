@@ -0,0 +1,111 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"testing"
+)
+
+func TestDifferentiate(t *testing.T) {
+	type derivativeTest struct {
+		source string
+		result string
+	}
+
+	tests := []derivativeTest{
+		// Constants.
+		{"3", "0"},
+		{"a", "0"},
+		{"a * b", "0"},
+		// Basic rules.
+		{"x", "1"},
+		{"-x", "-1"},
+		{"x + a", "1"},
+		{"x * x", "(2 * x)"},
+		{"a * x", "a"},
+		{"x ^ 3", "(3 * (x ^ 2))"},
+		{"1 / x", "(-1 / (x ^ 2))"},
+		{"a ^ x", "((a ^ x) * ln(a))"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		d, err := Differentiate(n, "x")
+		if err != nil {
+			t.Errorf("%q: error differentiating: %v", test.source, err)
+			continue
+		}
+		if r := Simplify(d).String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	n, _ := newParser("f(x)").Parse()
+	if _, err := Differentiate(n, "x"); err == nil {
+		t.Errorf("expected error differentiating a function call")
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	type simplifyTest struct {
+		source string
+		result string
+	}
+
+	tests := []simplifyTest{
+		{"2 * 3 + 1", "7"},
+		{"a + 0", "a"},
+		{"0 + a", "a"},
+		{"a * 1", "a"},
+		{"a * 0", "0"},
+		{"a ^ 1", "a"},
+		{"a ^ 0", "1"},
+		{"a / 1", "a"},
+		{"a - a", "0"},
+		{"a + a", "(2 * a)"},
+		{"-(-a)", "a"},
+		{"f(1 + 1, a * 1)", "f(2, a)"},
+		{"a / 0", "(a / 0)"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := Simplify(n).String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	// Word operators and positions are kept.
+	words := []simplifyTest{
+		{"a and b", "(a and b)"},
+		{"not not a", "(not (not a))"},
+		{"(1 + 1) and not (a * 1)", "(2 and (not a))"},
+	}
+	for _, test := range words {
+		p := newParser(test.source)
+		p.InfixWords = map[string]InfixParser{"and": BinaryParser(PrecLogicalAnd)}
+		p.PrefixWords = map[string]PrefixParser{"not": UnaryParser(PrecPrefix)}
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		s := Simplify(n)
+		if r := s.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		if s.Position() != n.Position() {
+			t.Errorf("%q: expected position %v, got %v", test.source, n.Position(), s.Position())
+		}
+	}
+}
@@ -0,0 +1,386 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"fmt"
+	"math"
+)
+
+// NewEnv returns an empty environment.
+func NewEnv() *Env {
+	return &Env{
+		Vars:  make(map[string]float64),
+		Funcs: make(map[string]func([]float64) (float64, error)),
+	}
+}
+
+// Env holds the variables and functions available to Eval.
+type Env struct {
+	Vars  map[string]float64
+	Funcs map[string]func([]float64) (float64, error)
+	// MaxIterations is the number of times a while loop may run its body
+	// before Eval returns an error. Zero means DefaultMaxIterations and a
+	// negative value means no limit.
+	MaxIterations int
+}
+
+// DefaultMaxIterations is the loop limit of environments that don't set
+// MaxIterations.
+const DefaultMaxIterations = 1000000
+
+// Func registers a function that takes exactly arity arguments. Calling it
+// with a different number of arguments returns an error. Functions that
+// take any number of arguments can be added to Funcs directly.
+func (e *Env) Func(name string, arity int, fn func([]float64) (float64, error)) {
+	e.Funcs[name] = func(args []float64) (float64, error) {
+		if len(args) != arity {
+			return 0, fmt.Errorf("%s expects %d arguments, got %d", name, arity, len(args))
+		}
+		return fn(args)
+	}
+}
+
+// Eval evaluates an arithmetic expression using the given environment.
+//
+// Names are resolved as variables and calls like "f(a, b)" call the
+// function registered with the same name. Assignments like "a = b" set the
+// variable in the environment and return the assigned value. Supported
+// operators are "+", "-", "*", "/" and "^", the prefix "-", "+" and "!",
+// the bitwise "&", "|", "<<" and ">>", which truncate their operands to
+// integers, the logical "&&" and "||" and the comparisons "==", "!=", "<",
+// ">", "<=" and ">=". Logical operators treat zero as false; they and comparisons
+// return 0 or 1. The ternary "a ? b : c" evaluates b if a is not zero and c
+// otherwise, and the default operator "a ?: b" returns a unless it is zero,
+// and only then evaluates b. A block like "{a = 1; a + 1}" evaluates its
+// expressions in order and returns the last value, or 0 if it is empty.
+// "if (a) b else c" works like the ternary, returning 0 if a is zero and
+// there is no else branch, and "while (a) b" evaluates b while a is not
+// zero and returns its last value, or 0 if it never ran; it is an error if
+// it runs more than env.MaxIterations times. A program returned by
+// ParseProgram is evaluated like a block. The built-in "fold(list, init,
+// f)" calls f with the accumulated value and each element of a list like
+// "(1, 2, 3)" in turn, starting from init; f is a lambda with two
+// parameters, like "fn(acc, x) acc + x", or the name of a function.
+// Null has no numeric value, so evaluating it is an error, also as a
+// condition.
+func Eval(n Node, env *Env) (float64, error) {
+	switch n := n.(type) {
+	case *NumberNode:
+		return n.Value, nil
+	case *NullNode:
+		return 0, fmt.Errorf("null has no numeric value")
+	case *NameNode:
+		if v, ok := env.Vars[n.Name]; ok {
+			return v, nil
+		}
+		return 0, fmt.Errorf("undefined variable %q", n.Name)
+	case *AssignNode:
+		v, err := Eval(n.Right, env)
+		if err != nil {
+			return 0, err
+		}
+		env.Vars[n.Name] = v
+		return v, nil
+	case *UnaryNode:
+		return evalUnary(n, env)
+	case *BinaryNode:
+		return evalBinary(n, env)
+	case *TernaryNode:
+		return evalTernary(n, env)
+	case *ElvisNode:
+		v, err := Eval(n.Left, env)
+		if err != nil || v != 0 {
+			return v, err
+		}
+		return Eval(n.Right, env)
+	case *FunctionNode:
+		return evalFunction(n, env)
+	case *BlockNode:
+		var v float64
+		for _, e := range n.Exprs {
+			var err error
+			if v, err = Eval(e, env); err != nil {
+				return 0, err
+			}
+		}
+		return v, nil
+	case *IfNode:
+		return evalIf(n, env)
+	case *WhileNode:
+		return evalWhile(n, env)
+	case *ProgramNode:
+		var v float64
+		for _, s := range n.Stmts {
+			var err error
+			if v, err = Eval(s, env); err != nil {
+				return 0, err
+			}
+		}
+		return v, nil
+	case *ExprStmt:
+		return Eval(n.X, env)
+	}
+	return 0, fmt.Errorf("cannot evaluate %s", n)
+}
+
+// EvalProgram evaluates a list of statements in order and returns the value
+// of the last one. Assignments change the environment, so they are visible
+// to the following statements. An empty program evaluates to 0.
+func EvalProgram(list *ListNode, env *Env) (float64, error) {
+	var v float64
+	for _, n := range list.Nodes {
+		var err error
+		if v, err = Eval(n, env); err != nil {
+			return 0, err
+		}
+	}
+	return v, nil
+}
+
+// evalUnary evaluates a prefix unary expression.
+func evalUnary(n *UnaryNode, env *Env) (float64, error) {
+	v, err := Eval(n.Right, env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.Operator {
+	case TokenPlus:
+		return v, nil
+	case TokenMinus:
+		return -v, nil
+	case TokenExclamation:
+		return boolValue(v == 0), nil
+	}
+	return 0, fmt.Errorf("cannot evaluate operator %s", n.Operator)
+}
+
+// evalBinary evaluates a binary expression.
+func evalBinary(n *BinaryNode, env *Env) (float64, error) {
+	l, err := Eval(n.Left, env)
+	if err != nil {
+		return 0, err
+	}
+	// Logical operators only evaluate the right side when needed.
+	switch n.Operator {
+	case TokenAnd:
+		if l == 0 {
+			return 0, nil
+		}
+	case TokenOr:
+		if l != 0 {
+			return 1, nil
+		}
+	}
+	r, err := Eval(n.Right, env)
+	if err != nil {
+		return 0, err
+	}
+	switch n.Operator {
+	case TokenPlus:
+		return l + r, nil
+	case TokenMinus:
+		return l - r, nil
+	case TokenAsterisk:
+		return l * r, nil
+	case TokenSlash:
+		if r == 0 {
+			return 0, fmt.Errorf("division by zero in %s", n)
+		}
+		return l / r, nil
+	case TokenCaret:
+		return math.Pow(l, r), nil
+	case TokenAmpersand:
+		return float64(int64(l) & int64(r)), nil
+	case TokenPipe:
+		return float64(int64(l) | int64(r)), nil
+	case TokenShiftLeft, TokenShiftRight:
+		if r < 0 {
+			return 0, fmt.Errorf("negative shift count in %s", n)
+		}
+		if n.Operator == TokenShiftLeft {
+			return float64(int64(l) << uint64(r)), nil
+		}
+		return float64(int64(l) >> uint64(r)), nil
+	case TokenAnd, TokenOr:
+		return boolValue(r != 0), nil
+	case TokenEqual:
+		return boolValue(l == r), nil
+	case TokenNotEqual:
+		return boolValue(l != r), nil
+	case TokenLess:
+		return boolValue(l < r), nil
+	case TokenGreater:
+		return boolValue(l > r), nil
+	case TokenLessEq:
+		return boolValue(l <= r), nil
+	case TokenGreaterEq:
+		return boolValue(l >= r), nil
+	}
+	return 0, fmt.Errorf("cannot evaluate operator %s", n.Operator)
+}
+
+// evalTernary evaluates a ternary expression. Only the branch selected by
+// the condition is evaluated.
+func evalTernary(n *TernaryNode, env *Env) (float64, error) {
+	cond, err := Eval(n.Condition, env)
+	if err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		return EvalProgram(n.List, env)
+	}
+	return EvalProgram(n.ElseList, env)
+}
+
+// evalIf evaluates a conditional, with an optional else branch.
+func evalIf(n *IfNode, env *Env) (float64, error) {
+	cond, err := Eval(n.Cond, env)
+	if err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		return Eval(n.Then, env)
+	}
+	if n.Else == nil {
+		return 0, nil
+	}
+	return Eval(n.Else, env)
+}
+
+// evalWhile evaluates a loop.
+func evalWhile(n *WhileNode, env *Env) (float64, error) {
+	max := env.MaxIterations
+	if max == 0 {
+		max = DefaultMaxIterations
+	}
+	var v float64
+	for i := 0; ; i++ {
+		cond, err := Eval(n.Cond, env)
+		if err != nil || cond == 0 {
+			return v, err
+		}
+		if max > 0 && i == max {
+			return 0, fmt.Errorf("loop exceeded %d iterations in %s", max, n)
+		}
+		if v, err = Eval(n.Body, env); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// evalFunction evaluates a function call.
+func evalFunction(n *FunctionNode, env *Env) (float64, error) {
+	name, ok := n.Function.(*NameNode)
+	if !ok {
+		return 0, fmt.Errorf("cannot call %s", n.Function)
+	}
+	fn, ok := env.Funcs[name.Name]
+	if !ok {
+		if name.Name == "fold" {
+			return evalFold(n, env)
+		}
+		return 0, fmt.Errorf("undefined function %q", name.Name)
+	}
+	args := make([]float64, len(n.Args.Nodes))
+	for k, v := range n.Args.Nodes {
+		arg, err := Eval(v, env)
+		if err != nil {
+			return 0, err
+		}
+		args[k] = arg
+	}
+	return fn(args)
+}
+
+// evalFold evaluates the fold built-in. A function registered with the
+// same name takes precedence.
+func evalFold(n *FunctionNode, env *Env) (float64, error) {
+	if len(n.Args.Nodes) != 3 {
+		return 0, fmt.Errorf("fold expects 3 arguments, got %d", len(n.Args.Nodes))
+	}
+	fn, err := callable(n.Args.Nodes[2], 2, env)
+	if err != nil {
+		return 0, err
+	}
+	acc, err := Eval(n.Args.Nodes[1], env)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range listNodes(n.Args.Nodes[0]) {
+		v, err := Eval(e, env)
+		if err != nil {
+			return 0, err
+		}
+		if acc, err = fn([]float64{acc, v}); err != nil {
+			return 0, err
+		}
+	}
+	return acc, nil
+}
+
+// callable returns the function named by n, or a function that calls n if
+// it is a lambda taking the given number of arguments.
+func callable(n Node, arity int, env *Env) (func([]float64) (float64, error), error) {
+	switch n := n.(type) {
+	case *NameNode:
+		if fn, ok := env.Funcs[n.Name]; ok {
+			return fn, nil
+		}
+		return nil, fmt.Errorf("undefined function %q", n.Name)
+	case *LambdaNode:
+		if len(n.Params) != arity {
+			return nil, fmt.Errorf("cannot call %s with %d arguments", n, arity)
+		}
+		return func(args []float64) (float64, error) {
+			return callLambda(n, args, env)
+		}, nil
+	}
+	return nil, fmt.Errorf("cannot call %s", n)
+}
+
+// callLambda evaluates the body of a lambda with its parameters set to the
+// given arguments. Variables shadowed by the parameters are restored
+// afterwards.
+func callLambda(n *LambdaNode, args []float64, env *Env) (float64, error) {
+	type shadowed struct {
+		value float64
+		ok    bool
+	}
+	saved := make([]shadowed, len(n.Params))
+	for k, param := range n.Params {
+		v, ok := env.Vars[param]
+		saved[k] = shadowed{v, ok}
+		env.Vars[param] = args[k]
+	}
+	defer func() {
+		// In reverse, so that repeated parameters restore the first value.
+		for k := len(n.Params) - 1; k >= 0; k-- {
+			if saved[k].ok {
+				env.Vars[n.Params[k]] = saved[k].value
+			} else {
+				delete(env.Vars, n.Params[k])
+			}
+		}
+	}()
+	return Eval(n.Body, env)
+}
+
+// listNodes returns the elements of a comma-separated list, or n itself if
+// it is not a list.
+func listNodes(n Node) []Node {
+	if s, ok := n.(*SequenceNode); ok {
+		return append(listNodes(s.First), listNodes(s.Second)...)
+	}
+	return []Node{n}
+}
+
+// boolValue returns 1 for true and 0 for false.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
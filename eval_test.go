@@ -0,0 +1,231 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"math"
+	"testing"
+)
+
+// testEnv returns an environment with a few variables and functions.
+func testEnv() *Env {
+	env := NewEnv()
+	env.Vars["a"] = 2
+	env.Vars["b"] = 5
+	env.Funcs["max"] = func(args []float64) (float64, error) {
+		v := math.Inf(-1)
+		for _, arg := range args {
+			v = math.Max(v, arg)
+		}
+		return v, nil
+	}
+	env.Func("abs", 1, func(args []float64) (float64, error) {
+		return math.Abs(args[0]), nil
+	})
+	return env
+}
+
+func TestEval(t *testing.T) {
+	type evalTest struct {
+		source string
+		result float64
+	}
+
+	tests := []evalTest{
+		{"1 + 2 * 3", 7},
+		{"2 ^ 3 ^ 2", 512},
+		{"-a + b", 3},
+		{"b / a", 2.5},
+		{"!a", 0},
+		{"a && 0 || b", 1},
+		{"a < b", 1},
+		{"a >= b", 0},
+		{"a + 3 == b", 1},
+		// Bitwise operators truncate to integers.
+		{"6 & 3", 2},
+		{"a | b & 4", 6},
+		{"1 << a + 1", 8},
+		{"-b >> 1", -3},
+		{"5.9 & 7", 5},
+		{"a != 2", 0},
+		{"abs(a - b)", 3},
+		{"max(a, abs(-b))", 5},
+		{"max(a, b, 7)", 7},
+		// The right side is not evaluated.
+		{"0 && c", 0},
+		{"1 || c", 1},
+		{"a ?: c", 2},
+		{"0 ?: b", 5},
+		// Only the selected branch is evaluated.
+		{"1 ? a : c", 2},
+		{"0 ? c : b", 5},
+		{"a > b ? c : a < b ? b : c", 5},
+		{"a ? b : (c = 1)", 5},
+		// Blocks evaluate to their last expression.
+		{"{c = a + 1; c * b}", 15},
+		{"{} + 1", 1},
+		{"if (a > b) a else b", 5},
+		{"if (0) a", 0},
+		{"{c = 0; while (c < 10) c = c + a}", 10},
+		{"while (0) a", 0},
+		// Folds call a lambda or a function for each element.
+		{"fold((1, 2, 3), 0, fn(acc, x) acc + x)", 6},
+		{"fold((1, 2, 3, 4), 1, fn(acc, x) acc * x)", 24},
+		{"fold((a, 9, b), 0, max)", 9},
+		{"fold(b, a, fn(acc, x) acc - x)", -3},
+		// Parameters don't change variables with the same name.
+		{"fold((1, 2), 0, fn(a, x) a + x) + a", 5},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		r, err := Eval(n, testEnv())
+		if err != nil {
+			t.Errorf("%q: error evaluating: %v", test.source, err)
+			continue
+		}
+		if r != test.result {
+			t.Errorf("%q: expected %v, got %v", test.source, test.result, r)
+		}
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	type evalErrorTest struct {
+		source string
+		err    string
+	}
+
+	tests := []evalErrorTest{
+		{"c + 1", `undefined variable "c"`},
+		{"min(a, b)", `undefined function "min"`},
+		{"abs(a, b)", "abs expects 1 arguments, got 2"},
+		{"abs()", "abs expects 1 arguments, got 0"},
+		{"a(b)(c)", "cannot call a(b)"},
+		{"a / 0", "division by zero in (a / 0)"},
+		{"1 << -a", "negative shift count in (1 << (-a))"},
+		{"fn(x) x", "cannot evaluate fn(x) x"},
+		{"a == null", "null has no numeric value"},
+		{"null ? a : b", "null has no numeric value"},
+		{"(fn(x) x) ? a : b", "cannot evaluate fn(x) x"},
+		{"0 ? a : c", `undefined variable "c"`},
+		{"while (1) a", "loop exceeded 1000000 iterations in (while (1) a)"},
+		{"fold((1, 2), 0)", "fold expects 3 arguments, got 2"},
+		{"fold((1, 2), 0, fn(x) x)", "cannot call fn(x) x with 2 arguments"},
+		{"fold((1, 2), 0, min)", `undefined function "min"`},
+		{"fold((1, c), 0, max)", `undefined variable "c"`},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		_, err = Eval(n, testEnv())
+		if err == nil {
+			t.Errorf("%q: expected error", test.source)
+			continue
+		}
+		if err.Error() != test.err {
+			t.Errorf("%q: expected error %q, got %q", test.source, test.err, err)
+		}
+	}
+
+	// The loop limit can be set in the environment.
+	for max, ok := range map[int]bool{3: true, 2: false, -1: true} {
+		n, err := newParser("{c = 0; while (c < 3) c = c + 1}").Parse()
+		if err != nil {
+			t.Fatalf("error parsing: %v", err)
+		}
+		env := testEnv()
+		env.MaxIterations = max
+		if _, err := Eval(n, env); (err == nil) != ok {
+			t.Errorf("MaxIterations %d: unexpected result %v", max, err)
+		}
+	}
+}
+
+func TestEvalProgram(t *testing.T) {
+	type programTest struct {
+		source string
+		result float64
+	}
+
+	tests := []programTest{
+		{"", 0},
+		{"a = 2; b = a * 3; a + b", 8},
+		{"a = b = 3; a * b", 9},
+		{"x = 1; x = x + 1; x = x * 10;", 20},
+	}
+
+	for _, test := range tests {
+		list := NewListNode()
+		err := newParser(test.source).ParseAll(func(n Node) bool {
+			list.Append(n)
+			return true
+		})
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		r, err := EvalProgram(list, NewEnv())
+		if err != nil {
+			t.Errorf("%q: error evaluating: %v", test.source, err)
+			continue
+		}
+		if r != test.result {
+			t.Errorf("%q: expected %v, got %v", test.source, test.result, r)
+		}
+	}
+
+	env := NewEnv()
+	list := NewListNode()
+	newParser("a = 1; b + 1; c = 2").ParseAll(func(n Node) bool {
+		list.Append(n)
+		return true
+	})
+	if _, err := EvalProgram(list, env); err == nil {
+		t.Errorf("expected error for undefined variable")
+	}
+	if _, ok := env.Vars["c"]; ok {
+		t.Errorf("statements after an error must not be evaluated")
+	}
+
+	// Programs returned by ParseProgram are evaluated by Eval.
+	for _, test := range tests {
+		prog, err := newParser(test.source).ParseProgram()
+		if err != nil {
+			t.Errorf("%q: error parsing program: %v", test.source, err)
+			continue
+		}
+		r, err := Eval(prog, NewEnv())
+		if err != nil {
+			t.Errorf("%q: error evaluating program: %v", test.source, err)
+			continue
+		}
+		if r != test.result {
+			t.Errorf("%q: expected %v, got %v", test.source, test.result, r)
+		}
+	}
+}
+
+func TestEvalTernarySideEffects(t *testing.T) {
+	env := testEnv()
+	n, err := newParser("a ? (x = 1) : (y = 2)").Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if r, err := Eval(n, env); err != nil || r != 1 {
+		t.Fatalf("expected 1, got %v (%v)", r, err)
+	}
+	if _, ok := env.Vars["y"]; ok || env.Vars["x"] != 1 {
+		t.Errorf("expected only x to be assigned, got %v", env.Vars)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam_test
+
+import (
+	"testing"
+
+	"github.com/moraes/bantam"
+)
+
+// rangeParser parses "a ~ b" as a call to "range(a, b)", using only the
+// exported API as a parser from another package would.
+type rangeParser int
+
+func (p rangeParser) Parse(parser *bantam.Parser, left bantam.Node, token bantam.Token) bantam.Node {
+	args := bantam.NewListNode()
+	args.Append(left)
+	args.Append(parser.ParseExpression(int(p)))
+	return bantam.NewFunctionNode(bantam.NewNameNode("range"), args)
+}
+
+func (p rangeParser) Precedence() int {
+	return int(p)
+}
+
+func TestExternalParser(t *testing.T) {
+	tests := map[string]string{
+		"a ~ b":         "range(a, b)",
+		"a ~ b + c":     "range(a, (b + c))",
+		"a ~ b ~ c":     "range(range(a, b), c)",
+		"a = b ~ c * d": "(a = range(b, (c * d)))",
+	}
+
+	for src, expected := range tests {
+		p := bantam.NewParser(bantam.NewStack(bantam.NewStringLexer(src)))
+		for k, v := range bantam.PrefixParsers {
+			p.PrefixParsers[k] = v
+		}
+		for k, v := range bantam.InfixParsers {
+			p.InfixParsers[k] = v
+		}
+		p.InfixParsers[bantam.TokenTilde] = rangeParser(bantam.PrecShift)
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if r := n.String(); r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Formatter renders expressions like Node.String does, but allows to
+// replace the symbols used for operators. For example, a Python-like output
+// can render "^" as "**":
+//
+//	f := &Formatter{Symbols: map[TokenType]string{TokenCaret: "**"}}
+//	f.Format(n) // "(a ** b)" for "a ^ b"
+//
+// Operators without a symbol in the table use the token type name. Word
+// operators, like "and", are rendered with their own text.
+type Formatter struct {
+	Symbols map[TokenType]string
+}
+
+// Format returns the string representation of the given node.
+func (f *Formatter) Format(n Node) string {
+	b := new(bytes.Buffer)
+	f.write(b, n)
+	return b.String()
+}
+
+// symbol returns the text used to render an operator.
+func (f *Formatter) symbol(t TokenType, word string) string {
+	if word != "" {
+		return word
+	}
+	if s, ok := f.Symbols[t]; ok {
+		return s
+	}
+	return t.String()
+}
+
+// write writes the representation of the given node to b.
+func (f *Formatter) write(b *bytes.Buffer, n Node) {
+	switch n := n.(type) {
+	case *AssignNode:
+		fmt.Fprintf(b, "(%s %s ", n.Name, f.symbol(TokenAssignment, ""))
+		f.write(b, n.Right)
+		b.WriteString(")")
+	case *BinaryNode:
+		b.WriteString("(")
+		f.write(b, n.Left)
+		fmt.Fprintf(b, " %s ", f.symbol(n.Operator, n.Word))
+		f.write(b, n.Right)
+		b.WriteString(")")
+	case *BlockNode:
+		b.WriteString(f.symbol(TokenBraceL, ""))
+		for k, v := range n.Exprs {
+			if k > 0 {
+				fmt.Fprintf(b, "%s ", f.symbol(TokenSemicolon, ""))
+			}
+			f.write(b, v)
+		}
+		b.WriteString(f.symbol(TokenBraceR, ""))
+	case *BracketNode:
+		b.WriteString(f.symbol(n.Open, ""))
+		f.write(b, n.Inner)
+		b.WriteString(f.symbol(n.Close, ""))
+	case *ElvisNode:
+		b.WriteString("(")
+		f.write(b, n.Left)
+		fmt.Fprintf(b, " %s ", f.symbol(TokenElvis, ""))
+		f.write(b, n.Right)
+		b.WriteString(")")
+	case *ExprStmt:
+		f.write(b, n.X)
+	case *FunctionNode:
+		f.write(b, n.Function)
+		b.WriteString("(")
+		for k, v := range n.Args.Nodes {
+			if k > 0 {
+				b.WriteString(", ")
+			}
+			f.write(b, v)
+		}
+		b.WriteString(")")
+	case *IfNode:
+		fmt.Fprintf(b, "(%s (", f.symbol(TokenIf, ""))
+		f.write(b, n.Cond)
+		b.WriteString(") ")
+		f.write(b, n.Then)
+		if n.Else != nil {
+			fmt.Fprintf(b, " %s ", f.symbol(TokenElse, ""))
+			f.write(b, n.Else)
+		}
+		b.WriteString(")")
+	case *InterpolationNode:
+		b.WriteByte('"')
+		for k, v := range n.Exprs {
+			writeStringPart(b, n.Parts[k], true)
+			b.WriteString("${")
+			f.write(b, v)
+			b.WriteString("}")
+		}
+		writeStringPart(b, n.Parts[len(n.Parts)-1], true)
+		b.WriteByte('"')
+	case *LambdaNode:
+		fmt.Fprintf(b, "%s(%s) ", f.symbol(TokenFn, ""), strings.Join(n.Params, ", "))
+		f.write(b, n.Body)
+	case *ListNode:
+		for _, v := range n.Nodes {
+			f.write(b, v)
+		}
+	case *MixfixNode:
+		b.WriteString("(")
+		first := true
+		n.each(func(op Token, operand Node) {
+			if !first {
+				b.WriteString(" ")
+			}
+			first = false
+			if operand != nil {
+				f.write(b, operand)
+			} else {
+				b.WriteString(f.symbol(op.Type, word(op)))
+			}
+		})
+		b.WriteString(")")
+	case *ProgramNode:
+		for k, v := range n.Stmts {
+			if k > 0 {
+				fmt.Fprintf(b, "%s ", f.symbol(TokenSemicolon, ""))
+			}
+			f.write(b, v)
+		}
+	case *SequenceNode:
+		b.WriteString("(")
+		f.write(b, n.First)
+		fmt.Fprintf(b, "%s ", f.symbol(TokenComma, ""))
+		f.write(b, n.Second)
+		b.WriteString(")")
+	case *TernaryNode:
+		b.WriteString("(")
+		f.write(b, n.Condition)
+		fmt.Fprintf(b, " %s ", f.symbol(TokenQuestion, ""))
+		f.write(b, n.List)
+		fmt.Fprintf(b, " %s ", f.symbol(TokenColon, ""))
+		f.write(b, n.ElseList)
+		b.WriteString(")")
+	case *UnaryNode:
+		if n.Word != "" {
+			fmt.Fprintf(b, "(%s ", n.Word)
+		} else {
+			fmt.Fprintf(b, "(%s", f.symbol(n.Operator, ""))
+		}
+		f.write(b, n.Right)
+		b.WriteString(")")
+	case *UnaryPostfixNode:
+		b.WriteString("(")
+		f.write(b, n.Left)
+		if n.Word != "" {
+			fmt.Fprintf(b, " %s)", n.Word)
+		} else {
+			fmt.Fprintf(b, "%s)", f.symbol(n.Operator, ""))
+		}
+	case *WhileNode:
+		fmt.Fprintf(b, "(%s (", f.symbol(TokenWhile, ""))
+		f.write(b, n.Cond)
+		b.WriteString(") ")
+		f.write(b, n.Body)
+		b.WriteString(")")
+	default:
+		b.WriteString(n.String())
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"testing"
+)
+
+func TestFormatter(t *testing.T) {
+	python := &Formatter{Symbols: map[TokenType]string{
+		TokenCaret: "**",
+		TokenAnd:   "and",
+		TokenFn:    "lambda",
+	}}
+	tests := []struct {
+		source string
+		result string
+	}{
+		{"a ^ b", "(a ** b)"},
+		{"a ^ b ^ c", "(a ** (b ** c))"},
+		{"f(a ^ 2, b) && c", "(f((a ** 2), b) and c)"},
+		{"-a ^ 2", "((-a) ** 2)"},
+		{"a!", "(a!)"},
+		{"fn(x, y) x ^ y", "lambda(x, y) (x ** y)"},
+		{"x = a ? b ^ 2 : c", "(x = (a ? (b ** 2) : c))"},
+		{"a ?: b, null", "((a ?: b), null)"},
+		{"{a ^ b; c}", "{(a ** b); c}"},
+		{"if (a) b ^ 2 else while (c) d", "(if (a) (b ** 2) else (while (c) d))"},
+	}
+
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := python.Format(n); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+		// Without symbols it matches String.
+		if r := new(Formatter).Format(n); r != n.String() {
+			t.Errorf("%q: expected %q, got %q", test.source, n.String(), r)
+		}
+	}
+}
+
+func TestFormatterProgram(t *testing.T) {
+	prog, err := newParser("a ^ b; f(c)").ParseProgram()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	f := &Formatter{Symbols: map[TokenType]string{TokenCaret: "**"}}
+	if r := f.Format(prog); r != "(a ** b); f(c)" {
+		t.Errorf("expected %q, got %q", "(a ** b); f(c)", r)
+	}
+	if r := new(Formatter).Format(prog); r != prog.String() {
+		t.Errorf("expected %q, got %q", prog.String(), r)
+	}
+}
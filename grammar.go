@@ -0,0 +1,118 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+// Grammar builds the parser maps of an expression language with chainable
+// calls that declare each operator and its precedence, instead of filling
+// the maps with parselets by hand:
+//
+//	g := NewGrammar().
+//		Prefix(TokenMinus, 6).
+//		InfixLeft(TokenPlus, 3).
+//		InfixRight(TokenCaret, 5).
+//		Ternary(TokenQuestion, TokenColon, 2)
+//	p := g.Parser(NewStack(NewLexer("-a + b ^ c")))
+//
+// A new grammar knows only names, numbers, strings and grouping with
+// parentheses. Each call replaces any parser registered before for the
+// same token.
+type Grammar struct {
+	prefix map[TokenType]PrefixParser
+	infix  map[TokenType]InfixParser
+}
+
+// NewGrammar returns a grammar for names, numbers, strings and parentheses.
+func NewGrammar() *Grammar {
+	return &Grammar{
+		prefix: map[TokenType]PrefixParser{
+			TokenName:   NameParser(0),
+			TokenNumber: NumberParser(0),
+			TokenString: StringParser(0),
+			TokenParenL: GroupParser(0),
+		},
+		infix: map[TokenType]InfixParser{},
+	}
+}
+
+// Prefix adds a unary prefix operator, like "-a". Its operand binds the
+// operators with a precedence higher than prec.
+func (g *Grammar) Prefix(t TokenType, prec int) *Grammar {
+	g.prefix[t] = UnaryParser(prec)
+	return g
+}
+
+// Postfix adds a unary postfix operator, like "a!".
+func (g *Grammar) Postfix(t TokenType, prec int) *Grammar {
+	g.infix[t] = UnaryPostfixParser(prec)
+	return g
+}
+
+// Infix adds a binary operator with the given associativity.
+func (g *Grammar) Infix(t TokenType, prec int, assoc Assoc) *Grammar {
+	g.infix[t] = OperatorParser{prec, assoc}
+	return g
+}
+
+// InfixLeft adds a left-associative binary operator, like "a + b".
+func (g *Grammar) InfixLeft(t TokenType, prec int) *Grammar {
+	return g.Infix(t, prec, AssocLeft)
+}
+
+// InfixRight adds a right-associative binary operator, like "a ^ b".
+func (g *Grammar) InfixRight(t TokenType, prec int) *Grammar {
+	return g.Infix(t, prec, AssocRight)
+}
+
+// Ternary adds a conditional operator, like "a ? b : c", where t starts
+// the operator and sep separates the branches.
+func (g *Grammar) Ternary(t, sep TokenType, prec int) *Grammar {
+	if sep == TokenColon {
+		g.infix[t] = TernaryParser(prec)
+	} else {
+		g.infix[t] = ternaryParser{prec, sep}
+	}
+	return g
+}
+
+// Call adds function calls, like "f(a, b)".
+func (g *Grammar) Call(prec int) *Grammar {
+	g.infix[TokenParenL] = FunctionParser(prec)
+	return g
+}
+
+// Bracket adds an expression enclosed by a pair of tokens, like "|a|".
+// See BracketParser.
+func (g *Grammar) Bracket(open, close TokenType) *Grammar {
+	g.prefix[open] = BracketParser{Open: open, Close: close}
+	return g
+}
+
+// PrefixParser registers a custom prefix parser, for constructs the other
+// methods don't cover.
+func (g *Grammar) PrefixParser(t TokenType, p PrefixParser) *Grammar {
+	g.prefix[t] = p
+	return g
+}
+
+// InfixParser registers a custom infix parser, for constructs the other
+// methods don't cover.
+func (g *Grammar) InfixParser(t TokenType, p InfixParser) *Grammar {
+	g.infix[t] = p
+	return g
+}
+
+// Parser returns a parser for the grammar that reads from the given stack.
+// The parser has its own copies of the maps, so the grammar can still be
+// changed or used to build other parsers.
+func (g *Grammar) Parser(stack *Stack) *Parser {
+	p := NewParser(stack)
+	for k, v := range g.prefix {
+		p.PrefixParsers[k] = v
+	}
+	for k, v := range g.infix {
+		p.InfixParsers[k] = v
+	}
+	return p
+}
@@ -0,0 +1,78 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"testing"
+)
+
+func TestGrammar(t *testing.T) {
+	g := NewGrammar().
+		Prefix(TokenMinus, 6).
+		InfixLeft(TokenPlus, 3).
+		InfixLeft(TokenMinus, 3).
+		InfixRight(TokenCaret, 5).
+		Postfix(TokenExclamation, 7).
+		Ternary(TokenQuestion, TokenColon, 2).
+		Call(8).
+		Bracket(TokenPipe, TokenPipe)
+	tests := []struct {
+		source string
+		result string
+	}{
+		{"-a + b ^ c ^ d", "((-a) + (b ^ (c ^ d)))"},
+		{"a - b - c", "((a - b) - c)"},
+		{"a ? b : c ? d : e", "(a ? b : (c ? d : e))"},
+		{"f(a, -b)!", "(f(a, (-b))!)"},
+		{`|a - "b"| + (1 + 2)`, `(|(a - "b")| + (1 + 2))`},
+	}
+	for _, test := range tests {
+		n, err := g.Parser(NewStack(NewLexer(test.source))).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := n.String(); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	// Operators that were not declared are errors.
+	for _, src := range []string{"a * b", "a = b", "null"} {
+		if _, err := g.Parser(NewStack(NewLexer(src))).Parse(); err == nil {
+			t.Errorf("%q: expected error", src)
+		}
+	}
+}
+
+func TestGrammarTernarySeparator(t *testing.T) {
+	g := NewGrammar().
+		InfixLeft(TokenPlus, 3).
+		Ternary(TokenQuestion, TokenPipe, 2)
+	n, err := g.Parser(NewStack(NewLexer("a ? b + 1 | c"))).Parse()
+	if err != nil || n.String() != "(a ? (b + 1) : c)" {
+		t.Errorf("expected (a ? (b + 1) : c), got %v (%v)", n, err)
+	}
+	if _, err := g.Parser(NewStack(NewLexer("a ? b : c"))).Parse(); err == nil {
+		t.Errorf("expected error for the default separator")
+	}
+}
+
+func TestGrammarParserMaps(t *testing.T) {
+	g := NewGrammar().InfixLeft(TokenPlus, 3)
+	p := g.Parser(NewStack(NewLexer("a * b")))
+	g.InfixLeft(TokenAsterisk, 4)
+	if _, err := p.Parse(); err == nil {
+		t.Errorf("expected parser to keep its own maps")
+	}
+	p = g.Parser(NewStack(NewLexer("a * b")))
+	p.RegisterInfix(TokenSlash, BinaryParser(4))
+	if _, ok := g.infix[TokenSlash]; ok {
+		t.Errorf("expected grammar to be unchanged by the parser")
+	}
+	if n, err := p.Parse(); err != nil || n.String() != "(a * b)" {
+		t.Errorf("expected (a * b), got %v (%v)", n, err)
+	}
+}
@@ -5,84 +5,1286 @@
 package bantam
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/scanner"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Lexer defines an interface for lexical scanners.
 //
-// We don't have a real lexer implementation in this package, only a dummy one
-// in the tests.
+// Once the input is exhausted Next must return a TokenEOF token. Invalid
+// input is reported by returning a TokenError token holding the message.
 type Lexer interface {
 	Next() Token
 }
 
+// ----------------------------------------------------------------------------
+
+// operators maps operator and punctuation symbols to token types.
+//
+// The lexer always reads the longest symbol in this table that matches the
+// input, so "<=" is never read as "<" "=" and "++" is never read as "+" "+".
+// A shorter symbol is only produced when the longer one doesn't apply, like
+// in "a < b" or "a + +b".
+var operators = map[string]TokenType{
+	"*":  TokenAsterisk,
+	"/":  TokenSlash,
+	"+":  TokenPlus,
+	"-":  TokenMinus,
+	"^":  TokenCaret,
+	"~":  TokenTilde,
+	"=":  TokenAssignment,
+	"?":  TokenQuestion,
+	"!":  TokenExclamation,
+	"(":  TokenParenL,
+	")":  TokenParenR,
+	":":  TokenColon,
+	",":  TokenComma,
+	";":  TokenSemicolon,
+	"&":  TokenAmpersand,
+	"|":  TokenPipe,
+	"<":  TokenLess,
+	">":  TokenGreater,
+	"<<": TokenShiftLeft,
+	">>": TokenShiftRight,
+	"&&": TokenAnd,
+	"||": TokenOr,
+	"<=": TokenLessEq,
+	">=": TokenGreaterEq,
+	"==": TokenEqual,
+	"!=": TokenNotEqual,
+	"++": TokenIncrement,
+	"--": TokenDecrement,
+	"?:": TokenElvis,
+	"+=": TokenPlusAssign,
+	"-=": TokenMinusAssign,
+	"*=": TokenMulAssign,
+	"/=": TokenDivAssign,
+	"**": TokenPower,
+	"{":  TokenBraceL,
+	"}":  TokenBraceR,
+}
+
+// keywords maps reserved words to token types.
+var keywords = map[string]TokenType{
+	"fn":    TokenFn,
+	"null":  TokenNull,
+	"if":    TokenIf,
+	"else":  TokenElse,
+	"while": TokenWhile,
+}
+
+// syntax holds the tables that drive a StringLexer.
+type syntax struct {
+	symbols      map[string]TokenType
+	maxSymbolLen int // Length of the longest symbol.
+	keywords     map[string]TokenType
+	nameStart    func(rune) bool
+	namePart     func(rune) bool
+	numbers      NumberFormat
+	strings      bool
+	lineComments []string
+	blockComment [2]string // Start and end, or empty.
+	patterns     *patternMatcher
+}
+
+// bantamSyntax is the syntax of the Bantam language.
+var bantamSyntax = &syntax{
+	symbols:      operators,
+	maxSymbolLen: maxLen(operators),
+	keywords:     keywords,
+	nameStart:    isLetter,
+	namePart:     isNamePart,
+	numbers:      NumberFraction | NumberExponent | NumberHex,
+	strings:      true,
+	lineComments: []string{"#", "//"},
+	blockComment: [2]string{"/*", "*/"},
+}
+
+// maxLen returns the length of the longest key in m.
+func maxLen(m map[string]TokenType) int {
+	max := 0
+	for k := range m {
+		if len(k) > max {
+			max = len(k)
+		}
+	}
+	return max
+}
+
+// NewLexer returns the built-in lexer for the Bantam language, reading from
+// the given source. It is a StringLexer; see it for the syntax.
+func NewLexer(src string) Lexer {
+	return NewStringLexer(src)
+}
+
+// Tokenize runs the built-in lexer on src and returns all its tokens,
+// ending with the TokenEOF. If the source is invalid it stops at the first
+// TokenError and returns the tokens before it and a *ParseError with the
+// message and position of the error.
+func Tokenize(src string) ([]Token, error) {
+	l := NewLexer(src)
+	var tokens []Token
+	for {
+		t := l.Next()
+		switch t.Type {
+		case TokenError:
+			return tokens, lexError(t)
+		case TokenEOF:
+			return append(tokens, t), nil
+		}
+		tokens = append(tokens, t)
+	}
+}
+
+// NewStringLexer returns a lexer for the given source.
+func NewStringLexer(src string) *StringLexer {
+	return &StringLexer{syntax: bantamSyntax, src: src}
+}
+
+// StringLexer is a lexer for the Bantam language that reads from a string.
+//
+// Names start with a Unicode letter or underscore, followed by letters,
+// digits or underscores, like "x1" or "número". Names that are keywords,
+// like "fn", get their own token type; more can be added with
+// RegisterKeyword. Numbers are a sequence of digits with an optional
+// fraction and exponent, like "42", "1.5" or "1.5e-3", or hexadecimal
+// integers like "0xFF". Strings are enclosed in double quotes, like "abc",
+// and may contain the escape sequences \n, \t, \" and \\. Whitespace and
+// comments between tokens are skipped. Line comments start with "#" or
+// "//" and run until the end of the line; block comments start with "/*",
+// end with "*/" and may span lines.
+type StringLexer struct {
+	// SignificantNewlines makes the lexer return a TokenNewline for each
+	// line break instead of skipping it, so that newlines can end
+	// statements in ParseAll.
+	SignificantNewlines bool
+	// KeepComments makes the lexer return a TokenComment for each comment
+	// instead of skipping it. The Stack sets them aside, so they don't
+	// reach the parsers; see Parser.AttachComments.
+	KeepComments bool
+	// Interpolation makes "${" start an expression inside a string, which
+	// ends at the matching "}", like in "a ${b + c} d". An interpolated
+	// string is lexed as a TokenInterpStart, the tokens of each expression
+	// separated by TokenInterpMid, and a TokenInterpEnd. A literal "${" is
+	// written as "\${".
+	Interpolation bool
+	// FoldKeywords makes keywords match regardless of case, so that "AND",
+	// "And" and "and" get the same token type, like in SQL. The token text
+	// keeps the case of the source.
+	FoldKeywords bool
+	// Indentation makes the lexer return a TokenIndent when a line is more
+	// indented than the previous one, and a TokenDedent for each level it
+	// closes when a line is less indented, like in Python. Levels still open
+	// at the end are closed before EOF. Blank lines and lines with only a
+	// comment don't count, and each space or tab counts as one column. It
+	// is usually combined with SignificantNewlines.
+	Indentation   bool
+	indents       []int   // Widths of the open indentation levels.
+	indentChecked bool    // Whether the current line indentation was checked.
+	pending       []Token // Tokens to return before lexing more.
+	partial       bool    // More source follows, so levels are not closed at the end.
+	interp        []int   // Open braces in each nested interpolation.
+	syntax        *syntax
+	keywords      map[string]TokenType // Nil to use the syntax keywords.
+	folded        map[string]TokenType // Lower case keywords, for FoldKeywords.
+	src           string
+	pos           int
+	line          int // Number of newlines before pos.
+	lineStart     int // Offset where the current line starts.
+}
+
+// Next returns the next token from the source.
+func (l *StringLexer) Next() Token {
+	if len(l.pending) > 0 {
+		t := l.pending[0]
+		l.pending = l.pending[1:]
+		return t
+	}
+	for l.pos < len(l.src) {
+		if l.Indentation && !l.indentChecked {
+			if t, ok := l.indent(); ok {
+				return t
+			}
+		}
+		c := l.src[l.pos]
+		switch {
+		case c == '\n':
+			pos := l.position(l.pos)
+			l.pos++
+			l.line++
+			l.lineStart = l.pos
+			l.indentChecked = false
+			if l.SignificantNewlines {
+				return Token{Type: TokenNewline, Text: "\n", Pos: pos}
+			}
+		case isSpace(c):
+			l.pos++
+		case c == '}' && len(l.interp) > 0 && l.interp[len(l.interp)-1] == 0:
+			l.interp = l.interp[:len(l.interp)-1]
+			return l.lexStringPart(TokenInterpMid, TokenInterpEnd)
+		case l.isLineComment(l.pos):
+			if t := l.lexLineComment(); l.KeepComments {
+				return t
+			}
+		case l.syntax.blockComment[0] != "" && strings.HasPrefix(l.src[l.pos:], l.syntax.blockComment[0]):
+			if t := l.lexBlockComment(); l.KeepComments || t.Type == TokenError {
+				return t
+			}
+		default:
+			if l.syntax.patterns != nil {
+				return l.lexPattern()
+			}
+			return l.lexToken()
+		}
+	}
+	if n := len(l.indents); n > 0 && !l.partial {
+		l.indents = l.indents[:n-1]
+		return Token{Type: TokenDedent, Pos: l.position(l.pos)}
+	}
+	return Token{Type: TokenEOF, Pos: l.position(l.pos)}
+}
+
+// LexerMark is a position in the source of a StringLexer, saved by Mark to
+// be restored by Reset.
+type LexerMark struct {
+	pos, line, lineStart int
+	indents              []int
+	indentChecked        bool
+	pending              []Token
+	interp               []int
+}
+
+// Mark returns the current state of the lexer, so that speculative lexing,
+// like reading ahead to decide whether "(" starts a parameter list or a
+// group, can rewind with Reset. Tokens read by a Stack from the lexer are
+// not rewound; a Stack reading from the lexer keeps them buffered.
+func (l *StringLexer) Mark() LexerMark {
+	return LexerMark{
+		pos:           l.pos,
+		line:          l.line,
+		lineStart:     l.lineStart,
+		indents:       append([]int(nil), l.indents...),
+		indentChecked: l.indentChecked,
+		pending:       append([]Token(nil), l.pending...),
+		interp:        append([]int(nil), l.interp...),
+	}
+}
+
+// Reset rewinds the lexer to a state returned by Mark, so that the tokens
+// read since then are read again.
+func (l *StringLexer) Reset(m LexerMark) {
+	l.pos = m.pos
+	l.line = m.line
+	l.lineStart = m.lineStart
+	l.indents = append(l.indents[:0], m.indents...)
+	l.indentChecked = m.indentChecked
+	l.pending = append(l.pending[:0], m.pending...)
+	l.interp = append(l.interp[:0], m.interp...)
+}
+
+// indent checks the indentation of the line that starts at the current
+// position, returning an indent or dedent token if it changed.
+func (l *StringLexer) indent() (Token, bool) {
+	l.indentChecked = true
+	end := l.pos
+	for end < len(l.src) && (l.src[end] == ' ' || l.src[end] == '\t') {
+		end++
+	}
+	if end == len(l.src) || l.src[end] == '\n' || l.src[end] == '\r' || l.isLineComment(end) {
+		return Token{}, false
+	}
+	width, top := end-l.pos, l.indentWidth()
+	pos := l.position(end)
+	switch {
+	case width > top:
+		l.indents = append(l.indents, width)
+		return Token{Type: TokenIndent, Text: l.src[l.pos:end], Pos: pos}, true
+	case width < top:
+		for l.indentWidth() > width {
+			l.indents = l.indents[:len(l.indents)-1]
+			l.pending = append(l.pending, Token{Type: TokenDedent, Pos: pos})
+		}
+		if l.indentWidth() != width {
+			l.pending = append(l.pending, Token{Type: TokenError, Text: "inconsistent indentation", Pos: pos})
+		}
+		t := l.pending[0]
+		l.pending = l.pending[1:]
+		return t, true
+	}
+	return Token{}, false
+}
+
+// indentWidth returns the width of the innermost indentation level.
+func (l *StringLexer) indentWidth() int {
+	if n := len(l.indents); n > 0 {
+		return l.indents[n-1]
+	}
+	return 0
+}
+
+// lexToken scans a name, number, string or symbol.
+func (l *StringLexer) lexToken() Token {
+	c := l.src[l.pos]
+	switch {
+	case l.syntax.nameStart(l.peekRune()):
+		return l.lexName()
+	case isDigit(c):
+		return l.lexNumber()
+	case c == '"' && l.syntax.strings:
+		return l.lexStringPart(TokenInterpStart, TokenString)
+	}
+	return l.lexOperator()
+}
+
+// lexPattern scans the longest token matched by the syntax patterns, unless
+// lexToken reads a longer one.
+func (l *StringLexer) lexPattern() Token {
+	start := l.pos
+	t := l.lexToken()
+	typ, n := l.syntax.patterns.match(l.src[start:])
+	if n == 0 || start+n < l.pos && t.Type != TokenError {
+		return t
+	}
+	l.pos = start + n
+	t = Token{Type: typ, Text: l.src[start:l.pos], Pos: l.position(start)}
+	if i := strings.LastIndexByte(t.Text, '\n'); i >= 0 {
+		l.line += strings.Count(t.Text, "\n")
+		l.lineStart = start + i + 1
+	}
+	return t
+}
+
+// position returns the position for the given offset in the current line.
+func (l *StringLexer) position(offset int) Pos {
+	return Pos{Offset: offset, Line: l.line + 1, Col: offset - l.lineStart + 1}
+}
+
+// RegisterKeyword makes the lexer return names equal to word as tokens of
+// type t instead of TokenName, so that words like "if", "and" or "not" can
+// have their own parsers. It affects only this lexer, and can replace a
+// built-in keyword; registering "fn" as TokenName makes it a plain name.
+func (l *StringLexer) RegisterKeyword(word string, t TokenType) {
+	l.keywords = registerKeyword(l.keywords, l.syntax.keywords, word, t)
+	l.folded = nil
+}
+
+// registerKeyword adds a keyword to kw, or to a copy of base if kw is nil,
+// and returns the map.
+func registerKeyword(kw, base map[string]TokenType, word string, t TokenType) map[string]TokenType {
+	if kw == nil {
+		kw = make(map[string]TokenType, len(base)+1)
+		for k, v := range base {
+			kw[k] = v
+		}
+	}
+	kw[word] = t
+	return kw
+}
+
+// peekRune returns the rune at the current position.
+func (l *StringLexer) peekRune() rune {
+	if c := l.src[l.pos]; c < utf8.RuneSelf {
+		return rune(c)
+	}
+	r, _ := utf8.DecodeRuneInString(l.src[l.pos:])
+	return r
+}
+
+// lexName scans a name like "abc", "x1" or "número". Names are made of
+// Unicode letters, digits and underscores, and can't start with a digit.
+func (l *StringLexer) lexName() Token {
+	start := l.pos
+	for l.pos < len(l.src) {
+		r, size := rune(l.src[l.pos]), 1
+		if r >= utf8.RuneSelf {
+			r, size = utf8.DecodeRuneInString(l.src[l.pos:])
+		}
+		if !l.syntax.namePart(r) {
+			break
+		}
+		l.pos += size
+	}
+	text := l.src[start:l.pos]
+	if t, ok := l.keyword(text); ok {
+		return Token{Type: t, Text: text, Pos: l.position(start)}
+	}
+	return Token{Type: TokenName, Text: text, Pos: l.position(start)}
+}
+
+// keyword returns the token type of a keyword.
+func (l *StringLexer) keyword(text string) (TokenType, bool) {
+	kw := l.keywords
+	if kw == nil {
+		kw = l.syntax.keywords
+	}
+	if t, ok := kw[text]; ok || !l.FoldKeywords {
+		return t, ok
+	}
+	if l.folded == nil {
+		l.folded = make(map[string]TokenType, len(kw))
+		for k, v := range kw {
+			l.folded[strings.ToLower(k)] = v
+		}
+	}
+	t, ok := l.folded[strings.ToLower(text)]
+	return t, ok
+}
+
+// lexNumber scans a number like "42", "1.5", "1.5e-3" or "0xFF".
+func (l *StringLexer) lexNumber() Token {
+	start := l.pos
+	numbers := l.syntax.numbers
+	if numbers&NumberHex != 0 && l.src[l.pos] == '0' && l.pos+1 < len(l.src) && (l.src[l.pos+1] == 'x' || l.src[l.pos+1] == 'X') {
+		l.pos += 2
+		if !l.skip(isHexDigit) {
+			return l.malformedNumber(start)
+		}
+		return Token{Type: TokenNumber, Text: l.src[start:l.pos], Pos: l.position(start)}
+	}
+	l.skip(isDigit)
+	if numbers&NumberFraction != 0 && l.pos+1 < len(l.src) && l.src[l.pos] == '.' && isDigit(l.src[l.pos+1]) {
+		l.pos++
+		l.skip(isDigit)
+	}
+	if numbers&NumberExponent != 0 && l.pos < len(l.src) && (l.src[l.pos] == 'e' || l.src[l.pos] == 'E') {
+		l.pos++
+		if l.pos < len(l.src) && (l.src[l.pos] == '+' || l.src[l.pos] == '-') {
+			l.pos++
+		}
+		if !l.skip(isDigit) {
+			return l.malformedNumber(start)
+		}
+	}
+	return Token{Type: TokenNumber, Text: l.src[start:l.pos], Pos: l.position(start)}
+}
+
+// escapes maps the characters allowed after a backslash in strings to the
+// characters they represent.
+var escapes = map[byte]byte{
+	'n':  '\n',
+	't':  '\t',
+	'"':  '"',
+	'\\': '\\',
+}
+
+// lexStringPart scans a string like "abc", starting at its opening quote,
+// or the rest of an interpolated string, starting at the "}" that ends an
+// expression. It returns the unescaped value as the token text, with type
+// open if the part ends with "${" or close if it ends the string. Strings
+// can't span lines.
+func (l *StringLexer) lexStringPart(open, close TokenType) Token {
+	start := l.pos
+	l.pos++
+	b := new(bytes.Buffer)
+	for l.pos < len(l.src) {
+		c := l.src[l.pos]
+		switch c {
+		case '"':
+			l.pos++
+			return Token{Type: close, Text: b.String(), Pos: l.position(start)}
+		case '\n':
+			return Token{Type: TokenError, Text: "unterminated string", Pos: l.position(start)}
+		case '$':
+			if l.Interpolation && strings.HasPrefix(l.src[l.pos:], "${") {
+				l.pos += 2
+				l.interp = append(l.interp, 0)
+				return Token{Type: open, Text: b.String(), Pos: l.position(start)}
+			}
+		case '\\':
+			if l.pos+1 < len(l.src) {
+				e, ok := escapes[l.src[l.pos+1]]
+				if l.Interpolation && l.src[l.pos+1] == '$' {
+					e, ok = '$', true
+				}
+				if !ok {
+					l.pos++
+					return Token{Type: TokenError,
+						Text: fmt.Sprintf("unknown escape sequence \\%c", l.src[l.pos]),
+						Pos:  l.position(l.pos - 1)}
+				}
+				c = e
+				l.pos++
+			}
+		}
+		b.WriteByte(c)
+		l.pos++
+	}
+	return Token{Type: TokenError, Text: "unterminated string", Pos: l.position(start)}
+}
+
+// malformedNumber returns an error for a number that starts at the given
+// offset and is missing digits, like "0x" or "1e".
+func (l *StringLexer) malformedNumber(start int) Token {
+	return Token{Type: TokenError,
+		Text: fmt.Sprintf("malformed number %q", l.src[start:l.pos]),
+		Pos:  l.position(start)}
+}
+
+// lexOperator scans the longest operator that matches the input, like
+// "<=" or "<".
+func (l *StringLexer) lexOperator() Token {
+	start := l.pos
+	for n := l.syntax.maxSymbolLen; n > 0; n-- {
+		if start+n > len(l.src) {
+			continue
+		}
+		text := l.src[start : start+n]
+		if t, ok := l.syntax.symbols[text]; ok {
+			if k := len(l.interp) - 1; k >= 0 {
+				// Braces inside an interpolation, if the syntax has them.
+				switch text {
+				case "{":
+					l.interp[k]++
+				case "}":
+					l.interp[k]--
+				}
+			}
+			l.pos += n
+			return Token{Type: t, Text: text, Pos: l.position(start)}
+		}
+	}
+	r, size := utf8.DecodeRuneInString(l.src[start:])
+	l.pos += size
+	return Token{Type: TokenError,
+		Text: fmt.Sprintf("unexpected character %q", r),
+		Pos:  l.position(start)}
+}
+
+// errUnterminatedComment is the error text for a block comment without an
+// end.
+const errUnterminatedComment = "unterminated comment"
+
+// isLineComment returns whether a line comment starts at the given offset.
+func (l *StringLexer) isLineComment(offset int) bool {
+	for _, v := range l.syntax.lineComments {
+		if strings.HasPrefix(l.src[offset:], v) {
+			return true
+		}
+	}
+	return false
+}
+
+// lexLineComment scans a comment up to the end of the line.
+func (l *StringLexer) lexLineComment() Token {
+	start := l.pos
+	for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+		l.pos++
+	}
+	return Token{Type: TokenComment, Text: l.src[start:l.pos], Pos: l.position(start)}
+}
+
+// lexBlockComment scans a comment like "/* abc */".
+func (l *StringLexer) lexBlockComment() Token {
+	start := l.pos
+	pos := l.position(start)
+	open, close := l.syntax.blockComment[0], l.syntax.blockComment[1]
+	end := strings.Index(l.src[start+len(open):], close)
+	if end < 0 {
+		l.pos = len(l.src)
+		return Token{Type: TokenError, Text: errUnterminatedComment, Pos: pos}
+	}
+	l.pos = start + len(open) + end + len(close)
+	text := l.src[start:l.pos]
+	if n := strings.Count(text, "\n"); n > 0 {
+		l.line += n
+		l.lineStart = start + strings.LastIndex(text, "\n") + 1
+	}
+	return Token{Type: TokenComment, Text: text, Pos: pos}
+}
+
+// skip advances past a sequence of characters accepted by fn. It returns
+// false if there were none.
+func (l *StringLexer) skip(fn func(byte) bool) bool {
+	start := l.pos
+	for l.pos < len(l.src) && fn(l.src[l.pos]) {
+		l.pos++
+	}
+	return l.pos > start
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r'
+}
+
+func isNamePart(r rune) bool {
+	return isLetter(r) || unicode.IsDigit(r)
+}
+
+func isLetter(r rune) bool {
+	return 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z' || r == '_' ||
+		r >= utf8.RuneSelf && unicode.IsLetter(r)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// ----------------------------------------------------------------------------
+
+// NewReaderLexer returns a lexer that reads the source from r.
+func NewReaderLexer(r io.Reader) *ReaderLexer {
+	return &ReaderLexer{r: bufio.NewReader(r)}
+}
+
+// ReaderLexer is a lexer for the Bantam language that reads the source from
+// an io.Reader one line at a time, so that large inputs don't need to be
+// kept in memory. It recognizes the same tokens as StringLexer. A read
+// error is returned as a TokenError with the error message.
+type ReaderLexer struct {
+	// SignificantNewlines is like StringLexer.SignificantNewlines.
+	SignificantNewlines bool
+	// KeepComments is like StringLexer.KeepComments.
+	KeepComments bool
+	// Interpolation is like StringLexer.Interpolation.
+	Interpolation bool
+	// FoldKeywords is like StringLexer.FoldKeywords.
+	FoldKeywords bool
+	// Indentation is like StringLexer.Indentation.
+	Indentation bool
+	keywords    map[string]TokenType
+	r           *bufio.Reader
+	line        *StringLexer // Lexer for the current line.
+	offset      int          // Offset where the current line starts.
+	lines       int          // Number of lines before the current one.
+	err         error        // Error from reading the current line.
+}
+
+// Next returns the next token from the source.
+func (l *ReaderLexer) Next() Token {
+	for {
+		if l.line != nil {
+			t := l.line.Next()
+			if t.Type == TokenError && t.Text == errUnterminatedComment && l.err == nil {
+				// Block comments may span lines: lex again from the start
+				// of the comment with the next line appended.
+				src, err := l.r.ReadString('\n')
+				l.offset += t.Pos.Offset
+				l.lines += t.Pos.Line - 1
+				l.reset(l.line.src[t.Pos.Offset:]+src, err)
+				l.line.lineStart = 1 - t.Pos.Col
+				l.line.indentChecked = true
+				continue
+			}
+			t.Pos.Offset += l.offset
+			t.Pos.Line += l.lines
+			if t.Type != TokenEOF {
+				return t
+			}
+			switch l.err {
+			case nil:
+			case io.EOF:
+				return t
+			default:
+				return Token{Type: TokenError, Text: l.err.Error(), Pos: t.Pos}
+			}
+			l.offset += len(l.line.src)
+			l.lines += l.line.line
+		}
+		// Only block comments span lines, so each line is lexed on its own.
+		l.reset(l.r.ReadString('\n'))
+	}
+}
+
+// RegisterKeyword is like StringLexer.RegisterKeyword.
+func (l *ReaderLexer) RegisterKeyword(word string, t TokenType) {
+	l.keywords = registerKeyword(l.keywords, keywords, word, t)
+	if l.line != nil {
+		l.line.keywords = l.keywords
+		l.line.folded = nil
+	}
+}
+
+// reset starts lexing src, read with the given error. Interpolations and
+// indentation levels open in the previous line stay open.
+func (l *ReaderLexer) reset(src string, err error) {
+	var interp, indents []int
+	if l.line != nil {
+		interp, indents = l.line.interp, l.line.indents
+	}
+	l.line = NewStringLexer(src)
+	l.line.Interpolation = l.Interpolation
+	l.line.FoldKeywords = l.FoldKeywords
+	l.line.Indentation = l.Indentation
+	l.line.indents = indents
+	l.line.partial = err == nil
+	l.line.interp = interp
+	l.line.SignificantNewlines = l.SignificantNewlines
+	l.line.KeepComments = l.KeepComments
+	l.line.keywords = l.keywords
+	l.err = err
+}
+
+// ----------------------------------------------------------------------------
+
+// NewScannerLexer returns a lexer that reads tokens from s, which must be
+// initialized. It sets the Error field of s to report scanning errors as
+// TokenError tokens.
+func NewScannerLexer(s *scanner.Scanner) *ScannerLexer {
+	l := &ScannerLexer{s: s}
+	s.Error = func(s *scanner.Scanner, msg string) {
+		if l.err == "" {
+			l.err = msg
+		}
+	}
+	return l
+}
+
+// ScannerLexer adapts a text/scanner Scanner to the Lexer interface, so
+// that Go-like identifiers, numbers, strings and comments are lexed without
+// writing a lexer. Identifiers become names, or keywords like "fn"; integers
+// and floats become numbers; strings, raw strings and characters become
+// TokenString with their unquoted value, and comments, if the scanner mode
+// keeps them, become TokenComment. Other characters are read as the longest
+// Bantam operator they form. If '\n' is removed from the scanner Whitespace,
+// newlines become TokenNewline.
+//
+// Token positions come from the scanner, so columns count characters
+// instead of bytes.
+type ScannerLexer struct {
+	s   *scanner.Scanner
+	err string // First error reported while scanning the current token.
+}
+
+// Next returns the next token from the scanner.
+func (l *ScannerLexer) Next() Token {
+	l.err = ""
+	r := l.s.Scan()
+	text := l.s.TokenText()
+	pos := Pos{Offset: l.s.Position.Offset, Line: l.s.Position.Line, Col: l.s.Position.Column}
+	if l.err != "" {
+		return Token{Type: TokenError, Text: l.err, Pos: pos}
+	}
+	switch r {
+	case scanner.EOF:
+		p := l.s.Pos()
+		return Token{Type: TokenEOF, Pos: Pos{Offset: p.Offset, Line: p.Line, Col: p.Column}}
+	case scanner.Ident:
+		if t, ok := keywords[text]; ok {
+			return Token{Type: t, Text: text, Pos: pos}
+		}
+		return Token{Type: TokenName, Text: text, Pos: pos}
+	case scanner.Int, scanner.Float:
+		return Token{Type: TokenNumber, Text: text, Pos: pos}
+	case scanner.String, scanner.RawString, scanner.Char:
+		s, err := strconv.Unquote(text)
+		if err != nil {
+			return Token{Type: TokenError, Text: fmt.Sprintf("invalid literal %s", text), Pos: pos}
+		}
+		return Token{Type: TokenString, Text: s, Pos: pos}
+	case scanner.Comment:
+		return Token{Type: TokenComment, Text: text, Pos: pos}
+	case '\n':
+		return Token{Type: TokenNewline, Text: text, Pos: pos}
+	}
+	t, ok := operators[text]
+	if !ok {
+		return Token{Type: TokenError, Text: fmt.Sprintf("unexpected character %q", r), Pos: pos}
+	}
+	for {
+		next, ok := operators[text+string(l.s.Peek())]
+		if !ok {
+			break
+		}
+		text += string(l.s.Next())
+		t = next
+	}
+	return Token{Type: t, Text: text, Pos: pos}
+}
+
+// ----------------------------------------------------------------------------
+
+// NewSliceLexer returns a lexer that returns the given tokens.
+func NewSliceLexer(tokens []Token) *SliceLexer {
+	return &SliceLexer{tokens: tokens}
+}
+
+// SliceLexer is a lexer that returns tokens from a slice, like tokens
+// produced by another tool or recorded from another lexer. After the
+// slice is exhausted, or once it returns a TokenEOF from it, it keeps
+// returning TokenEOF. The EOF token it adds has an unknown position.
+type SliceLexer struct {
+	tokens []Token
+	pos    int
+}
+
+// Next returns the next token from the slice.
+func (l *SliceLexer) Next() Token {
+	if l.pos == len(l.tokens) {
+		return Token{Type: TokenEOF}
+	}
+	t := l.tokens[l.pos]
+	if t.Type != TokenEOF {
+		l.pos++
+	}
+	return t
+}
+
+// ----------------------------------------------------------------------------
+
+// NewFilterLexer returns a lexer that passes the tokens of l through fn.
+func NewFilterLexer(l Lexer, fn func(Token) (Token, bool)) *FilterLexer {
+	return &FilterLexer{lexer: l, fn: fn}
+}
+
+// FilterLexer drops or rewrites the tokens of another lexer before the
+// parser sees them. The filter function returns the token to use, which
+// may be changed, and false to drop it. EOF tokens are not filtered, so the
+// stream always ends. For example, to drop newlines:
+//
+//	l := NewFilterLexer(lexer, func(t Token) (Token, bool) {
+//		return t, t.Type != TokenNewline
+//	})
+type FilterLexer struct {
+	lexer Lexer
+	fn    func(Token) (Token, bool)
+}
+
+// Next returns the next token that passes the filter.
+func (l *FilterLexer) Next() Token {
+	for {
+		t := l.lexer.Next()
+		if t.Type == TokenEOF {
+			return t
+		}
+		if t, ok := l.fn(t); ok {
+			return t
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
+// NewChanLexer starts a goroutine that reads tokens from l and sends them
+// over a channel with the given buffer size, so that lexing runs ahead of
+// parsing. The goroutine stops after sending a TokenEOF or when the
+// returned lexer is closed. The caller must not use l afterwards.
+func NewChanLexer(l Lexer, buffer int) *ChanLexer {
+	c := &ChanLexer{
+		tokens: make(chan Token, buffer),
+		done:   make(chan struct{}),
+	}
+	go c.run(l)
+	return c
+}
+
+// ChanLexer receives over a channel the tokens of a lexer that runs in its
+// own goroutine. It is a Lexer itself, so it can feed a Stack:
+//
+//	l := NewChanLexer(NewReaderLexer(r), 64)
+//	defer l.Close()
+//	n, err := NewParser(NewStack(l)).Parse()
+type ChanLexer struct {
+	tokens chan Token
+	done   chan struct{} // Closed by Close.
+	once   sync.Once
+	eof    Token // Last token received, once the channel is closed.
+}
+
+// run sends the tokens read from l until EOF or until the lexer is closed.
+func (c *ChanLexer) run(l Lexer) {
+	defer close(c.tokens)
+	for {
+		t := l.Next()
+		select {
+		case c.tokens <- t:
+		case <-c.done:
+			return
+		}
+		if t.Type == TokenEOF {
+			return
+		}
+	}
+}
+
+// Tokens returns the channel the tokens are sent on. It is closed after
+// the TokenEOF token, or after Close.
+func (c *ChanLexer) Tokens() <-chan Token {
+	return c.tokens
+}
+
+// Next returns the next token from the channel. After EOF it keeps
+// returning the EOF token. After Close it may still return tokens that
+// were already sent, and then a zero EOF token.
+func (c *ChanLexer) Next() Token {
+	if t, ok := <-c.tokens; ok {
+		if t.Type == TokenEOF {
+			c.eof = t
+		}
+		return t
+	}
+	return c.eof
+}
+
+// Close stops the lexing goroutine. It is safe to call it more than once.
+func (c *ChanLexer) Close() {
+	c.once.Do(func() { close(c.done) })
+}
+
+// ----------------------------------------------------------------------------
+
+// simpleLexer is a lexer for single-character tokens. Characters in symbols
+// are operators, spaces are skipped and any other character is a name.
+type simpleLexer struct {
+	src     string
+	pos     int
+	symbols map[string]TokenType
+}
+
+// Next returns the next token from the source.
+func (l *simpleLexer) Next() Token {
+	for l.pos < len(l.src) {
+		_, size := utf8.DecodeRuneInString(l.src[l.pos:])
+		s := l.src[l.pos : l.pos+size]
+		pos := Pos{Offset: l.pos, Line: 1, Col: l.pos + 1}
+		l.pos += size
+		if s == " " {
+			continue
+		}
+		if t, ok := l.symbols[s]; ok {
+			return Token{Type: t, Text: s, Pos: pos}
+		}
+		return Token{Type: TokenName, Text: s, Pos: pos}
+	}
+	return Token{Type: TokenEOF, Pos: Pos{Offset: l.pos, Line: 1, Col: l.pos + 1}}
+}
+
+// ----------------------------------------------------------------------------
+
 // NewStack returns a stack for the given lexer.
 func NewStack(lexer Lexer) *Stack {
 	return &Stack{lexer: lexer}
 }
 
 // Stack is a basic LIFO stack for tokens. It allows forwarding and rewinding.
+//
+// Once the lexer returns EOF the stream is exhausted: the stack stops
+// calling the lexer and Pop returns the same EOF token every time, and
+// pushing it back onto an empty stack doesn't grow the buffer. Parsers that
+// loop consuming tokens, like "for !s.Match(TokenParenR) { ... }", must
+// still check for EOF to end the loop, since Match won't fail by itself.
 type Stack struct {
-	lexer  Lexer
-	tokens []Token
-	count  int
+	// MaxLookahead, if positive, is the number of tokens Peek may look
+	// ahead: Peek(index) panics with a *ParseError if index is not less
+	// than it. It lets grammars document and enforce the lookahead their
+	// parselets need. The default grammar needs one token of lookahead.
+	MaxLookahead int
+	// Lookbehind is the number of consumed tokens the stack keeps, to be
+	// returned by Previous, so that parselets can inspect what came before
+	// them. Tokens pushed back are no longer consumed.
+	Lookbehind int
+	lexer      Lexer
+	// Tokens read or pushed back but not consumed are kept in a ring
+	// buffer, whose length is zero or a power of two. The next token is at
+	// head, so Push and Pop work at the front and Peek reads from the lexer
+	// into the back.
+	buf      []Token
+	head     int
+	count    int
+	read     int       // Number of tokens read from the lexer.
+	eof      *Token    // EOF token, once the lexer returned it.
+	comments []Token   // Comments read from the lexer.
+	attached int       // Number of comments attached to nodes by a Parser.
+	marks    int       // Number of marks not rewound or released.
+	log      []stackOp // Pushes and pops since the first mark.
+	prev     []Token   // Last Lookbehind+1 consumed tokens, most recent last.
+}
+
+// stackOp is a Push or Pop recorded to be undone by Rewind.
+type stackOp struct {
+	token Token
+	push  bool
 }
 
-// Push adds one or more tokens back to the stack.
+// Push adds one or more tokens back to the stack. The last one is the
+// next to be popped.
 func (s *Stack) Push(t ...Token) {
-	s.tokens = append(s.tokens[:s.count], t...)
-	s.count += len(t)
+	for _, v := range t {
+		if s.push(v) && s.marks > 0 {
+			s.log = append(s.log, stackOp{token: v, push: true})
+		}
+		s.unconsume(v)
+	}
+}
+
+// push adds a token to the front of the buffer, returning false if it was
+// not needed.
+func (s *Stack) push(t Token) bool {
+	if s.count == 0 && s.eof != nil && t == *s.eof {
+		// Pop returns it anyway.
+		return false
+	}
+	s.grow()
+	s.head = (s.head - 1) & (len(s.buf) - 1)
+	s.buf[s.head] = t
+	s.count++
+	return true
 }
 
 // Pop consumes and returns a token from the stack.
 func (s *Stack) Pop() Token {
+	t := s.pop()
+	if s.marks > 0 {
+		s.log = append(s.log, stackOp{token: t})
+	}
+	s.consume(t)
+	return t
+}
+
+// consume records a popped token for Previous.
+func (s *Stack) consume(t Token) {
+	if s.Lookbehind <= 0 || t.Type == TokenEOF {
+		return
+	}
+	// One extra token is kept so that a token pushed back leaves the
+	// window full.
+	if len(s.prev) > s.Lookbehind {
+		n := copy(s.prev, s.prev[len(s.prev)-s.Lookbehind:])
+		s.prev = s.prev[:n]
+	}
+	s.prev = append(s.prev, t)
+}
+
+// unconsume forgets the last token recorded for Previous if t was pushed
+// back.
+func (s *Stack) unconsume(t Token) {
+	if n := len(s.prev); n > 0 && s.prev[n-1] == t {
+		s.prev = s.prev[:n-1]
+	}
+}
+
+// Previous returns the token consumed k tokens ago, with 0 being the last
+// one, and whether it is known. Only the last Lookbehind tokens are kept.
+func (s *Stack) Previous(k int) (Token, bool) {
+	if k < 0 || k >= s.Lookbehind || k >= len(s.prev) {
+		return Token{}, false
+	}
+	return s.prev[len(s.prev)-1-k], true
+}
+
+// pop removes the token at the front of the buffer, or reads one from the
+// lexer if the buffer is empty.
+func (s *Stack) pop() Token {
 	if s.count == 0 {
-		return s.lexer.Next()
+		return s.next()
 	}
+	t := s.buf[s.head]
+	s.head = (s.head + 1) & (len(s.buf) - 1)
 	s.count--
-	return s.tokens[s.count]
+	return t
 }
 
-// Peek returns without consuming a token at the given index.
-func (s *Stack) Peek(index int) Token {
-	switch {
-	case index == 0:
-		t := s.Pop()
-		s.Push(t)
-		return t
-	case index > 0:
-		if index < s.count {
-			return s.tokens[index]
+// Mark returns a checkpoint that Rewind can go back to, so that a parselet
+// can attempt a parse and backtrack if it fails, when one token of
+// lookahead can't resolve an ambiguity. From the first mark the stack
+// records the tokens pushed and popped, until each mark is rewound or
+// released; marks can be nested.
+func (s *Stack) Mark() int {
+	s.marks++
+	return len(s.log)
+}
+
+// Rewind undoes the pushes and pops made since the given mark, so that the
+// tokens consumed since then are returned again. Marks taken after it
+// can't be used anymore.
+func (s *Stack) Rewind(mark int) {
+	for i := len(s.log) - 1; i >= mark; i-- {
+		if op := s.log[i]; op.push {
+			s.pop()
+		} else {
+			s.push(op.token)
+			s.unconsume(op.token)
 		}
-		t := make([]Token, index+1)
-		for index >= 0 {
-			t[index] = s.Pop()
-			index--
+	}
+	s.log = s.log[:mark]
+	s.Release(mark)
+}
+
+// Release discards a mark without rewinding, when the attempt succeeded.
+func (s *Stack) Release(mark int) {
+	if s.marks > 0 {
+		s.marks--
+	}
+	if s.marks == 0 {
+		s.log = s.log[:0]
+	}
+}
+
+// next reads a token from the lexer, setting comments aside. After EOF it
+// returns the EOF token without calling the lexer.
+func (s *Stack) next() Token {
+	if s.eof != nil {
+		return *s.eof
+	}
+	s.read++
+	t := s.lexer.Next()
+	for t.Type == TokenComment {
+		s.comments = append(s.comments, t)
+		t = s.lexer.Next()
+	}
+	if t.Type == TokenEOF {
+		// A copy, so that t doesn't escape for every token.
+		eof := t
+		s.eof = &eof
+	}
+	return t
+}
+
+// popped returns the number of tokens read from the lexer and not in the
+// buffer, not counting EOF.
+func (s *Stack) popped() int {
+	n := s.read - s.count
+	if s.eof != nil {
+		n--
+	}
+	return n
+}
+
+// grow makes room for one more token in the buffer.
+func (s *Stack) grow() {
+	if s.count < len(s.buf) {
+		return
+	}
+	size := 2 * len(s.buf)
+	if size == 0 {
+		size = 4
+	}
+	buf := make([]Token, size)
+	for i := 0; i < s.count; i++ {
+		buf[i] = s.buf[(s.head+i)&(len(s.buf)-1)]
+	}
+	s.buf, s.head = buf, 0
+}
+
+// Filter makes the stack pass the tokens it reads from now on through fn,
+// like a FilterLexer wrapping its lexer. Tokens already buffered are not
+// filtered. Filters added later see the tokens kept by earlier ones.
+func (s *Stack) Filter(fn func(Token) (Token, bool)) {
+	s.lexer = NewFilterLexer(s.lexer, fn)
+}
+
+// Reset makes the stack read from another lexer, as if it was new, but
+// keeps its buffer to avoid allocations when a stack is reused for many
+// inputs. MaxLookahead and Lookbehind are kept; marks, comments and
+// consumed tokens are dropped, and a Filter must be set again.
+func (s *Stack) Reset(lexer Lexer) {
+	for k := range s.buf {
+		// Don't keep the old tokens alive.
+		s.buf[k] = Token{}
+	}
+	s.lexer = lexer
+	s.head, s.count, s.read = 0, 0, 0
+	s.eof = nil
+	s.comments = nil
+	s.attached = 0
+	s.marks = 0
+	s.log = s.log[:0]
+	s.prev = s.prev[:0]
+}
+
+// Comments returns the comments read from the lexer so far. They are set
+// aside when read, so Pop never returns a TokenComment.
+func (s *Stack) Comments() []Token {
+	return s.comments
+}
+
+// Remaining returns a copy of the tokens that were read from the lexer but
+// not consumed yet, in the order they will be popped. Tokens not read yet
+// are not included.
+func (s *Stack) Remaining() []Token {
+	t := make([]Token, s.count)
+	for k := range t {
+		t[k] = s.buf[(s.head+k)&(len(s.buf)-1)]
+	}
+	return t
+}
+
+// Peek returns without consuming a token at the given index. Past EOF it
+// returns the EOF token.
+func (s *Stack) Peek(index int) Token {
+	if index < 0 {
+		panic(fmt.Errorf("Peek received negative index"))
+	}
+	if s.MaxLookahead > 0 && index >= s.MaxLookahead {
+		panic(&ParseError{
+			Msg:   fmt.Sprintf("lookahead of %d tokens exceeds the limit of %d", index+1, s.MaxLookahead),
+			Token: s.Peek(0),
+			Pos:   s.Peek(0).Pos})
+	}
+	for s.count <= index {
+		t := s.next()
+		if t.Type == TokenEOF {
+			return t
 		}
-		s.Push(t...)
-		return t[0]
+		s.grow()
+		s.buf[(s.head+s.count)&(len(s.buf)-1)] = t
+		s.count++
 	}
-	panic(fmt.Errorf("Peek received negative index"))
+	return s.buf[(s.head+index)&(len(s.buf)-1)]
+}
+
+// PeekN returns without consuming the next n tokens, padded with EOF
+// tokens if the input ends before. Like Peek, it panics if n exceeds
+// MaxLookahead.
+func (s *Stack) PeekN(n int) []Token {
+	if n == 0 {
+		return nil
+	}
+	s.Peek(n - 1)
+	t := make([]Token, n)
+	for k := range t {
+		t[k] = s.Peek(k)
+	}
+	return t
 }
 
 // Expect consumes a token if matches one of the expected types. Otherwise
-// it panics.
+// it panics with the *ParseError returned by TryExpect, which Parse
+// returns.
 func (s *Stack) Expect(expected ...TokenType) Token {
+	t, err := s.TryExpect(expected...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// TryExpect consumes a token if matches one of the expected types.
+// Otherwise the token is not consumed and it returns a *ParseError at the
+// position of the token, or the lexer error if the token is a TokenError.
+// It lets code outside a parse compose token checks without recovering
+// panics.
+func (s *Stack) TryExpect(expected ...TokenType) (Token, error) {
 	t := s.Pop()
 	switch len(expected) {
 	case 1:
 		if t.Type == expected[0] {
-			return t
+			return t, nil
 		}
 	default:
 		for _, e := range expected {
 			if t.Type == e {
-				return t
+				return t, nil
 			}
 		}
 	}
 	s.Push(t)
-	panic(fmt.Errorf("expected token %s and found %s", expected, t.Type))
+	if t.Type == TokenError {
+		return t, lexError(t)
+	}
+	return t, &ParseError{Msg: fmt.Sprintf("expected token %s and found %s", expected, t.Type), Token: t, Pos: t.Pos,
+		Expected: append([]TokenType(nil), expected...)}
 }
 
 // Match consumes a token if it is of the expected type, returning true.
@@ -95,3 +1297,20 @@ func (s *Stack) Match(expected TokenType) bool {
 	}
 	return true
 }
+
+// PeekTextIs returns true if the text of the next token is s, without
+// consuming it.
+func (s *Stack) PeekTextIs(text string) bool {
+	return s.Peek(0).Text == text
+}
+
+// MatchText consumes a token if its text is the expected one, returning
+// true. Otherwise the token is not consumed and it returns false.
+func (s *Stack) MatchText(expected string) bool {
+	t := s.Pop()
+	if t.Text != expected {
+		s.Push(t)
+		return false
+	}
+	return true
+}
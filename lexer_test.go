@@ -0,0 +1,1014 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"text/scanner"
+)
+
+// lex returns all tokens read from a StringLexer, including the final EOF.
+func lex(src string) []Token {
+	l := NewStringLexer(src)
+	var tokens []Token
+	for {
+		t := l.Next()
+		tokens = append(tokens, t)
+		if t.Type == TokenEOF || t.Type == TokenError {
+			return tokens
+		}
+	}
+}
+
+func TestStringLexer(t *testing.T) {
+	type lexerTest struct {
+		source string
+		tokens []Token
+	}
+
+	eof := Token{Type: TokenEOF}
+	tests := []lexerTest{
+		{"", []Token{eof}},
+		{"  \t\n", []Token{eof}},
+		// Identifiers may contain digits after the first char.
+		{"x1", []Token{{Type: TokenName, Text: "x1"}, eof}},
+		{"foo2bar", []Token{{Type: TokenName, Text: "foo2bar"}, eof}},
+		{"_a9", []Token{{Type: TokenName, Text: "_a9"}, eof}},
+		// Keywords.
+		{"fn fnx", []Token{{Type: TokenFn, Text: "fn"}, {Type: TokenName, Text: "fnx"}, eof}},
+		{"null nullish nullable", []Token{
+			{Type: TokenNull, Text: "null"},
+			{Type: TokenName, Text: "nullish"},
+			{Type: TokenName, Text: "nullable"},
+			eof,
+		}},
+		// A leading digit starts a number.
+		{"1x", []Token{{Type: TokenNumber, Text: "1"}, {Type: TokenName, Text: "x"}, eof}},
+		{"1.5", []Token{{Type: TokenNumber, Text: "1.5"}, eof}},
+		{"12.", []Token{{Type: TokenNumber, Text: "12"}, {Type: TokenError, Text: `unexpected character '.'`}}},
+		{"0xFF 0X1a 1e9 1.5e-3 2E+10", []Token{
+			{Type: TokenNumber, Text: "0xFF"},
+			{Type: TokenNumber, Text: "0X1a"},
+			{Type: TokenNumber, Text: "1e9"},
+			{Type: TokenNumber, Text: "1.5e-3"},
+			{Type: TokenNumber, Text: "2E+10"},
+			eof,
+		}},
+		{"0xFFg", []Token{{Type: TokenNumber, Text: "0xFF"}, {Type: TokenName, Text: "g"}, eof}},
+		{"1e-3-2", []Token{{Type: TokenNumber, Text: "1e-3"}, {Type: TokenMinus, Text: "-"}, {Type: TokenNumber, Text: "2"}, eof}},
+		{"0x", []Token{{Type: TokenError, Text: `malformed number "0x"`}}},
+		{"0xg", []Token{{Type: TokenError, Text: `malformed number "0x"`}}},
+		{"1e", []Token{{Type: TokenError, Text: `malformed number "1e"`}}},
+		{"1.5e+ 2", []Token{{Type: TokenError, Text: `malformed number "1.5e+"`}}},
+		// Strings.
+		{`"abc" ""`, []Token{{Type: TokenString, Text: "abc"}, {Type: TokenString, Text: ""}, eof}},
+		{`"a\"b\\c\nd\te"`, []Token{{Type: TokenString, Text: "a\"b\\c\nd\te"}, eof}},
+		{`"a#b" # c`, []Token{{Type: TokenString, Text: "a#b"}, eof}},
+		{`"abc`, []Token{{Type: TokenError, Text: "unterminated string"}}},
+		{"\"ab\nc\"", []Token{{Type: TokenError, Text: "unterminated string"}}},
+		{`"ab\`, []Token{{Type: TokenError, Text: "unterminated string"}}},
+		{`"a\qb"`, []Token{{Type: TokenError, Text: `unknown escape sequence \q`}}},
+		// Operators.
+		{"a+b1 * (c)", []Token{
+			{Type: TokenName, Text: "a"},
+			{Type: TokenPlus, Text: "+"},
+			{Type: TokenName, Text: "b1"},
+			{Type: TokenAsterisk, Text: "*"},
+			{Type: TokenParenL, Text: "("},
+			{Type: TokenName, Text: "c"},
+			{Type: TokenParenR, Text: ")"},
+			eof,
+		}},
+		// Two-character operators.
+		{"a<<b>>c", []Token{
+			{Type: TokenName, Text: "a"},
+			{Type: TokenShiftLeft, Text: "<<"},
+			{Type: TokenName, Text: "b"},
+			{Type: TokenShiftRight, Text: ">>"},
+			{Type: TokenName, Text: "c"},
+			eof,
+		}},
+		{"&&&|||", []Token{
+			{Type: TokenAnd, Text: "&&"},
+			{Type: TokenAmpersand, Text: "&"},
+			{Type: TokenOr, Text: "||"},
+			{Type: TokenPipe, Text: "|"},
+			eof,
+		}},
+		{"<<=<=>=>!=!==", []Token{
+			{Type: TokenShiftLeft, Text: "<<"},
+			{Type: TokenAssignment, Text: "="},
+			{Type: TokenLessEq, Text: "<="},
+			{Type: TokenGreaterEq, Text: ">="},
+			{Type: TokenGreater, Text: ">"},
+			{Type: TokenNotEqual, Text: "!="},
+			{Type: TokenNotEqual, Text: "!="},
+			{Type: TokenAssignment, Text: "="},
+			eof,
+		}},
+		{"a+++b---c", []Token{
+			{Type: TokenName, Text: "a"},
+			{Type: TokenIncrement, Text: "++"},
+			{Type: TokenPlus, Text: "+"},
+			{Type: TokenName, Text: "b"},
+			{Type: TokenDecrement, Text: "--"},
+			{Type: TokenMinus, Text: "-"},
+			{Type: TokenName, Text: "c"},
+			eof,
+		}},
+		{"a?:b?c:d", []Token{
+			{Type: TokenName, Text: "a"},
+			{Type: TokenElvis, Text: "?:"},
+			{Type: TokenName, Text: "b"},
+			{Type: TokenQuestion, Text: "?"},
+			{Type: TokenName, Text: "c"},
+			{Type: TokenColon, Text: ":"},
+			{Type: TokenName, Text: "d"},
+			eof,
+		}},
+		// Comments.
+		{"# only a comment", []Token{eof}},
+		{"a # comment\n# another\nb", []Token{{Type: TokenName, Text: "a"}, {Type: TokenName, Text: "b"}, eof}},
+		{"a#", []Token{{Type: TokenName, Text: "a"}, eof}},
+		{"a // comment\nb", []Token{{Type: TokenName, Text: "a"}, {Type: TokenName, Text: "b"}, eof}},
+		{"a /* one\ntwo */ / b", []Token{{Type: TokenName, Text: "a"}, {Type: TokenSlash, Text: "/"}, {Type: TokenName, Text: "b"}, eof}},
+		{"a/**/b", []Token{{Type: TokenName, Text: "a"}, {Type: TokenName, Text: "b"}, eof}},
+		{"a /* b", []Token{{Type: TokenName, Text: "a"}, {Type: TokenError, Text: "unterminated comment"}}},
+		{"a @", []Token{{Type: TokenName, Text: "a"}, {Type: TokenError, Text: `unexpected character '@'`}}},
+		// Unicode names.
+		{"número + 变量", []Token{{Type: TokenName, Text: "número"}, {Type: TokenPlus, Text: "+"}, {Type: TokenName, Text: "变量"}, eof}},
+		{"_x٣ café1", []Token{{Type: TokenName, Text: "_x٣"}, {Type: TokenName, Text: "café1"}, eof}},
+		{"a €", []Token{{Type: TokenName, Text: "a"}, {Type: TokenError, Text: `unexpected character '€'`}}},
+		{"٣", []Token{{Type: TokenError, Text: `unexpected character '٣'`}}},
+	}
+
+	for _, test := range tests {
+		tokens := lex(test.source)
+		if len(tokens) != len(test.tokens) {
+			t.Errorf("%q: expected %v, got %v", test.source, test.tokens, tokens)
+			continue
+		}
+		for k, v := range tokens {
+			if v.Type != test.tokens[k].Type || v.Text != test.tokens[k].Text {
+				t.Errorf("%q: token %d: expected %#v, got %#v", test.source, k, test.tokens[k], v)
+			}
+		}
+	}
+}
+
+func TestNewLexer(t *testing.T) {
+	l := NewLexer("fn(x) x1 <= 0x1F ?: null")
+	expected := []TokenType{TokenFn, TokenParenL, TokenName, TokenParenR,
+		TokenName, TokenLessEq, TokenNumber, TokenElvis, TokenNull, TokenEOF}
+	for k, v := range expected {
+		if r := l.Next(); r.Type != v {
+			t.Errorf("token %d: expected %s, got %s", k, v, r.Type)
+		}
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tokens, err := Tokenize("a +\n 0x1F")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []Token{
+		{Type: TokenName, Text: "a", Pos: Pos{Offset: 0, Line: 1, Col: 1}},
+		{Type: TokenPlus, Text: "+", Pos: Pos{Offset: 2, Line: 1, Col: 3}},
+		{Type: TokenNumber, Text: "0x1F", Pos: Pos{Offset: 5, Line: 2, Col: 2}},
+		{Type: TokenEOF, Pos: Pos{Offset: 9, Line: 2, Col: 6}},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, tokens)
+	}
+	for k, v := range tokens {
+		if v != expected[k] {
+			t.Errorf("token %d: expected %#v, got %#v", k, expected[k], v)
+		}
+	}
+
+	tokens, err = Tokenize("a + \"b")
+	e, ok := err.(*ParseError)
+	if !ok || e.Msg != "unterminated string" || e.Pos.String() != "1:5" {
+		t.Errorf("expected unterminated string at 1:5, got %v", err)
+	}
+	if len(tokens) != 2 {
+		t.Errorf("expected the tokens before the error, got %v", tokens)
+	}
+}
+
+func TestReaderLexer(t *testing.T) {
+	tests := []string{
+		"",
+		"a + b",
+		"a +\n  # comment\n\tc12 * 0x1F\n",
+		"a /* one\ntwo\n */ + b // three\nc",
+		"a /* one\ntwo",
+		"f(a,\r\nb) ?: null\n\n",
+		"a @ b",
+	}
+	for _, src := range tests {
+		for _, significant := range []bool{false, true} {
+			expected := NewStringLexer(src)
+			expected.SignificantNewlines = significant
+			expected.KeepComments = significant
+			l := NewReaderLexer(iotest.OneByteReader(strings.NewReader(src)))
+			l.SignificantNewlines = significant
+			l.KeepComments = significant
+			for {
+				e, r := expected.Next(), l.Next()
+				if r != e {
+					t.Errorf("%q: expected %#v, got %#v", src, e, r)
+					break
+				}
+				if e.Type == TokenEOF || e.Type == TokenError {
+					break
+				}
+			}
+		}
+	}
+
+	// Read errors are returned as error tokens.
+	l := NewReaderLexer(io.MultiReader(strings.NewReader("a\nb"), iotest.ErrReader(errors.New("boom"))))
+	for _, expected := range []string{"a", "b", "boom"} {
+		if r := l.Next(); r.Text != expected {
+			t.Errorf("expected %q, got %v", expected, r)
+		}
+	}
+}
+
+func TestStringLexerPositions(t *testing.T) {
+	tokens := lex("ab +\n  # comment\n\tc12 é")
+	expected := []Pos{
+		{Offset: 0, Line: 1, Col: 1},
+		{Offset: 3, Line: 1, Col: 4},
+		{Offset: 18, Line: 3, Col: 2},
+		{Offset: 22, Line: 3, Col: 6},
+		{Offset: 24, Line: 3, Col: 8},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected %d tokens, got %d", len(expected), len(tokens))
+	}
+	for k, v := range tokens {
+		if v.Pos != expected[k] {
+			t.Errorf("token %d (%s): expected %#v, got %#v", k, v, expected[k], v.Pos)
+		}
+	}
+}
+
+func TestStringLexerNewlines(t *testing.T) {
+	l := NewStringLexer("a # comment\n\nb")
+	l.SignificantNewlines = true
+	var tokens []Token
+	for {
+		t := l.Next()
+		tokens = append(tokens, t)
+		if t.Type == TokenEOF {
+			break
+		}
+	}
+	expected := []Token{
+		{Type: TokenName, Text: "a", Pos: Pos{Offset: 0, Line: 1, Col: 1}},
+		{Type: TokenNewline, Text: "\n", Pos: Pos{Offset: 11, Line: 1, Col: 12}},
+		{Type: TokenNewline, Text: "\n", Pos: Pos{Offset: 12, Line: 2, Col: 1}},
+		{Type: TokenName, Text: "b", Pos: Pos{Offset: 13, Line: 3, Col: 1}},
+		{Type: TokenEOF, Pos: Pos{Offset: 14, Line: 3, Col: 2}},
+	}
+	if len(tokens) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, tokens)
+	}
+	for k, v := range tokens {
+		if v != expected[k] {
+			t.Errorf("token %d: expected %#v, got %#v", k, expected[k], v)
+		}
+	}
+}
+
+func TestStringLexerKeepComments(t *testing.T) {
+	l := NewStringLexer("a # one\n/* two\n */ b // three")
+	l.KeepComments = true
+	expected := []Token{
+		{Type: TokenName, Text: "a", Pos: Pos{Offset: 0, Line: 1, Col: 1}},
+		{Type: TokenComment, Text: "# one", Pos: Pos{Offset: 2, Line: 1, Col: 3}},
+		{Type: TokenComment, Text: "/* two\n */", Pos: Pos{Offset: 8, Line: 2, Col: 1}},
+		{Type: TokenName, Text: "b", Pos: Pos{Offset: 19, Line: 3, Col: 5}},
+		{Type: TokenComment, Text: "// three", Pos: Pos{Offset: 21, Line: 3, Col: 7}},
+		{Type: TokenEOF, Pos: Pos{Offset: 29, Line: 3, Col: 15}},
+	}
+	for k, v := range expected {
+		if r := l.Next(); r != v {
+			t.Errorf("token %d: expected %#v, got %#v", k, v, r)
+		}
+	}
+
+	// The stack sets comments aside.
+	l = NewStringLexer("a /* one */ b")
+	l.KeepComments = true
+	s := NewStack(l)
+	for _, expected := range []TokenType{TokenName, TokenName, TokenEOF} {
+		if r := s.Pop(); r.Type != expected {
+			t.Errorf("expected %s, got %s", expected, r)
+		}
+	}
+	if c := s.Comments(); len(c) != 1 || c[0].Text != "/* one */" {
+		t.Errorf("expected one comment, got %v", c)
+	}
+}
+
+func TestRegisterKeyword(t *testing.T) {
+	const tokenIf TokenType = 1001
+	src := "if a and not fn then null"
+	expected := []TokenType{tokenIf, TokenName, TokenAnd, TokenExclamation,
+		TokenName, TokenName, TokenNull, TokenEOF}
+	lexers := map[string]interface {
+		Lexer
+		RegisterKeyword(string, TokenType)
+	}{
+		"StringLexer": NewStringLexer(src),
+		"ReaderLexer": NewReaderLexer(strings.NewReader(src)),
+	}
+	for name, l := range lexers {
+		l.RegisterKeyword("if", tokenIf)
+		l.RegisterKeyword("and", TokenAnd)
+		l.RegisterKeyword("not", TokenExclamation)
+		l.RegisterKeyword("fn", TokenName)
+		for k, v := range expected {
+			if r := l.Next(); r.Type != v {
+				t.Errorf("%s: token %d: expected %s, got %s", name, k, v, r.Type)
+			}
+		}
+	}
+
+	// Other lexers keep the built-in keywords.
+	if r := NewStringLexer("fn and").Next(); r.Type != TokenFn {
+		t.Errorf("expected %s, got %s", TokenFn, r.Type)
+	}
+
+	// Keywords can match regardless of case.
+	src = "AND And and NULL Fn ANDY"
+	expected = []TokenType{TokenAnd, TokenAnd, TokenAnd, TokenNull, TokenFn, TokenName, TokenEOF}
+	sl, rl := NewStringLexer(src), NewReaderLexer(strings.NewReader(src))
+	sl.FoldKeywords, rl.FoldKeywords = true, true
+	lexers["StringLexer"], lexers["ReaderLexer"] = sl, rl
+	for name, l := range lexers {
+		l.RegisterKeyword("And", TokenAnd)
+		for k, v := range expected {
+			if r := l.Next(); r.Type != v {
+				t.Errorf("%s: token %d: expected %s, got %s", name, k, v, r.Type)
+			} else if k == 0 && r.Text != "AND" {
+				t.Errorf("%s: expected text AND, got %q", name, r.Text)
+			}
+		}
+	}
+	if r := NewStringLexer("NULL").Next(); r.Type != TokenName {
+		t.Errorf("expected %s, got %s", TokenName, r.Type)
+	}
+
+	// Keywords reuse the parsers of their token types.
+	l := NewStringLexer("a and not b")
+	l.RegisterKeyword("and", TokenAnd)
+	l.RegisterKeyword("not", TokenExclamation)
+	p := newParser("")
+	p.Stack = NewStack(l)
+	if n, err := p.Parse(); err != nil || n.String() != "(a && (!b))" {
+		t.Errorf("expected (a && (!b)), got %v (%v)", n, err)
+	}
+}
+
+func TestStringLexerInterpolation(t *testing.T) {
+	tests := []struct {
+		source string
+		tokens []Token
+	}{
+		{`"a ${b + 1} c ${d} e"`, []Token{
+			{Type: TokenInterpStart, Text: "a "}, {Type: TokenName, Text: "b"}, {Type: TokenPlus, Text: "+"},
+			{Type: TokenNumber, Text: "1"}, {Type: TokenInterpMid, Text: " c "}, {Type: TokenName, Text: "d"},
+			{Type: TokenInterpEnd, Text: " e"},
+		}},
+		{`"${f("x ${y}")}"`, []Token{
+			{Type: TokenInterpStart}, {Type: TokenName, Text: "f"}, {Type: TokenParenL, Text: "("},
+			{Type: TokenInterpStart, Text: "x "}, {Type: TokenName, Text: "y"}, {Type: TokenInterpEnd},
+			{Type: TokenParenR, Text: ")"}, {Type: TokenInterpEnd},
+		}},
+		{`"\${a} $b {c}"`, []Token{{Type: TokenString, Text: "${a} $b {c}"}}},
+		{`"a ${b`, []Token{{Type: TokenInterpStart, Text: "a "}, {Type: TokenName, Text: "b"}, {Type: TokenEOF}}},
+		{`"${a} b`, []Token{{Type: TokenInterpStart}, {Type: TokenName, Text: "a"}, {Type: TokenError, Text: "unterminated string"}}},
+		{`a}`, []Token{{Type: TokenName, Text: "a"}, {Type: TokenBraceR, Text: "}"}}},
+		// Braces inside an interpolation don't close it.
+		{`"${ {a} } b"`, []Token{
+			{Type: TokenInterpStart}, {Type: TokenBraceL, Text: "{"}, {Type: TokenName, Text: "a"},
+			{Type: TokenBraceR, Text: "}"}, {Type: TokenInterpEnd, Text: " b"},
+		}},
+	}
+	for _, test := range tests {
+		l := NewStringLexer(test.source)
+		l.Interpolation = true
+		for k, v := range test.tokens {
+			if r := l.Next(); r.Type != v.Type || r.Text != v.Text {
+				t.Errorf("%q: token %d: expected %#v, got %#v", test.source, k, v, r)
+			}
+		}
+	}
+
+	// Without Interpolation "${" is part of the string.
+	if r := lex(`"a ${b}"`)[0]; r.Type != TokenString || r.Text != "a ${b}" {
+		t.Errorf("expected string, got %#v", r)
+	}
+
+	// The ReaderLexer keeps interpolations open across lines.
+	src := "\"a ${b +\n c} d\" + \"${\ne\n}\""
+	expected := NewStringLexer(src)
+	expected.Interpolation = true
+	l := NewReaderLexer(strings.NewReader(src))
+	l.Interpolation = true
+	for {
+		e, r := expected.Next(), l.Next()
+		if r != e {
+			t.Errorf("%q: expected %#v, got %#v", src, e, r)
+			break
+		}
+		if e.Type == TokenEOF {
+			break
+		}
+	}
+}
+
+func TestScannerLexer(t *testing.T) {
+	tests := []struct {
+		source string
+		tokens []Token
+	}{
+		{"fn(x) x1 <= 0x1F ?: null", []Token{
+			{Type: TokenFn, Text: "fn"}, {Type: TokenParenL, Text: "("}, {Type: TokenName, Text: "x"},
+			{Type: TokenParenR, Text: ")"}, {Type: TokenName, Text: "x1"}, {Type: TokenLessEq, Text: "<="},
+			{Type: TokenNumber, Text: "0x1F"}, {Type: TokenElvis, Text: "?:"}, {Type: TokenNull, Text: "null"},
+		}},
+		{"a < = b // comment\n*=1.5e3", []Token{
+			{Type: TokenName, Text: "a"}, {Type: TokenLess, Text: "<"}, {Type: TokenAssignment, Text: "="},
+			{Type: TokenName, Text: "b"}, {Type: TokenMulAssign, Text: "*="}, {Type: TokenNumber, Text: "1.5e3"},
+		}},
+		{`"a\tb" + ` + "`c\\d`", []Token{
+			{Type: TokenString, Text: "a\tb"}, {Type: TokenPlus, Text: "+"}, {Type: TokenString, Text: `c\d`},
+		}},
+		{"a @", []Token{{Type: TokenName, Text: "a"}, {Type: TokenError, Text: "unexpected character '@'"}}},
+		{`"abc`, []Token{{Type: TokenError, Text: "literal not terminated"}}},
+	}
+	for _, test := range tests {
+		var s scanner.Scanner
+		s.Init(strings.NewReader(test.source))
+		l := NewScannerLexer(&s)
+		for k, v := range test.tokens {
+			if r := l.Next(); r.Type != v.Type || r.Text != v.Text {
+				t.Errorf("%q: token %d: expected %#v, got %#v", test.source, k, v, r)
+			}
+		}
+		if v := test.tokens[len(test.tokens)-1]; v.Type != TokenError {
+			if r := l.Next(); r.Type != TokenEOF {
+				t.Errorf("%q: expected EOF, got %#v", test.source, r)
+			}
+		}
+	}
+
+	// Newlines, comments and positions.
+	var s scanner.Scanner
+	s.Init(strings.NewReader("a /* b */\n  c"))
+	s.Mode ^= scanner.SkipComments
+	s.Whitespace ^= 1 << '\n'
+	l := NewScannerLexer(&s)
+	expected := []Token{
+		{Type: TokenName, Text: "a", Pos: Pos{Offset: 0, Line: 1, Col: 1}},
+		{Type: TokenComment, Text: "/* b */", Pos: Pos{Offset: 2, Line: 1, Col: 3}},
+		{Type: TokenNewline, Text: "\n", Pos: Pos{Offset: 9, Line: 1, Col: 10}},
+		{Type: TokenName, Text: "c", Pos: Pos{Offset: 12, Line: 2, Col: 3}},
+		{Type: TokenEOF, Pos: Pos{Offset: 13, Line: 2, Col: 4}},
+	}
+	for k, v := range expected {
+		if r := l.Next(); r != v {
+			t.Errorf("token %d: expected %#v, got %#v", k, v, r)
+		}
+	}
+
+	// The parser reads from it like any other lexer.
+	s.Init(strings.NewReader("f(a, b) * -2"))
+	p := newParser("")
+	p.Stack = NewStack(NewScannerLexer(&s))
+	if n, err := p.Parse(); err != nil || n.String() != "(f(a, b) * (-2))" {
+		t.Errorf("expected (f(a, b) * (-2)), got %v (%v)", n, err)
+	}
+}
+
+func TestSliceLexer(t *testing.T) {
+	tokens := lex("a + b")
+	l := NewSliceLexer(tokens[:len(tokens)-1])
+	for _, expected := range []TokenType{TokenName, TokenPlus, TokenName, TokenEOF, TokenEOF} {
+		if r := l.Next(); r.Type != expected {
+			t.Errorf("expected %s, got %s", expected, r)
+		}
+	}
+
+	// An EOF in the slice is returned again, with its position.
+	l = NewSliceLexer(tokens)
+	p := newParser("")
+	p.Stack = NewStack(l)
+	if n, err := p.Parse(); err != nil || n.String() != "(a + b)" {
+		t.Errorf("expected (a + b), got %v (%v)", n, err)
+	}
+	if r := l.Next(); r != tokens[3] {
+		t.Errorf("expected %#v, got %#v", tokens[3], r)
+	}
+
+	// Tokens after EOF are ignored.
+	l = NewSliceLexer([]Token{{Type: TokenEOF}, {Type: TokenName, Text: "a"}})
+	for i := 0; i < 2; i++ {
+		if r := l.Next(); r.Type != TokenEOF {
+			t.Errorf("expected EOF, got %v", r)
+		}
+	}
+}
+
+// endlessLexer returns names forever.
+type endlessLexer struct{}
+
+func (endlessLexer) Next() Token {
+	return Token{Type: TokenName, Text: "a"}
+}
+
+func TestStackReset(t *testing.T) {
+	s := NewStack(NewStringLexer("a b c # x"))
+	s.Lookbehind = 1
+	s.Mark()
+	s.Pop()
+	s.Peek(3)
+	s.Reset(NewStringLexer("d"))
+	if r := s.Pop(); r.Text != "d" || r.Pos.String() != "1:1" {
+		t.Errorf("expected d at 1:1, got %v at %s", r, r.Pos)
+	}
+	if r := s.Pop(); r.Type != TokenEOF {
+		t.Errorf("expected EOF, got %v", r)
+	}
+	if r, _ := s.Previous(0); r.Text != "d" || len(s.Comments()) != 0 || s.Lookbehind != 1 {
+		t.Errorf("expected a clean stack, got previous %v and comments %v", r, s.Comments())
+	}
+
+	// A reused stack doesn't allocate.
+	l := endlessLexer{}
+	allocs := testing.AllocsPerRun(100, func() {
+		s.Reset(l)
+		for i := 0; i < 8; i++ {
+			s.Peek(i)
+		}
+		for i := 0; i < 8; i++ {
+			s.Pop()
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestChanLexer(t *testing.T) {
+	src := "f(a, b) ?: \"c\" @ 0x1F"
+	for _, buffer := range []int{0, 1, 64} {
+		expected := NewStringLexer(src)
+		l := NewChanLexer(NewStringLexer(src), buffer)
+		for {
+			e, r := expected.Next(), l.Next()
+			if r != e {
+				t.Errorf("buffer %d: expected %#v, got %#v", buffer, e, r)
+				break
+			}
+			if e.Type == TokenEOF {
+				break
+			}
+		}
+		// EOF is returned again.
+		if r := l.Next(); r.Type != TokenEOF || r.Pos.Offset != len(src) {
+			t.Errorf("buffer %d: expected EOF, got %#v", buffer, r)
+		}
+		l.Close()
+	}
+
+	// Close stops a lexer that never ends.
+	l := NewChanLexer(endlessLexer{}, 0)
+	l.Next()
+	l.Close()
+	l.Close()
+	for range l.Tokens() {
+	}
+	if r := l.Next(); r.Type != TokenEOF {
+		t.Errorf("expected EOF after Close, got %v", r)
+	}
+
+	// Tokens can be parsed as they arrive.
+	p := newParser("")
+	p.Stack = NewStack(NewChanLexer(NewStringLexer("a + b * c"), 0))
+	if n, err := p.Parse(); err != nil || n.String() != "(a + (b * c))" {
+		t.Errorf("expected (a + (b * c)), got %v (%v)", n, err)
+	}
+}
+
+func TestStringLexerIndentation(t *testing.T) {
+	tests := []struct {
+		source string
+		tokens string // Token types and names.
+	}{
+		{"a\n  b\n  c\nd", `"a" newline indent "b" newline "c" newline dedent "d" EOF`},
+		{"a\n  b\n    c\n\n  # comment\nd\n", `"a" newline indent "b" newline indent "c" newline newline newline dedent dedent "d" newline EOF`},
+		{"a\n  b\n    c", `"a" newline indent "b" newline indent "c" dedent dedent EOF`},
+		{"a\n\tb /* x\n*/ c\n\td", `"a" newline indent "b" "c" newline "d" dedent EOF`},
+		{"a\n    b\n  c", `"a" newline indent "b" newline dedent inconsistent indentation "c" EOF`},
+		{"  a", `indent "a" dedent EOF`},
+	}
+	for _, test := range tests {
+		for _, reader := range []bool{false, true} {
+			var l Lexer
+			if reader {
+				rl := NewReaderLexer(strings.NewReader(test.source))
+				rl.SignificantNewlines, rl.Indentation = true, true
+				l = rl
+			} else {
+				sl := NewStringLexer(test.source)
+				sl.SignificantNewlines, sl.Indentation = true, true
+				l = sl
+			}
+			var names []string
+			for {
+				tok := l.Next()
+				names = append(names, tok.String())
+				if tok.Type == TokenEOF {
+					break
+				}
+			}
+			if r := strings.Join(names, " "); r != test.tokens {
+				t.Errorf("%q (reader %v): expected %s, got %s", test.source, reader, test.tokens, r)
+			}
+		}
+	}
+
+	// Indent and dedent tokens are at the first token of the line.
+	l := NewStringLexer("a\n  b\nc")
+	l.Indentation = true
+	expected := []Token{
+		{Type: TokenName, Text: "a", Pos: Pos{Offset: 0, Line: 1, Col: 1}},
+		{Type: TokenIndent, Text: "  ", Pos: Pos{Offset: 4, Line: 2, Col: 3}},
+		{Type: TokenName, Text: "b", Pos: Pos{Offset: 4, Line: 2, Col: 3}},
+		{Type: TokenDedent, Pos: Pos{Offset: 6, Line: 3, Col: 1}},
+		{Type: TokenName, Text: "c", Pos: Pos{Offset: 6, Line: 3, Col: 1}},
+		{Type: TokenEOF, Pos: Pos{Offset: 7, Line: 3, Col: 2}},
+	}
+	for k, v := range expected {
+		if r := l.Next(); r != v {
+			t.Errorf("token %d: expected %#v, got %#v", k, v, r)
+		}
+	}
+}
+
+func TestStringLexerMark(t *testing.T) {
+	src := "f(a, b)\n  \"x ${y\n}\"\nz"
+	l := NewStringLexer(src)
+	l.Indentation, l.Interpolation = true, true
+	var all []Token
+	for {
+		tok := l.Next()
+		all = append(all, tok)
+		if tok.Type == TokenEOF {
+			break
+		}
+	}
+	// Rewind from each token to each earlier one.
+	for i := range all {
+		l := NewStringLexer(src)
+		l.Indentation, l.Interpolation = true, true
+		for range all[:i] {
+			l.Next()
+		}
+		m := l.Mark()
+		for j := i; j < len(all); j++ {
+			l.Next()
+		}
+		for n := 0; n < 2; n++ {
+			l.Reset(m)
+			for j := i; j < len(all); j++ {
+				if r := l.Next(); r != all[j] {
+					t.Errorf("mark %d, reset %d: token %d: expected %#v, got %#v", i, n, j, all[j], r)
+				}
+			}
+		}
+	}
+}
+
+func TestStackText(t *testing.T) {
+	s := NewStack(NewStringLexer("if a then b"))
+	if !s.PeekTextIs("if") {
+		t.Errorf("expected next token to be if")
+	}
+	if s.MatchText("then") {
+		t.Errorf("expected MatchText to fail")
+	}
+	if !s.MatchText("if") {
+		t.Errorf("expected MatchText to consume if")
+	}
+	// Buffered lookahead.
+	if r := s.Peek(1).Text; r != "then" {
+		t.Errorf("expected then, got %q", r)
+	}
+	if s.PeekTextIs("then") {
+		t.Errorf("expected next token to be a")
+	}
+	if !s.MatchText("a") || !s.PeekTextIs("then") || !s.MatchText("then") {
+		t.Errorf("expected to match a then")
+	}
+	if !s.MatchText("b") || s.Pop().Type != TokenEOF {
+		t.Errorf("expected b and EOF")
+	}
+}
+
+func TestFilterLexer(t *testing.T) {
+	l := NewStringLexer("a\nand\n\nb")
+	l.SignificantNewlines = true
+	s := NewStack(l)
+	s.Filter(func(t Token) (Token, bool) {
+		return t, t.Type != TokenNewline
+	})
+	s.Filter(func(t Token) (Token, bool) {
+		if t.Type == TokenName && t.Text == "and" {
+			t.Type = TokenAnd
+		}
+		return t, true
+	})
+	p := newParser("")
+	p.Stack = s
+	if n, err := p.Parse(); err != nil || n.String() != "(a && b)" {
+		t.Errorf("expected (a && b), got %v (%v)", n, err)
+	}
+
+	// EOF is never filtered.
+	f := NewFilterLexer(NewStringLexer("a b"), func(t Token) (Token, bool) {
+		return t, false
+	})
+	for i := 0; i < 2; i++ {
+		if r := f.Next(); r.Type != TokenEOF {
+			t.Errorf("expected EOF, got %v", r)
+		}
+	}
+}
+
+func TestStackLookahead(t *testing.T) {
+	s := NewStack(NewStringLexer("a + b"))
+	s.MaxLookahead = 3
+	texts := func(tokens []Token) string {
+		var r []string
+		for _, v := range tokens {
+			r = append(r, v.String())
+		}
+		return strings.Join(r, " ")
+	}
+	if r := texts(s.PeekN(3)); r != `"a" + "b"` {
+		t.Errorf("expected the next 3 tokens, got %s", r)
+	}
+	s.Pop()
+	if r := texts(s.PeekN(3)); r != `+ "b" EOF` {
+		t.Errorf("expected tokens padded with EOF, got %s", r)
+	}
+	if r := s.PeekN(0); len(r) != 0 {
+		t.Errorf("expected no tokens, got %v", r)
+	}
+	func() {
+		defer func() {
+			e, ok := recover().(*ParseError)
+			if !ok || e.Msg != "lookahead of 4 tokens exceeds the limit of 3" || e.Pos.String() != "1:3" {
+				t.Errorf("expected lookahead error at 1:3, got %#v", e)
+			}
+		}()
+		s.Peek(3)
+	}()
+
+	// The default grammar needs one token of lookahead.
+	p := newParser("x = f(a, -b) ? c : d!")
+	p.MaxLookahead = 1
+	if _, err := p.Parse(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestStackTryExpect(t *testing.T) {
+	s := NewStack(NewStringLexer("a (\n@"))
+	if r, err := s.TryExpect(TokenNumber, TokenName); err != nil || r.Text != "a" {
+		t.Errorf("expected a, got %v (%v)", r, err)
+	}
+	_, err := s.TryExpect(TokenParenR)
+	e, ok := err.(*ParseError)
+	if !ok || e.Msg != "expected token [)] and found (" || e.Pos.String() != "1:3" {
+		t.Errorf("expected *ParseError at 1:3, got %#v", err)
+	}
+	// The token was not consumed.
+	s.Expect(TokenParenL)
+	_, err = s.TryExpect(TokenName)
+	if e, ok := err.(*ParseError); !ok || e.Msg != "unexpected character '@'" || e.Pos.String() != "2:1" {
+		t.Errorf("expected lexer error at 2:1, got %#v", err)
+	}
+
+	// Parse returns the error of Expect as it is.
+	_, err = newParser("a ? b ;").Parse()
+	if e, ok := err.(*ParseError); !ok || e.Pos.String() != "1:7" {
+		t.Errorf("expected *ParseError at 1:7, got %#v", err)
+	}
+}
+
+func TestStackPrevious(t *testing.T) {
+	s := NewStack(NewStringLexer("a b c d"))
+	s.Lookbehind = 2
+	if _, ok := s.Previous(0); ok {
+		t.Errorf("expected no previous token before the first Pop")
+	}
+	prev := func(k int) string {
+		r, ok := s.Previous(k)
+		if !ok {
+			return "-"
+		}
+		return r.Text
+	}
+	tests := []struct {
+		op   func()
+		want [3]string
+	}{
+		{func() { s.Pop() }, [3]string{"a", "-", "-"}},
+		{func() { s.Pop() }, [3]string{"b", "a", "-"}},
+		{func() { s.Pop() }, [3]string{"c", "b", "-"}},
+		// Pushing back the last token un-consumes it.
+		{func() { s.Push(s.Pop()) }, [3]string{"c", "b", "-"}},
+		{func() { s.Match(TokenName) }, [3]string{"d", "c", "-"}},
+		// EOF is not recorded.
+		{func() { s.Pop() }, [3]string{"d", "c", "-"}},
+	}
+	for i, test := range tests {
+		test.op()
+		if got := [3]string{prev(0), prev(1), prev(2)}; got != test.want {
+			t.Errorf("%d: expected %v, got %v", i, test.want, got)
+		}
+	}
+
+	// Rewinding restores the consumed tokens.
+	s = NewStack(NewStringLexer("a b c"))
+	s.Lookbehind = 3
+	s.Pop()
+	m := s.Mark()
+	s.Pop()
+	s.Pop()
+	s.Rewind(m)
+	if r, _ := s.Previous(0); r.Text != "a" {
+		t.Errorf("expected a after Rewind, got %v", r)
+	}
+	if _, ok := s.Previous(1); ok {
+		t.Errorf("expected a single previous token after Rewind")
+	}
+}
+
+func TestStackRing(t *testing.T) {
+	// Compare random operations with a slice that holds all the tokens.
+	var src []string
+	for i := 0; i < 200; i++ {
+		src = append(src, fmt.Sprintf("a%d", i))
+	}
+	s := NewStack(NewStringLexer(strings.Join(src, " ")))
+	model := append([]string(nil), src...)
+	rnd := rand.New(rand.NewSource(1))
+	text := func(k int) string {
+		if k < len(model) {
+			return model[k]
+		}
+		return ""
+	}
+	for i := 0; i < 5000 && len(model) > 0; i++ {
+		switch op := rnd.Intn(4); op {
+		case 0:
+			if r := s.Pop(); r.Text != text(0) {
+				t.Fatalf("op %d: Pop: expected %q, got %v", i, text(0), r)
+			}
+			model = model[1:]
+		case 1:
+			k := rnd.Intn(20)
+			if r := s.Peek(k); r.Text != text(k) {
+				t.Fatalf("op %d: Peek(%d): expected %q, got %v", i, k, text(k), r)
+			}
+		case 2:
+			name := fmt.Sprintf("p%d", i)
+			s.Push(Token{Type: TokenName, Text: name})
+			model = append([]string{name}, model...)
+		case 3:
+			// Pop some tokens and push them back, like Peek used to.
+			var popped []string
+			var pushed []Token
+			for n := rnd.Intn(12); n > 0 && len(model) > 0; n-- {
+				t := s.Pop()
+				popped = append(popped, t.Text)
+				pushed = append([]Token{t}, pushed...)
+				model = model[1:]
+			}
+			s.Push(pushed...)
+			model = append(popped, model...)
+		}
+	}
+}
+
+func BenchmarkStackPeek(b *testing.B) {
+	src := strings.Repeat("a + ", 1000)
+	for i := 0; i < b.N; i++ {
+		s := NewStack(NewStringLexer(src))
+		for s.Pop().Type != TokenEOF {
+			s.Peek(0)
+			s.Peek(3)
+		}
+	}
+}
+
+// countingLexer returns the tokens of a StringLexer, counting the calls to
+// Next.
+type countingLexer struct {
+	*StringLexer
+	calls int
+}
+
+func (l *countingLexer) Next() Token {
+	l.calls++
+	return l.StringLexer.Next()
+}
+
+func TestStackEOF(t *testing.T) {
+	l := &countingLexer{StringLexer: NewStringLexer("a")}
+	s := NewStack(l)
+	if r := s.Pop(); r.Text != "a" {
+		t.Fatalf("expected a, got %v", r)
+	}
+	eof := s.Pop()
+	for i := 0; i < 100; i++ {
+		if r := s.Pop(); r != eof {
+			t.Fatalf("Pop %d: expected %v, got %v", i, eof, r)
+		}
+		if s.Match(TokenParenR) || s.Peek(0) != eof || s.Peek(3) != eof {
+			t.Fatalf("expected only EOF")
+		}
+	}
+	if len(s.buf) != 0 || s.count != 0 {
+		t.Errorf("expected empty buffer, got %v", s.Remaining())
+	}
+	if l.calls != 2 || s.read != 2 {
+		t.Errorf("expected 2 calls to Next, got %d", l.calls)
+	}
+
+	// Tokens pushed back before EOF are still returned first.
+	s.Push(Token{Type: TokenName, Text: "b"})
+	if r := s.Peek(1); r != eof {
+		t.Errorf("expected EOF, got %v", r)
+	}
+	if r := s.Pop(); r.Text != "b" || s.Pop() != eof || s.count != 0 {
+		t.Errorf("expected b and EOF")
+	}
+}
+
+func TestStringLexerMaximalMunch(t *testing.T) {
+	tests := map[string]string{
+		"a<=b":   "a <= b",
+		"a<b":    "a < b",
+		"a< =b":  "a < = b",
+		"a&&b":   "a && b",
+		"a&b":    "a & b",
+		"a&&&b":  "a && & b",
+		"a||b|c": "a || b | c",
+		"a==b=c": "a == b = c",
+		"a++":    "a ++",
+		"a+b":    "a + b",
+		"a + +b": "a + + b",
+		"a+ +b":  "a + + b",
+		"-a--":   "- a --",
+		"a>>=b":  "a >> = b",
+		"!!=a":   "! != a",
+		"a+=b":   "a += b",
+		"a++=b":  "a ++ = b",
+		"a/=*=b": "a /= *= b",
+		"a**b":   "a ** b",
+		"a***b":  "a ** * b",
+		"a**=b":  "a ** = b",
+		"a* *b":  "a * * b",
+	}
+	for src, expected := range tests {
+		var texts []string
+		for _, v := range lex(src) {
+			if v.Type == TokenEOF {
+				break
+			}
+			texts = append(texts, v.Text)
+		}
+		if r := strings.Join(texts, " "); r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+	}
+}
@@ -7,17 +7,34 @@ package bantam
 import (
 	"bytes"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 // Node is the basic interface for expression nodes.
+//
+// Position returns the position of the token that created the node, like
+// the operator in a binary expression. Nodes can embed a Pos to implement
+// it; nodes built outside of the parser have an unknown position.
 type Node interface {
 	String() string
+	Position() Pos
+}
+
+// Stmt is a statement of a program, returned by ParseProgram. Statements
+// are nodes; the marker method keeps expressions from being used where a
+// statement is expected. It is exported so that statements can be defined
+// outside of this package, to be returned by a StmtParser.
+type Stmt interface {
+	Node
+	StmtNode()
 }
 
 // ----------------------------------------------------------------------------
 
 // AssignNode represents an assignment expression like "a = b".
 type AssignNode struct {
+	Pos
 	Name  string
 	Right Node
 }
@@ -34,8 +51,10 @@ func (n *AssignNode) String() string {
 
 // BinaryNode represents a binary arithmetic expression like "a + b".
 type BinaryNode struct {
+	Pos
 	Left     Node
 	Operator TokenType
+	Word     string // Operator text for word operators like "and".
 	Right    Node
 }
 
@@ -44,13 +63,54 @@ func NewBinaryNode(left Node, operator TokenType, right Node) *BinaryNode {
 }
 
 func (n *BinaryNode) String() string {
-	return fmt.Sprintf("(%s %s %s)", n.Left, n.Operator, n.Right)
+	return fmt.Sprintf("(%s %s %s)", n.Left, operator(n.Operator, n.Word), n.Right)
+}
+
+// ----------------------------------------------------------------------------
+
+// BracketNode represents an expression enclosed by a pair of tokens other
+// than parentheses, like "|a|".
+type BracketNode struct {
+	Pos
+	Open  TokenType
+	Inner Node
+	Close TokenType
+}
+
+func NewBracketNode(open TokenType, inner Node, close TokenType) *BracketNode {
+	return &BracketNode{Open: open, Inner: inner, Close: close}
+}
+
+func (n *BracketNode) String() string {
+	return fmt.Sprintf("%s%s%s", n.Open, n.Inner, n.Close)
+}
+
+// ----------------------------------------------------------------------------
+
+// BlockNode represents a block of expressions like "{a = 1; a + 1}", whose
+// value is the last expression.
+type BlockNode struct {
+	Pos
+	Exprs []Node
+}
+
+func NewBlockNode(exprs ...Node) *BlockNode {
+	return &BlockNode{Exprs: exprs}
+}
+
+func (n *BlockNode) String() string {
+	s := make([]string, len(n.Exprs))
+	for k, v := range n.Exprs {
+		s[k] = v.String()
+	}
+	return "{" + strings.Join(s, "; ") + "}"
 }
 
 // ----------------------------------------------------------------------------
 
 // FunctionNode represents a function call like "a(b, c, d)".
 type FunctionNode struct {
+	Pos
 	Function Node
 	Args     *ListNode
 }
@@ -72,8 +132,50 @@ func (n *FunctionNode) String() string {
 
 // ----------------------------------------------------------------------------
 
+// IfNode represents a conditional like "if (a) b else c". Else is nil if
+// there is no else branch. It is also a statement.
+type IfNode struct {
+	Pos
+	Cond Node
+	Then Node
+	Else Node
+}
+
+func NewIfNode(cond, then, els Node) *IfNode {
+	return &IfNode{Cond: cond, Then: then, Else: els}
+}
+
+func (n *IfNode) String() string {
+	if n.Else == nil {
+		return fmt.Sprintf("(if (%s) %s)", n.Cond, n.Then)
+	}
+	return fmt.Sprintf("(if (%s) %s else %s)", n.Cond, n.Then, n.Else)
+}
+
+func (n *IfNode) StmtNode() {}
+
+// ----------------------------------------------------------------------------
+
+// LambdaNode represents an anonymous function like "fn(a, b) a + b".
+type LambdaNode struct {
+	Pos
+	Params []string
+	Body   Node
+}
+
+func NewLambdaNode(params []string, body Node) *LambdaNode {
+	return &LambdaNode{Params: params, Body: body}
+}
+
+func (n *LambdaNode) String() string {
+	return fmt.Sprintf("fn(%s) %s", strings.Join(n.Params, ", "), n.Body)
+}
+
+// ----------------------------------------------------------------------------
+
 // ListNode holds a sequence of nodes.
 type ListNode struct {
+	Pos
 	Nodes []Node // The element nodes in lexical order.
 }
 
@@ -96,7 +198,7 @@ func (n *ListNode) String() string {
 func listNode(n Node) *ListNode {
 	list, ok := n.(*ListNode)
 	if !ok {
-		list = &ListNode{}
+		list = &ListNode{Pos: n.Position()}
 		list.Append(n)
 	}
 	return list
@@ -104,8 +206,54 @@ func listNode(n Node) *ListNode {
 
 // ----------------------------------------------------------------------------
 
+// MixfixNode represents an operator made of several tokens, like
+// "a between b and c", parsed by a MixfixParser. Prefix is true if the
+// first operator comes before the first operand, like in "|a|".
+type MixfixNode struct {
+	Pos
+	Operators []Token
+	Operands  []Node
+	Prefix    bool
+}
+
+func NewMixfixNode(operators ...Token) *MixfixNode {
+	return &MixfixNode{Operators: operators}
+}
+
+func (n *MixfixNode) String() string {
+	var s []string
+	n.each(func(op Token, operand Node) {
+		if operand != nil {
+			s = append(s, operand.String())
+		} else {
+			s = append(s, operator(op.Type, word(op)))
+		}
+	})
+	return "(" + strings.Join(s, " ") + ")"
+}
+
+// each calls fn with the operators and operands in source order, one per
+// call, the other argument being nil for operands or the zero Token for
+// operators.
+func (n *MixfixNode) each(fn func(Token, Node)) {
+	ops, operands := n.Operators, n.Operands
+	if !n.Prefix && len(operands) > 0 {
+		fn(Token{}, operands[0])
+		operands = operands[1:]
+	}
+	for k, op := range ops {
+		fn(op, nil)
+		if k < len(operands) {
+			fn(Token{}, operands[k])
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
 // NameNode represents a simple variable name expression like "abc".
 type NameNode struct {
+	Pos
 	Name string
 }
 
@@ -119,8 +267,136 @@ func (n *NameNode) String() string {
 
 // ----------------------------------------------------------------------------
 
+// Null is the only NullNode. Being shared, it has no position.
+var Null = &NullNode{}
+
+// NullNode represents the null literal.
+type NullNode struct{}
+
+func (n *NullNode) String() string {
+	return "null"
+}
+
+func (n *NullNode) Position() Pos {
+	return Pos{}
+}
+
+// ----------------------------------------------------------------------------
+
+// NumberNode represents a number literal like "42" or "1.5".
+type NumberNode struct {
+	Pos
+	Value float64
+	Text  string // Source text, like "0xFF"; empty for computed numbers.
+}
+
+func NewNumberNode(value float64) *NumberNode {
+	return &NumberNode{Value: value}
+}
+
+// String returns the source text of the number if it is known, or the
+// shortest representation of its value otherwise.
+func (n *NumberNode) String() string {
+	if n.Text != "" {
+		return n.Text
+	}
+	return strconv.FormatFloat(n.Value, 'g', -1, 64)
+}
+
+// ----------------------------------------------------------------------------
+
+// SequenceNode represents a comma expression like "a, b".
+type SequenceNode struct {
+	Pos
+	First  Node
+	Second Node
+}
+
+func NewSequenceNode(first, second Node) *SequenceNode {
+	return &SequenceNode{First: first, Second: second}
+}
+
+func (n *SequenceNode) String() string {
+	return fmt.Sprintf("(%s, %s)", n.First, n.Second)
+}
+
+// ----------------------------------------------------------------------------
+
+// InterpolationNode represents an interpolated string like "a ${b} c".
+// Parts holds the string parts around the expressions, so it always has one
+// more element than Exprs: "a " and " c" in the example.
+type InterpolationNode struct {
+	Pos
+	Parts []string
+	Exprs []Node
+}
+
+func NewInterpolationNode(first string) *InterpolationNode {
+	return &InterpolationNode{Parts: []string{first}}
+}
+
+func (n *InterpolationNode) String() string {
+	b := new(bytes.Buffer)
+	b.WriteByte('"')
+	for k, v := range n.Exprs {
+		writeStringPart(b, n.Parts[k], true)
+		fmt.Fprintf(b, "${%s}", v)
+	}
+	writeStringPart(b, n.Parts[len(n.Parts)-1], true)
+	b.WriteByte('"')
+	return b.String()
+}
+
+// ----------------------------------------------------------------------------
+
+// StringNode represents a string literal like "abc".
+type StringNode struct {
+	Pos
+	Value string
+}
+
+func NewStringNode(value string) *StringNode {
+	return &StringNode{Value: value}
+}
+
+// String returns the value in double quotes, escaping the characters that
+// the lexer reads as escape sequences.
+func (n *StringNode) String() string {
+	b := new(bytes.Buffer)
+	b.WriteByte('"')
+	writeStringPart(b, n.Value, false)
+	b.WriteByte('"')
+	return b.String()
+}
+
+// writeStringPart writes s escaping the characters that the lexer reads as
+// escape sequences, and "${" if interpolation is set.
+func writeStringPart(b *bytes.Buffer, s string, interpolation bool) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '$':
+			if interpolation && strings.HasPrefix(s[i:], "${") {
+				b.WriteByte('\\')
+			}
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// ----------------------------------------------------------------------------
+
 // TernaryNode represents a ternary expression like "a ? b : c".
 type TernaryNode struct {
+	Pos
 	Condition Node
 	List      *ListNode
 	ElseList  *ListNode
@@ -136,9 +412,42 @@ func (n *TernaryNode) String() string {
 
 // ----------------------------------------------------------------------------
 
+// ElvisNode represents a ternary expression without a middle operand, like
+// "a ?: b", which is a shorthand for "a ? a : b" that evaluates a only once.
+type ElvisNode struct {
+	Pos
+	Left  Node
+	Right Node
+}
+
+func NewElvisNode(left, right Node) *ElvisNode {
+	return &ElvisNode{Left: left, Right: right}
+}
+
+func (n *ElvisNode) String() string {
+	return fmt.Sprintf("(%s ?: %s)", n.Left, n.Right)
+}
+
+// ----------------------------------------------------------------------------
+
+// ErrorNode stands for an expression that could not be parsed, in the
+// trees returned by ParseRecover.
+type ErrorNode struct {
+	Pos
+	Err *ParseError
+}
+
+func (n *ErrorNode) String() string {
+	return "<error>"
+}
+
+// ----------------------------------------------------------------------------
+
 // UnaryNode represents a prefix unary arithmetic expression like "!a" or "-b".
 type UnaryNode struct {
+	Pos
 	Operator TokenType
+	Word     string // Operator text for word operators like "not".
 	Right    Node
 }
 
@@ -147,6 +456,9 @@ func NewUnaryNode(operator TokenType, right Node) *UnaryNode {
 }
 
 func (n *UnaryNode) String() string {
+	if n.Word != "" {
+		return fmt.Sprintf("(%s %s)", n.Word, n.Right)
+	}
 	return fmt.Sprintf("(%s%s)", n.Operator, n.Right)
 }
 
@@ -154,8 +466,10 @@ func (n *UnaryNode) String() string {
 
 // UnaryPostfixNode represents a postfix unary arithmetic expression like "a++".
 type UnaryPostfixNode struct {
+	Pos
 	Left     Node
 	Operator TokenType
+	Word     string // Operator text for word operators.
 }
 
 func NewUnaryPostfixNode(left Node, operator TokenType) *UnaryPostfixNode {
@@ -163,5 +477,77 @@ func NewUnaryPostfixNode(left Node, operator TokenType) *UnaryPostfixNode {
 }
 
 func (n *UnaryPostfixNode) String() string {
+	if n.Word != "" {
+		return fmt.Sprintf("(%s %s)", n.Left, n.Word)
+	}
 	return fmt.Sprintf("(%s%s)", n.Left, n.Operator)
 }
+
+// ----------------------------------------------------------------------------
+
+// ProgramNode represents a program made of statements separated by
+// semicolons, like "a = 1; f(a)".
+type ProgramNode struct {
+	Pos
+	Stmts []Stmt
+}
+
+func NewProgramNode(stmts ...Stmt) *ProgramNode {
+	return &ProgramNode{Stmts: stmts}
+}
+
+func (n *ProgramNode) String() string {
+	s := make([]string, len(n.Stmts))
+	for k, v := range n.Stmts {
+		s[k] = v.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+// ----------------------------------------------------------------------------
+
+// ExprStmt is a statement made of an expression.
+type ExprStmt struct {
+	Pos
+	X Node
+}
+
+func NewExprStmt(x Node) *ExprStmt {
+	return &ExprStmt{X: x}
+}
+
+func (n *ExprStmt) String() string {
+	return n.X.String()
+}
+
+func (n *ExprStmt) StmtNode() {}
+
+// ----------------------------------------------------------------------------
+
+// WhileNode represents a loop like "while (a) b". It is also a statement.
+type WhileNode struct {
+	Pos
+	Cond Node
+	Body Node
+}
+
+func NewWhileNode(cond, body Node) *WhileNode {
+	return &WhileNode{Cond: cond, Body: body}
+}
+
+func (n *WhileNode) String() string {
+	return fmt.Sprintf("(while (%s) %s)", n.Cond, n.Body)
+}
+
+func (n *WhileNode) StmtNode() {}
+
+// ----------------------------------------------------------------------------
+
+// operator returns the text used to print an operator: the word for word
+// operators, or the token type name otherwise.
+func operator(t TokenType, word string) string {
+	if word != "" {
+		return word
+	}
+	return t.String()
+}
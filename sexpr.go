@@ -0,0 +1,151 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// ToSExpr returns a Lisp-style representation of the given node.
+//
+// Operators are written in prefix position, so "a + b * c" becomes
+// "(+ a (* b c))". Assignments are written as "(= a b)", ternary expressions
+// as "(if a b c)", function calls as "(call f a b)", sequences as
+// "(seq a b)" and lambdas as "(lambda (a b) body)". Postfix operators are
+// written as "(postfix ! a)" to set them apart from prefix ones, and
+// brackets like "|a|" as "(bracket (| |) a)".
+func ToSExpr(n Node) string {
+	b := new(bytes.Buffer)
+	writeSExpr(b, n)
+	return b.String()
+}
+
+// writeSExpr writes the s-expression for the given node to b.
+func writeSExpr(b *bytes.Buffer, n Node) {
+	switch n := n.(type) {
+	case *AssignNode:
+		fmt.Fprintf(b, "(%s %s ", TokenAssignment, n.Name)
+		writeSExpr(b, n.Right)
+		b.WriteString(")")
+	case *BinaryNode:
+		fmt.Fprintf(b, "(%s ", operator(n.Operator, n.Word))
+		writeSExpr(b, n.Left)
+		b.WriteString(" ")
+		writeSExpr(b, n.Right)
+		b.WriteString(")")
+	case *BlockNode:
+		b.WriteString("(block")
+		for _, v := range n.Exprs {
+			b.WriteString(" ")
+			writeSExpr(b, v)
+		}
+		b.WriteString(")")
+	case *BracketNode:
+		fmt.Fprintf(b, "(bracket (%s %s) ", n.Open, n.Close)
+		writeSExpr(b, n.Inner)
+		b.WriteString(")")
+	case *ElvisNode:
+		fmt.Fprintf(b, "(%s ", TokenElvis)
+		writeSExpr(b, n.Left)
+		b.WriteString(" ")
+		writeSExpr(b, n.Right)
+		b.WriteString(")")
+	case *ExprStmt:
+		writeSExpr(b, n.X)
+	case *FunctionNode:
+		b.WriteString("(call ")
+		writeSExpr(b, n.Function)
+		for _, v := range n.Args.Nodes {
+			b.WriteString(" ")
+			writeSExpr(b, v)
+		}
+		b.WriteString(")")
+	case *IfNode:
+		b.WriteString("(if ")
+		writeSExpr(b, n.Cond)
+		b.WriteString(" ")
+		writeSExpr(b, n.Then)
+		if n.Else != nil {
+			b.WriteString(" ")
+			writeSExpr(b, n.Else)
+		}
+		b.WriteString(")")
+	case *InterpolationNode:
+		b.WriteString("(interp")
+		for k, v := range n.Parts {
+			fmt.Fprintf(b, " %s", NewStringNode(v))
+			if k < len(n.Exprs) {
+				b.WriteString(" ")
+				writeSExpr(b, n.Exprs[k])
+			}
+		}
+		b.WriteString(")")
+	case *LambdaNode:
+		fmt.Fprintf(b, "(lambda (%s) ", strings.Join(n.Params, " "))
+		writeSExpr(b, n.Body)
+		b.WriteString(")")
+	case *ListNode:
+		if len(n.Nodes) == 1 {
+			writeSExpr(b, n.Nodes[0])
+			return
+		}
+		b.WriteString("(list")
+		for _, v := range n.Nodes {
+			b.WriteString(" ")
+			writeSExpr(b, v)
+		}
+		b.WriteString(")")
+	case *MixfixNode:
+		words := make([]string, len(n.Operators))
+		for k, v := range n.Operators {
+			words[k] = operator(v.Type, word(v))
+		}
+		fmt.Fprintf(b, "(mixfix (%s)", strings.Join(words, " "))
+		for _, v := range n.Operands {
+			b.WriteString(" ")
+			writeSExpr(b, v)
+		}
+		b.WriteString(")")
+	case *ProgramNode:
+		b.WriteString("(program")
+		for _, v := range n.Stmts {
+			b.WriteString(" ")
+			writeSExpr(b, v)
+		}
+		b.WriteString(")")
+	case *SequenceNode:
+		b.WriteString("(seq ")
+		writeSExpr(b, n.First)
+		b.WriteString(" ")
+		writeSExpr(b, n.Second)
+		b.WriteString(")")
+	case *TernaryNode:
+		b.WriteString("(if ")
+		writeSExpr(b, n.Condition)
+		b.WriteString(" ")
+		writeSExpr(b, n.List)
+		b.WriteString(" ")
+		writeSExpr(b, n.ElseList)
+		b.WriteString(")")
+	case *UnaryNode:
+		fmt.Fprintf(b, "(%s ", operator(n.Operator, n.Word))
+		writeSExpr(b, n.Right)
+		b.WriteString(")")
+	case *UnaryPostfixNode:
+		fmt.Fprintf(b, "(postfix %s ", operator(n.Operator, n.Word))
+		writeSExpr(b, n.Left)
+		b.WriteString(")")
+	case *WhileNode:
+		b.WriteString("(while ")
+		writeSExpr(b, n.Cond)
+		b.WriteString(" ")
+		writeSExpr(b, n.Body)
+		b.WriteString(")")
+	default:
+		b.WriteString(n.String())
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"testing"
+)
+
+func TestToSExpr(t *testing.T) {
+	tests := []struct {
+		source string
+		result string
+	}{
+		// Binary.
+		{"a + b * c", "(+ a (* b c))"},
+		{"a ^ b ^ c", "(^ a (^ b c))"},
+		{"a = b", "(= a b)"},
+		// Unary.
+		{"-a", "(- a)"},
+		{"~!a", "(~ (! a))"},
+		{"a!", "(postfix ! a)"},
+		// Ternary.
+		{"a ? b : c", "(if a b c)"},
+		{"a ? b : c ? d : e", "(if a b (if c d e))"},
+		// Function call.
+		{"f()", "(call f)"},
+		{"f(a, b)", "(call f a b)"},
+		{"f(a + b)(c)", "(call (call f (+ a b)) c)"},
+		// Sequence.
+		{"a, b", "(seq a b)"},
+	}
+
+	for _, test := range tests {
+		l := &lexer{src: test.source}
+		p := &Parser{Stack: &Stack{lexer: l}, PrefixParsers: PrefixParsers, InfixParsers: InfixParsers}
+		n, err := p.Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		if r := ToSExpr(n); r != test.result {
+			t.Errorf("%q: expected %q, got %q", test.source, test.result, r)
+		}
+	}
+
+	// Brackets.
+	p := newParser("|a + b| * 2").Clone()
+	p.PrefixParsers[TokenPipe] = BracketParser{Open: TokenPipe, Close: TokenPipe}
+	n, err := p.Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	if r := ToSExpr(n); r != "(* (bracket (| |) (+ a b)) 2)" {
+		t.Errorf("expected %q, got %q", "(* (bracket (| |) (+ a b)) 2)", r)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"math"
+)
+
+// Simplify returns a simplified version of an arithmetic expression.
+//
+// It folds operations on number literals, like "2 * 3", and applies basic
+// identities like "x + 0", "x * 1", "x * 0" and "x ^ 1". Equal operands
+// are combined, so "x + x" becomes "2 * x". Nodes it doesn't know about are
+// returned unchanged. The given tree is not modified.
+func Simplify(n Node) Node {
+	switch n := n.(type) {
+	case *BinaryNode:
+		return simplifyBinary(n, Simplify(n.Left), Simplify(n.Right))
+	case *UnaryNode:
+		right := Simplify(n.Right)
+		switch n.Operator {
+		case TokenPlus:
+			return right
+		case TokenMinus:
+			if v, ok := number(right); ok {
+				return NewNumberNode(-v)
+			}
+			if u, ok := right.(*UnaryNode); ok && u.Operator == TokenMinus {
+				return u.Right
+			}
+		}
+		u := NewUnaryNode(n.Operator, right)
+		u.Pos, u.Word = n.Pos, n.Word
+		return u
+	case *FunctionNode:
+		args := NewListNode()
+		for _, v := range n.Args.Nodes {
+			args.Append(Simplify(v))
+		}
+		f := NewFunctionNode(Simplify(n.Function), args)
+		f.Pos = n.Pos
+		return f
+	}
+	return n
+}
+
+// simplifyBinary simplifies a binary expression with simplified operands.
+// The position and word of n are kept if the node is rebuilt.
+func simplifyBinary(n *BinaryNode, left, right Node) Node {
+	op := n.Operator
+	l, lok := number(left)
+	r, rok := number(right)
+	if lok && rok {
+		switch op {
+		case TokenPlus:
+			return NewNumberNode(l + r)
+		case TokenMinus:
+			return NewNumberNode(l - r)
+		case TokenAsterisk:
+			return NewNumberNode(l * r)
+		case TokenSlash:
+			if r != 0 {
+				return NewNumberNode(l / r)
+			}
+		case TokenCaret:
+			return NewNumberNode(math.Pow(l, r))
+		}
+	}
+	switch op {
+	case TokenPlus:
+		switch {
+		case lok && l == 0:
+			return right
+		case rok && r == 0:
+			return left
+		case left.String() == right.String():
+			return NewBinaryNode(NewNumberNode(2), TokenAsterisk, left)
+		}
+	case TokenMinus:
+		switch {
+		case rok && r == 0:
+			return left
+		case lok && l == 0:
+			return Simplify(NewUnaryNode(TokenMinus, right))
+		case left.String() == right.String():
+			return NewNumberNode(0)
+		}
+	case TokenAsterisk:
+		switch {
+		case lok && l == 0, rok && r == 0:
+			return NewNumberNode(0)
+		case lok && l == 1:
+			return right
+		case rok && r == 1:
+			return left
+		}
+	case TokenSlash:
+		switch {
+		case rok && r == 1:
+			return left
+		case lok && l == 0 && !(rok && r == 0):
+			return NewNumberNode(0)
+		}
+	case TokenCaret:
+		switch {
+		case rok && r == 0:
+			return NewNumberNode(1)
+		case rok && r == 1:
+			return left
+		}
+	}
+	b := NewBinaryNode(left, op, right)
+	b.Pos, b.Word = n.Pos, n.Word
+	return b
+}
+
+// number returns the value of a number literal.
+func number(n Node) (float64, bool) {
+	if num, ok := n.(*NumberNode); ok {
+		return num.Value, true
+	}
+	return 0, false
+}
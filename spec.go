@@ -0,0 +1,165 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"regexp"
+	"strings"
+)
+
+// NumberFormat is a set of flags for the number literals a LexerSpec
+// accepts. Decimal integers like "42" are always accepted.
+type NumberFormat int
+
+const (
+	NumberFraction NumberFormat = 1 << iota // Fractions like "1.5".
+	NumberExponent                          // Exponents like "1e3" or "1.5e-3".
+	NumberHex                               // Hexadecimal integers like "0xFF".
+)
+
+// LexerSpec declares the tokens of a language, so that BuildLexer can
+// return a lexer for it instead of one being written by hand for each
+// grammar. The lexer works like StringLexer, with its tables replaced by
+// the ones in the spec:
+//
+//	spec := &LexerSpec{
+//		Symbols:      map[string]TokenType{"+": TokenPlus, "==": TokenEqual},
+//		Keywords:     map[string]TokenType{"and": TokenAnd},
+//		LineComments: []string{"--"},
+//	}
+//	l := BuildLexer(spec, "a + 1 == b -- comment")
+type LexerSpec struct {
+	// Symbols maps operators and punctuation to token types. The lexer
+	// reads the longest symbol that matches the input.
+	Symbols map[string]TokenType
+	// Keywords maps names to token types. Other names are TokenName.
+	Keywords map[string]TokenType
+	// NameStart and NamePart report whether a rune can start a name and
+	// whether it can appear after the first rune. If nil, names are made
+	// of Unicode letters, digits and underscores and can't start with a
+	// digit, like in StringLexer.
+	NameStart func(rune) bool
+	NamePart  func(rune) bool
+	// Numbers sets the accepted number literals, besides decimal integers.
+	Numbers NumberFormat
+	// Strings enables double-quoted strings with escape sequences, like in
+	// StringLexer.
+	Strings bool
+	// LineComments lists the prefixes of comments that run until the end
+	// of the line, like "#" or "//".
+	LineComments []string
+	// BlockComment holds the start and end of comments that may span
+	// lines, like "/*" and "*/". Leave it empty for none.
+	BlockComment [2]string
+	patterns     []pattern
+	matcher      *patternMatcher // Compiled patterns, or nil.
+}
+
+// pattern is a token type defined by a regular expression.
+type pattern struct {
+	typ  TokenType
+	expr string
+}
+
+// AddPattern defines tokens of type t as the text matched by the regular
+// expression expr, in the syntax of the regexp package, for quick
+// prototyping of grammars:
+//
+//	spec.AddPattern(TokenNumber, `[0-9]+(\.[0-9]+)?`)
+//
+// At each position the lexer reads the longest text matched by a pattern;
+// if several patterns match the same length, the one added first wins.
+// Patterns are preferred to the other rules of the spec, unless those read
+// a longer token. An error is returned if expr is not a valid regular
+// expression.
+func (s *LexerSpec) AddPattern(t TokenType, expr string) error {
+	if _, err := regexp.Compile(expr); err != nil {
+		return err
+	}
+	s.patterns = append(s.patterns, pattern{typ: t, expr: expr})
+	s.matcher = nil
+	return nil
+}
+
+// patternMatcher matches all the patterns of a spec with one regular
+// expression, made of a group for each pattern.
+type patternMatcher struct {
+	re     *regexp.Regexp
+	groups []int       // Index of the group of each pattern.
+	types  []TokenType // Token type of each pattern.
+}
+
+// compilePatterns returns a matcher for the given patterns.
+func compilePatterns(patterns []pattern) *patternMatcher {
+	m := &patternMatcher{}
+	exprs := make([]string, len(patterns))
+	group := 1
+	for k, v := range patterns {
+		exprs[k] = "(" + v.expr + ")"
+		m.groups = append(m.groups, group)
+		m.types = append(m.types, v.typ)
+		// The patterns were checked by AddPattern.
+		group += regexp.MustCompile(v.expr).NumSubexp() + 1
+	}
+	m.re = regexp.MustCompile(`^(?:` + strings.Join(exprs, "|") + `)`)
+	m.re.Longest()
+	return m
+}
+
+// match returns the token type and length of the longest match at the start
+// of src, or a zero length if no pattern matches.
+func (m *patternMatcher) match(src string) (TokenType, int) {
+	loc := m.re.FindStringSubmatchIndex(src)
+	if loc == nil {
+		return 0, 0
+	}
+	for k, g := range m.groups {
+		if loc[2*g] >= 0 {
+			return m.types[k], loc[1]
+		}
+	}
+	return 0, 0
+}
+
+// BuildLexer returns a lexer for src with the tokens declared in spec.
+// Later changes to spec don't affect the lexer. The patterns of the spec
+// are compiled once and shared by the lexers built from it.
+func BuildLexer(spec *LexerSpec, src string) *StringLexer {
+	return &StringLexer{syntax: spec.syntax(), src: src}
+}
+
+// syntax returns the lexer tables for the spec.
+func (s *LexerSpec) syntax() *syntax {
+	syn := &syntax{
+		symbols:      make(map[string]TokenType, len(s.Symbols)),
+		keywords:     make(map[string]TokenType, len(s.Keywords)),
+		nameStart:    s.NameStart,
+		namePart:     s.NamePart,
+		numbers:      s.Numbers,
+		strings:      s.Strings,
+		lineComments: append([]string(nil), s.LineComments...),
+		blockComment: s.BlockComment,
+	}
+	if len(s.patterns) > 0 {
+		if s.matcher == nil {
+			s.matcher = compilePatterns(s.patterns)
+		}
+		syn.patterns = s.matcher
+	}
+	for k, v := range s.Symbols {
+		syn.symbols[k] = v
+	}
+	for k, v := range s.Keywords {
+		syn.keywords[k] = v
+	}
+	syn.maxSymbolLen = maxLen(syn.symbols)
+	if syn.nameStart == nil {
+		syn.nameStart = isLetter
+	}
+	if syn.namePart == nil {
+		syn.namePart = isNamePart
+	}
+	return syn
+}
@@ -0,0 +1,135 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func TestBuildLexer(t *testing.T) {
+	spec := &LexerSpec{
+		Symbols:      map[string]TokenType{"+": TokenPlus, "=": TokenAssignment, "==": TokenEqual, "(": TokenParenL, ")": TokenParenR},
+		Keywords:     map[string]TokenType{"and": TokenAnd},
+		NameStart:    unicode.IsLower,
+		NamePart:     func(r rune) bool { return unicode.IsLower(r) || r == '-' },
+		Numbers:      NumberFraction,
+		LineComments: []string{"--"},
+		BlockComment: [2]string{"{-", "-}"},
+	}
+	tests := []struct {
+		source string
+		tokens string // Token texts, or the error message last.
+	}{
+		{"a == b and c", "a == b and c"},
+		{"kebab-case + 1.5", "kebab-case + 1.5"},
+		{"f(x) -- comment\n+ 2 {- block\n -} = y", "f ( x ) + 2 = y"},
+		{"1e3", "1 e 3"},
+		{"0x1", "0 x 1"},
+		{"a * b", "a unexpected character '*'"},
+		{"A", "unexpected character 'A'"},
+		{`"s"`, `unexpected character '"'`},
+		{"{- a", "unterminated comment"},
+		{"fn # b", "fn unexpected character '#'"},
+	}
+	for _, test := range tests {
+		l := BuildLexer(spec, test.source)
+		var texts []string
+		for {
+			tok := l.Next()
+			if tok.Type == TokenEOF {
+				break
+			}
+			texts = append(texts, tok.Text)
+			if tok.Type == TokenError {
+				break
+			}
+		}
+		if r := strings.Join(texts, " "); r != test.tokens {
+			t.Errorf("%q: expected %q, got %q", test.source, test.tokens, r)
+		}
+	}
+
+	// Keywords get their token types, and the spec is copied.
+	l := BuildLexer(spec, "and x")
+	spec.Keywords["x"] = TokenNull
+	for _, expected := range []TokenType{TokenAnd, TokenName, TokenEOF} {
+		if r := l.Next(); r.Type != expected {
+			t.Errorf("expected %s, got %s", expected, r.Type)
+		}
+	}
+
+	// A built lexer feeds the parser like any other.
+	l = BuildLexer(&LexerSpec{
+		Symbols: map[string]TokenType{"+": TokenPlus, "*": TokenAsterisk},
+		Strings: true,
+	}, `a + "b" * 2`)
+	p := newParser("")
+	p.Stack = NewStack(l)
+	if n, err := p.Parse(); err != nil || n.String() != `(a + ("b" * 2))` {
+		t.Errorf(`expected (a + ("b" * 2)), got %v (%v)`, n, err)
+	}
+}
+
+func TestAddPattern(t *testing.T) {
+	const tokenDate TokenType = 1002
+	spec := &LexerSpec{
+		Symbols: map[string]TokenType{"+": TokenPlus, "-": TokenMinus},
+	}
+	for _, p := range []struct {
+		t    TokenType
+		expr string
+	}{
+		{TokenNumber, `[0-9]+(\.[0-9]+)?`},
+		{tokenDate, `[0-9]{4}-[0-9]{2}-[0-9]{2}`},
+		{TokenString, `'[^']*'`},
+		{TokenName, `[0-9]+`}, // Never wins: TokenNumber is first.
+	} {
+		if err := spec.AddPattern(p.t, p.expr); err != nil {
+			t.Fatalf("%q: %v", p.expr, err)
+		}
+	}
+	if err := spec.AddPattern(TokenName, `(`); err == nil {
+		t.Errorf("expected error for invalid pattern")
+	}
+	tests := []struct {
+		source string
+		tokens []Token
+	}{
+		{"1.5 + 2", []Token{{Type: TokenNumber, Text: "1.5"}, {Type: TokenPlus, Text: "+"}, {Type: TokenNumber, Text: "2"}}},
+		{"2024-01-31 - 1", []Token{{Type: tokenDate, Text: "2024-01-31"}, {Type: TokenMinus, Text: "-"}, {Type: TokenNumber, Text: "1"}}},
+		{"2024-01", []Token{{Type: TokenNumber, Text: "2024"}, {Type: TokenMinus, Text: "-"}, {Type: TokenNumber, Text: "01"}}},
+		{"'a b'+abc", []Token{{Type: TokenString, Text: "'a b'"}, {Type: TokenPlus, Text: "+"}, {Type: TokenName, Text: "abc"}}},
+		// Names are read by the spec rules, which read longer tokens.
+		{"x1", []Token{{Type: TokenName, Text: "x1"}}},
+		{"'a", []Token{{Type: TokenError, Text: `unexpected character '\''`}}},
+	}
+	for _, test := range tests {
+		l := BuildLexer(spec, test.source)
+		for k, v := range test.tokens {
+			if r := l.Next(); r.Type != v.Type || r.Text != v.Text {
+				t.Errorf("%q: token %d: expected %#v, got %#v", test.source, k, v, r)
+			}
+		}
+		if r := l.Next(); r.Type != TokenEOF && test.tokens[len(test.tokens)-1].Type != TokenError {
+			t.Errorf("%q: expected EOF, got %v", test.source, r)
+		}
+	}
+
+	// Patterns may span lines.
+	spec = &LexerSpec{}
+	spec.AddPattern(TokenString, "`[^`]*`")
+	l := BuildLexer(spec, "`a\nb` c")
+	expected := []Token{
+		{Type: TokenString, Text: "`a\nb`", Pos: Pos{Offset: 0, Line: 1, Col: 1}},
+		{Type: TokenName, Text: "c", Pos: Pos{Offset: 6, Line: 2, Col: 4}},
+	}
+	for k, v := range expected {
+		if r := l.Next(); r != v {
+			t.Errorf("token %d: expected %#v, got %#v", k, v, r)
+		}
+	}
+}
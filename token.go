@@ -6,6 +6,7 @@ package bantam
 
 import (
 	"fmt"
+	"strconv"
 )
 
 const (
@@ -26,10 +27,67 @@ const (
 	TokenParenR      // )
 	TokenColon       // :
 	TokenComma       // ,
+	// Newer types are appended below, so that the values above don't change.
+	// Error; the token text is the error message.
+	TokenError
+	// Line break, only emitted when newlines are significant.
+	TokenNewline
+	// Comment, only emitted when comments are kept; the token text is the
+	// whole comment, including its delimiters.
+	TokenComment
+	// Indentation changes, only emitted when indentation is significant.
+	TokenIndent
+	TokenDedent
+	// Literals
+	TokenNumber
+	TokenString // The token text is the unescaped value.
+	// More operators
+	TokenSemicolon   // ;
+	TokenAmpersand   // &
+	TokenPipe        // |
+	TokenShiftLeft   // <<
+	TokenShiftRight  // >>
+	TokenAnd         // &&
+	TokenOr          // ||
+	TokenLess        // <
+	TokenGreater     // >
+	TokenLessEq      // <=
+	TokenGreaterEq   // >=
+	TokenEqual       // ==
+	TokenNotEqual    // !=
+	TokenIncrement   // ++
+	TokenDecrement   // --
+	TokenElvis       // ?:
+	TokenPlusAssign  // +=
+	TokenMinusAssign // -=
+	TokenMulAssign   // *=
+	TokenDivAssign   // /=
+	TokenPower       // **
+	TokenBraceL      // {
+	TokenBraceR      // }
+	// String interpolation, like "a ${b} c ${d} e". The token text is the
+	// unescaped string part: "a ", " c " and " e".
+	TokenInterpStart // "a ${
+	TokenInterpMid   // } c ${
+	TokenInterpEnd   // } e"
+	// Keywords
+	TokenFn    // fn
+	TokenNull  // null
+	TokenIf    // if
+	TokenElse  // else
+	TokenWhile // while
 )
 
 var tokenNames = map[TokenType]string{
 	TokenEOF:         "EOF",
+	TokenError:       "error",
+	TokenNewline:     "newline",
+	TokenComment:     "comment",
+	TokenIndent:      "indent",
+	TokenDedent:      "dedent",
+	TokenName:        "name",
+	TokenNumber:      "number",
+	TokenString:      "string",
 	TokenAsterisk:    "*",
 	TokenSlash:       "/",
 	TokenPlus:        "+",
@@ -43,6 +101,46 @@ var tokenNames = map[TokenType]string{
 	TokenParenR:      ")",
 	TokenColon:       ":",
 	TokenComma:       ",",
+	TokenSemicolon:   ";",
+	TokenAmpersand:   "&",
+	TokenPipe:        "|",
+	TokenShiftLeft:   "<<",
+	TokenShiftRight:  ">>",
+	TokenAnd:         "&&",
+	TokenOr:          "||",
+	TokenLess:        "<",
+	TokenGreater:     ">",
+	TokenLessEq:      "<=",
+	TokenGreaterEq:   ">=",
+	TokenEqual:       "==",
+	TokenNotEqual:    "!=",
+	TokenIncrement:   "++",
+	TokenDecrement:   "--",
+	TokenElvis:       "?:",
+	TokenPlusAssign:  "+=",
+	TokenMinusAssign: "-=",
+	TokenMulAssign:   "*=",
+	TokenDivAssign:   "/=",
+	TokenPower:       "**",
+	TokenBraceL:      "{",
+	TokenBraceR:      "}",
+	TokenInterpStart: `"${`,
+	TokenInterpMid:   "}${",
+	TokenInterpEnd:   `}"`,
+	TokenFn:          "fn",
+	TokenNull:        "null",
+	TokenIf:          "if",
+	TokenElse:        "else",
+	TokenWhile:       "while",
+}
+
+// RegisterTokenName sets the name used to print a token type, so that
+// custom token types are shown with meaningful names in error messages.
+//
+// It is not safe to call it concurrently with parsing or printing tokens;
+// register names during initialization, before any parsing starts.
+func RegisterTokenName(t TokenType, name string) {
+	tokenNames[t] = name
 }
 
 // TokenType identifies the type of Tokens.
@@ -52,17 +150,45 @@ func (t TokenType) String() string {
 	if s, ok := tokenNames[t]; ok {
 		return s
 	}
-	return fmt.Sprintf("<%s>", t)
+	return fmt.Sprintf("<%d>", int(t))
 }
 
 type Token struct {
 	Type TokenType
 	Text string
+	Pos  Pos
 }
 
+// String returns the token text for literals, quoting names so that they
+// can't be confused with operators, or the token type name otherwise.
+// Custom token types without a registered name are shown by their text.
 func (t Token) String() string {
-	if s, ok := tokenNames[t.Type]; ok {
-		return s
+	switch t.Type {
+	case TokenName:
+		return strconv.Quote(t.Text)
+	case TokenError, TokenNumber:
+		return t.Text
 	}
-	return t.Text
+	if _, ok := tokenNames[t.Type]; !ok && t.Text != "" {
+		return t.Text
+	}
+	return t.Type.String()
+}
+
+// Pos is a position in the source. Lines and columns start at 1, and the
+// column counts bytes. The zero value means the position is unknown.
+type Pos struct {
+	Offset int // Byte offset, starting at 0.
+	Line   int
+	Col    int
+}
+
+// Position returns the position itself. It allows nodes to embed a Pos to
+// implement the Node interface.
+func (p Pos) Position() Pos {
+	return p
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Col)
 }
@@ -0,0 +1,97 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"testing"
+)
+
+func TestTokenTypeString(t *testing.T) {
+	tests := map[TokenType]string{
+		TokenEOF:       "EOF",
+		TokenName:      "name",
+		TokenNumber:    "number",
+		TokenPlus:      "+",
+		TokenFn:        "fn",
+		TokenType(999): "<999>",
+	}
+	for typ, expected := range tests {
+		if r := typ.String(); r != expected {
+			t.Errorf("expected %q, got %q", expected, r)
+		}
+	}
+}
+
+func TestTokenTypeValues(t *testing.T) {
+	// The original token types keep their values; new ones are appended.
+	tests := map[TokenType]int{
+		TokenEOF:      0,
+		TokenName:     1,
+		TokenAsterisk: 2,
+		TokenComma:    14,
+		TokenError:    15,
+	}
+	for typ, expected := range tests {
+		if int(typ) != expected {
+			t.Errorf("expected %s to be %d, got %d", typ, expected, int(typ))
+		}
+	}
+}
+
+func TestTokenString(t *testing.T) {
+	tests := map[Token]string{
+		{Type: TokenEOF}:               "EOF",
+		{Type: TokenName, Text: "foo"}: `"foo"`,
+		{Type: TokenName, Text: ""}:    `""`,
+		{Type: TokenName, Text: "a b"}: `"a b"`,
+		{Type: TokenNumber, Text: "4"}: "4",
+		{Type: TokenPlus}:              "+",
+		{Type: TokenType(999)}:         "<999>",
+		{Type: 999, Text: "=>"}:        "=>",
+	}
+	for token, expected := range tests {
+		if r := token.String(); r != expected {
+			t.Errorf("expected %q, got %q", expected, r)
+		}
+	}
+}
+
+type arrowParser int
+
+func (arrowParser) Parse(parser *Parser, token Token) Node {
+	parser.Expect(tokenArrow)
+	return NewNameNode(token.Text)
+}
+
+const tokenArrow TokenType = 1000
+
+func TestRegisterTokenName(t *testing.T) {
+	RegisterTokenName(tokenArrow, "=>")
+	defer delete(tokenNames, tokenArrow)
+
+	if r := tokenArrow.String(); r != "=>" {
+		t.Errorf("expected %q, got %q", "=>", r)
+	}
+	if r := (Token{Type: tokenArrow}).String(); r != "=>" {
+		t.Errorf("expected %q, got %q", "=>", r)
+	}
+
+	p := newParser("a b").Clone()
+	p.PrefixParsers[TokenName] = arrowParser(0)
+	_, err := p.Parse()
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	if r := err.Error(); r != "expected token [=>] and found name" {
+		t.Errorf("unexpected error: %q", r)
+	}
+}
+
+func TestTokenStringInErrors(t *testing.T) {
+	_, err := newParser("a foo").Parse()
+	if err == nil || err.Error() != `unexpected token "foo" after expression` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+
+package bantam
+
+// TypedPrefixParser is like PrefixParser, for a TypedParser building
+// nodes of type N.
+type TypedPrefixParser[N any] interface {
+	Parse(parser *TypedParser[N], token Token) N
+}
+
+// TypedInfixParser is like InfixParser, for a TypedParser building nodes
+// of type N.
+type TypedInfixParser[N any] interface {
+	Parse(parser *TypedParser[N], left N, token Token) N
+	Precedence() int
+}
+
+// TypedParser is a Pratt parser like Parser that builds nodes of a type
+// chosen by the caller, like the node interface of an existing AST,
+// instead of Node. It runs the same algorithm on the same tokens, but only
+// the core of it: the options of Parser, like word operators, operator
+// sections or error recovery, are not available.
+//
+// Parselets report errors calling Errorf or the Stack's Expect.
+// Expressions are parsed recursively, so set MaxDepth when parsing
+// untrusted input.
+type TypedParser[N any] struct {
+	*Stack
+	PrefixParsers map[TokenType]TypedPrefixParser[N]
+	InfixParsers  map[TokenType]TypedInfixParser[N]
+	// MaxDepth limits how deeply expressions can be nested. Zero means no
+	// limit.
+	MaxDepth int
+	depth    int
+}
+
+// NewTypedParser returns a TypedParser for the given token stack, without
+// parselets: they are registered with Prefix and Infix.
+func NewTypedParser[N any](stack *Stack) *TypedParser[N] {
+	return &TypedParser[N]{
+		Stack:         stack,
+		PrefixParsers: map[TokenType]TypedPrefixParser[N]{},
+		InfixParsers:  map[TokenType]TypedInfixParser[N]{},
+	}
+}
+
+// Prefix registers a prefix parselet for a token type.
+func (p *TypedParser[N]) Prefix(t TokenType, parser TypedPrefixParser[N]) *TypedParser[N] {
+	p.PrefixParsers[t] = parser
+	return p
+}
+
+// Infix registers an infix parselet for a token type.
+func (p *TypedParser[N]) Infix(t TokenType, parser TypedInfixParser[N]) *TypedParser[N] {
+	p.InfixParsers[t] = parser
+	return p
+}
+
+// Parse parses a whole expression, up to EOF.
+func (p *TypedParser[N]) Parse() (n N, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			var zero N
+			n, err = zero, p.panicError(e)
+		}
+	}()
+	p.depth = 0
+	if p.Peek(0).Type == TokenEOF {
+		p.errorf("empty input")
+	}
+	n = p.ParseExpression(0)
+	if err := p.expectEOF(); err != nil {
+		panic(err)
+	}
+	return n, nil
+}
+
+// ParseExpression parses an expression, stopping at the first operator
+// with a precedence lower than or equal to the given one. It is called by
+// parselets to parse their operands.
+func (p *TypedParser[N]) ParseExpression(precedence int) N {
+	p.depth++
+	if p.MaxDepth > 0 && p.depth > p.MaxDepth {
+		p.errorf("expression too deeply nested")
+	}
+	token := p.Pop()
+	for token.Type == TokenNewline {
+		// An operand can start on the next line.
+		token = p.Pop()
+	}
+	prefix, ok := p.PrefixParsers[token.Type]
+	if !ok {
+		p.Push(token)
+		p.errorf("could not parse %s", token)
+	}
+	left := prefix.Parse(p, token)
+	for precedence < p.precedence() {
+		token = p.Pop()
+		left = p.InfixParsers[token.Type].Parse(p, left, token)
+	}
+	p.depth--
+	return left
+}
+
+// Errorf stops parsing and makes Parse return a *ParseError at the
+// position of the next token.
+func (p *TypedParser[N]) Errorf(format string, args ...interface{}) {
+	p.errorf(format, args...)
+}
+
+// precedence returns the precedence of the next token, or 0 if it is not
+// an infix operator.
+func (p *TypedParser[N]) precedence() int {
+	if parser, ok := p.InfixParsers[p.Peek(0).Type]; ok {
+		return parser.Precedence()
+	}
+	return 0
+}
+
+// ----------------------------------------------------------------------------
+
+// TypedLeaf returns a prefix parselet for single-token expressions, like
+// names and numbers.
+func TypedLeaf[N any](node func(token Token) N) TypedPrefixParser[N] {
+	return typedLeaf[N](node)
+}
+
+type typedLeaf[N any] func(Token) N
+
+func (f typedLeaf[N]) Parse(parser *TypedParser[N], token Token) N {
+	return f(token)
+}
+
+// TypedGroup returns a prefix parselet for parentheses: the node of the
+// inner expression is returned as is.
+func TypedGroup[N any]() TypedPrefixParser[N] {
+	return typedGroup[N]{}
+}
+
+type typedGroup[N any] struct{}
+
+func (typedGroup[N]) Parse(parser *TypedParser[N], token Token) N {
+	n := parser.ParseExpression(0)
+	parser.Expect(TokenParenR)
+	return n
+}
+
+// TypedUnary returns a prefix parselet for unary operators with the given
+// precedence.
+func TypedUnary[N any](precedence int, node func(op Token, right N) N) TypedPrefixParser[N] {
+	return typedUnary[N]{precedence, node}
+}
+
+type typedUnary[N any] struct {
+	precedence int
+	node       func(Token, N) N
+}
+
+func (u typedUnary[N]) Parse(parser *TypedParser[N], token Token) N {
+	return u.node(token, parser.ParseExpression(u.precedence))
+}
+
+// TypedBinary returns an infix parselet for binary operators with the
+// given precedence and associativity.
+func TypedBinary[N any](precedence int, assoc Assoc, node func(op Token, left, right N) N) TypedInfixParser[N] {
+	return typedBinary[N]{OperatorParser{Prec: precedence, Assoc: assoc}, node}
+}
+
+type typedBinary[N any] struct {
+	op   OperatorParser
+	node func(Token, N, N) N
+}
+
+func (b typedBinary[N]) Parse(parser *TypedParser[N], left N, token Token) N {
+	precedence := b.op.Prec
+	if b.op.Assoc == AssocRight {
+		precedence--
+	}
+	right := parser.ParseExpression(precedence)
+	if b.op.Assoc == AssocNone && parser.precedence() == b.op.Prec {
+		parser.errorf("operator '%s' is not associative", token)
+	}
+	return b.node(token, left, right)
+}
+
+func (b typedBinary[N]) Precedence() int {
+	return b.op.Prec
+}
@@ -0,0 +1,84 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+
+package bantam
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// calc is a TypedParser that evaluates arithmetic while parsing.
+func calc(src string) (float64, error) {
+	p := NewTypedParser[float64](NewStack(NewLexer(src)))
+	p.Prefix(TokenNumber, TypedLeaf(func(t Token) float64 {
+		f, _ := strconv.ParseFloat(t.Text, 64)
+		return f
+	}))
+	p.Prefix(TokenParenL, TypedGroup[float64]())
+	p.Prefix(TokenMinus, TypedUnary(PrecPrefix, func(op Token, x float64) float64 {
+		return -x
+	}))
+	arith := func(op Token, a, b float64) float64 {
+		switch op.Type {
+		case TokenPlus:
+			return a + b
+		case TokenMinus:
+			return a - b
+		case TokenAsterisk:
+			return a * b
+		case TokenSlash:
+			return a / b
+		}
+		return a
+	}
+	p.Infix(TokenPlus, TypedBinary(PrecSum, AssocLeft, arith))
+	p.Infix(TokenMinus, TypedBinary(PrecSum, AssocLeft, arith))
+	p.Infix(TokenAsterisk, TypedBinary(PrecProduct, AssocLeft, arith))
+	p.Infix(TokenSlash, TypedBinary(PrecProduct, AssocLeft, arith))
+	p.Infix(TokenCaret, TypedBinary(PrecExponent, AssocRight, func(op Token, a, b float64) float64 {
+		r := 1.0
+		for i := 0; i < int(b); i++ {
+			r *= a
+		}
+		return r
+	}))
+	return p.Parse()
+}
+
+func TestTypedParser(t *testing.T) {
+	tests := []struct {
+		src  string
+		want float64
+		err  string
+	}{
+		{src: "1 + 2 * 3", want: 7},
+		{src: "(1 + 2) * 3", want: 9},
+		{src: "8 - 4 - 2", want: 2},
+		{src: "-2 * 3", want: -6},
+		{src: "2 ^ 3 ^ 2", want: 512},
+		{src: "", err: "empty input"},
+		{src: "1 +", err: "could not parse"},
+		{src: "(1 + 2", err: "expected"},
+		{src: "1 2", err: "unexpected token"},
+	}
+	for _, test := range tests {
+		got, err := calc(test.src)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%q: got error %v, want %q", test.src, err, test.err)
+			}
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("%q: got error %T, want *ParseError", test.src, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("%q: got %v, %v, want %v", test.src, got, err, test.want)
+		}
+	}
+}
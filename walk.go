@@ -0,0 +1,153 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"sort"
+)
+
+// Walk traverses a tree in depth-first order, calling fn for each node
+// before its children. If fn returns false, the children of that node are
+// not visited. Nodes unknown to this package are visited but have no
+// children.
+func Walk(n Node, fn func(Node) bool) {
+	if n == nil || !fn(n) {
+		return
+	}
+	switch n := n.(type) {
+	case *AssignNode:
+		Walk(n.Right, fn)
+	case *BinaryNode:
+		Walk(n.Left, fn)
+		Walk(n.Right, fn)
+	case *BlockNode:
+		for _, v := range n.Exprs {
+			Walk(v, fn)
+		}
+	case *BracketNode:
+		Walk(n.Inner, fn)
+	case *ElvisNode:
+		Walk(n.Left, fn)
+		Walk(n.Right, fn)
+	case *FunctionNode:
+		Walk(n.Function, fn)
+		Walk(n.Args, fn)
+	case *IfNode:
+		Walk(n.Cond, fn)
+		Walk(n.Then, fn)
+		Walk(n.Else, fn)
+	case *InterpolationNode:
+		for _, v := range n.Exprs {
+			Walk(v, fn)
+		}
+	case *ExprStmt:
+		Walk(n.X, fn)
+	case *LambdaNode:
+		Walk(n.Body, fn)
+	case *ListNode:
+		for _, v := range n.Nodes {
+			Walk(v, fn)
+		}
+	case *ProgramNode:
+		for _, v := range n.Stmts {
+			Walk(v, fn)
+		}
+	case *MixfixNode:
+		for _, v := range n.Operands {
+			Walk(v, fn)
+		}
+	case *SequenceNode:
+		Walk(n.First, fn)
+		Walk(n.Second, fn)
+	case *TernaryNode:
+		Walk(n.Condition, fn)
+		Walk(n.List, fn)
+		Walk(n.ElseList, fn)
+	case *UnaryNode:
+		Walk(n.Right, fn)
+	case *UnaryPostfixNode:
+		Walk(n.Left, fn)
+	case *WhileNode:
+		Walk(n.Cond, fn)
+		Walk(n.Body, fn)
+	}
+}
+
+// FreeNames returns the sorted names of the variables read by an
+// expression.
+//
+// Assignment targets are not included unless they are also read, like in
+// "a = a + 1". Callee names are not included either, so "f(a)" returns only
+// "a"; a callee that is not a plain name, like "(a ? f : g)(b)", is an
+// expression and its names are included. Lambda parameters are bound
+// inside the lambda body, so "fn(x) x + y" returns only "y".
+func FreeNames(n Node) []string {
+	set := make(map[string]bool)
+	freeNames(n, set)
+	names := make([]string, 0, len(set))
+	for name := range set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// freeNames adds the free names of an expression to set.
+func freeNames(n Node, set map[string]bool) {
+	Walk(n, func(n Node) bool {
+		switch n := n.(type) {
+		case *NameNode:
+			set[n.Name] = true
+		case *FunctionNode:
+			if _, ok := n.Function.(*NameNode); !ok {
+				freeNames(n.Function, set)
+			}
+			freeNames(n.Args, set)
+			return false
+		case *LambdaNode:
+			body := make(map[string]bool)
+			freeNames(n.Body, body)
+			for _, param := range n.Params {
+				delete(body, param)
+			}
+			for name := range body {
+				set[name] = true
+			}
+			return false
+		}
+		return true
+	})
+}
+
+// Stats returns how many times each operator is used in an expression,
+// keyed by the operator token type, like TokenPlus for "+" in binary and
+// unary expressions. Two keys have a special meaning: TokenName counts
+// names, including the names of called functions, and TokenParenL counts
+// function calls. Word operators like "and" are not counted.
+func Stats(n Node) map[TokenType]int {
+	stats := make(map[TokenType]int)
+	Walk(n, func(n Node) bool {
+		switch n := n.(type) {
+		case *BinaryNode:
+			if n.Word == "" {
+				stats[n.Operator]++
+			}
+		case *UnaryNode:
+			if n.Word == "" {
+				stats[n.Operator]++
+			}
+		case *UnaryPostfixNode:
+			if n.Word == "" {
+				stats[n.Operator]++
+			}
+		case *FunctionNode:
+			stats[TokenParenL]++
+		case *NameNode:
+			stats[TokenName]++
+		}
+		return true
+	})
+	return stats
+}
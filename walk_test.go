@@ -0,0 +1,99 @@
+// Copyright 2013 Rodrigo Moraes. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package bantam
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	n, err := newParser("a = -b ? f(c, 1) : d!").Parse()
+	if err != nil {
+		t.Fatalf("error parsing: %v", err)
+	}
+	var nodes []string
+	Walk(n, func(n Node) bool {
+		nodes = append(nodes, n.String())
+		return true
+	})
+	expected := []string{
+		"(a = ((-b) ? f(c, 1) : (d!)))",
+		"((-b) ? f(c, 1) : (d!))",
+		"(-b)", "b",
+		"f(c, 1)", "f(c, 1)", "f", "c1", "c", "1",
+		"(d!)", "(d!)", "d",
+	}
+	if strings.Join(nodes, " | ") != strings.Join(expected, " | ") {
+		t.Errorf("expected %q, got %q", expected, nodes)
+	}
+
+	// Skip children.
+	nodes = nil
+	Walk(n, func(n Node) bool {
+		nodes = append(nodes, n.String())
+		_, ok := n.(*TernaryNode)
+		return !ok
+	})
+	if len(nodes) != 2 {
+		t.Errorf("expected 2 nodes, got %q", nodes)
+	}
+}
+
+func TestFreeNames(t *testing.T) {
+	tests := map[string]string{
+		"a = b + f(c, c)":    "b c",
+		"a = a + 1":          "a",
+		"a ? b : c":          "a b c",
+		"f(a)(b)":            "a b",
+		"(a ? f : g)(b)":     "a b f g",
+		"fn(x) x + y":        "y",
+		"fn(x) fn(y) x + z":  "z",
+		"g(fn(f) f(a))":      "a",
+		"x + (fn(x) x)":      "x",
+		"-a! , null, b <= 2": "a b",
+	}
+	for src, expected := range tests {
+		n, err := newParser(src).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", src, err)
+			continue
+		}
+		if r := strings.Join(FreeNames(n), " "); r != expected {
+			t.Errorf("%q: expected %q, got %q", src, expected, r)
+		}
+	}
+}
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		source string
+		stats  map[TokenType]int
+	}{
+		{"a + b + c * d", map[TokenType]int{TokenPlus: 2, TokenAsterisk: 1, TokenName: 4}},
+		{"-a - b!", map[TokenType]int{TokenMinus: 2, TokenExclamation: 1, TokenName: 2}},
+		{"f(a, g(1))", map[TokenType]int{TokenParenL: 2, TokenName: 3}},
+		{"x = a ? 1 : 2", map[TokenType]int{TokenName: 1}},
+		{"1", map[TokenType]int{}},
+	}
+	for _, test := range tests {
+		n, err := newParser(test.source).Parse()
+		if err != nil {
+			t.Errorf("%q: error parsing: %v", test.source, err)
+			continue
+		}
+		stats := Stats(n)
+		if len(stats) != len(test.stats) {
+			t.Errorf("%q: expected %v, got %v", test.source, test.stats, stats)
+			continue
+		}
+		for k, v := range test.stats {
+			if stats[k] != v {
+				t.Errorf("%q: expected %v, got %v", test.source, test.stats, stats)
+				break
+			}
+		}
+	}
+}